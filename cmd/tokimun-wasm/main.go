@@ -0,0 +1,42 @@
+//go:build js && wasm
+
+// Command tokimun-wasm exposes the compiler to JavaScript for the browser
+// playground. Build it with
+//
+//	GOOS=js GOARCH=wasm go build -o tokimun.wasm ./cmd/tokimun-wasm
+//
+// It registers a global tokimunCompile(source) function that returns an
+// object with either a code or an error field, plus any warnings.
+package main
+
+import (
+	"syscall/js"
+
+	"github.com/micr0/tokimun/compiler"
+)
+
+func main() {
+	js.Global().Set("tokimunCompile", js.FuncOf(compile))
+
+	// Keep the exported function alive
+	select {}
+}
+
+func compile(this js.Value, args []js.Value) any {
+	if len(args) != 1 || args[0].Type() != js.TypeString {
+		return map[string]any{"error": "tokimunCompile expects a source string"}
+	}
+
+	warnings := []any{}
+	options := compiler.Options{
+		Warn: func(w compiler.Warning) {
+			warnings = append(warnings, w.String())
+		},
+	}
+
+	code, err := compiler.Compile(args[0].String(), options)
+	if err != nil {
+		return map[string]any{"error": err.Error(), "warnings": warnings}
+	}
+	return map[string]any{"code": code, "warnings": warnings}
+}
@@ -0,0 +1,163 @@
+package compiler
+
+import (
+	"io"
+)
+
+// Node is a node of the syntax tree recorded by Parse. The compiler works
+// in a single pass, so the tree mirrors the grammar rules it applies:
+// statements hold their expressions and nested statements as children,
+// binary and unary expressions keep their operator in Value, and names
+// and literals are leaves with their source text in Value.
+type Node struct {
+	Type     string  `json:"type"`
+	Value    string  `json:"value,omitempty"`
+	Line     int     `json:"line"`
+	Column   int     `json:"column"`
+	Children []*Node `json:"children,omitempty"`
+}
+
+// Parse returns the syntax tree of source, for tools that want to work
+// with tokimun programs without reimplementing the parser
+func Parse(source string) (*Node, error) {
+	tokens, err := NewLexer(source).Tokenize()
+	if err != nil {
+		return nil, err
+	}
+
+	root := &Node{Type: "Program", Line: 1, Column: 1}
+	compiler := NewCompiler(tokens, Options{})
+	compiler.nodes = []*Node{root}
+	if err := compiler.CompileTo(io.Discard); err != nil {
+		return nil, err
+	}
+
+	return root, nil
+}
+
+// passThrough are the expression levels that only get a node of their
+// own when they apply an operator
+var passThrough = map[string]bool{
+	"Binary":  true,
+	"Compare": true,
+	"Primary": true,
+}
+
+// node opens a tree node for the construct starting at the current token
+// and returns the function that closes it, for use as
+//
+//	defer c.node("While")()
+func (c *Compiler) node(typ string) func() {
+	if c.nodes == nil {
+		return func() {}
+	}
+
+	token := c.peek()
+	n := &Node{Type: typ, Line: token.Line, Column: token.Column}
+	parent := c.nodes[len(c.nodes)-1]
+	parent.Children = append(parent.Children, n)
+	c.nodes = append(c.nodes, n)
+
+	return func() { c.closeNode(n) }
+}
+
+func (c *Compiler) closeNode(n *Node) {
+	for len(c.nodes) > 1 {
+		top := c.nodes[len(c.nodes)-1]
+		c.nodes = c.nodes[:len(c.nodes)-1]
+		if top == n {
+			break
+		}
+	}
+
+	// An expression level without an operator is just its operand
+	if passThrough[n.Type] && n.Value == "" && len(n.Children) == 1 {
+		parent := c.nodes[len(c.nodes)-1]
+		parent.Children[len(parent.Children)-1] = n.Children[0]
+	}
+}
+
+// leaf adds a node for a single token
+func (c *Compiler) leaf(typ string, token Token) {
+	if c.nodes == nil {
+		return
+	}
+	parent := c.nodes[len(c.nodes)-1]
+	parent.Children = append(parent.Children, &Node{Type: typ, Value: token.Value, Line: token.Line, Column: token.Column})
+}
+
+// setNode changes the type and value of the innermost open node, once
+// the compiler knows what it's looking at
+func (c *Compiler) setNode(typ string, value string) {
+	if c.nodes == nil {
+		return
+	}
+	n := c.nodes[len(c.nodes)-1]
+	n.Type = typ
+	n.Value = value
+}
+
+// binaryOp records an operator at the current expression level. A second
+// operator makes what came before its left operand, so a - b + c is
+// (a - b) + c.
+func (c *Compiler) binaryOp(op string) {
+	if c.nodes == nil {
+		return
+	}
+	n := c.nodes[len(c.nodes)-1]
+	if n.Value != "" {
+		left := *n
+		n.Children = []*Node{&left}
+	}
+	n.Value = op
+}
+
+// compareOp records a comparison operator. A chain like a < b <= c is a
+// single Compare node with the operators separated by spaces in Value.
+func (c *Compiler) compareOp(op string) {
+	if c.nodes == nil {
+		return
+	}
+	n := c.nodes[len(c.nodes)-1]
+	if n.Value == "" || n.Value == "in" {
+		c.binaryOp(op)
+		return
+	}
+	n.Value += " " + op
+}
+
+// wrap moves the children of the innermost open node under a new node,
+// which stays open until the returned function is called. It records
+// suffixes like calls, whose callee has already been parsed.
+func (c *Compiler) wrap(typ string, value string) func() {
+	if c.nodes == nil {
+		return func() {}
+	}
+
+	parent := c.nodes[len(c.nodes)-1]
+	n := &Node{Type: typ, Value: value, Line: parent.Line, Column: parent.Column, Children: parent.Children}
+	if len(parent.Children) > 0 {
+		n.Line, n.Column = parent.Children[0].Line, parent.Children[0].Column
+	}
+	parent.Children = []*Node{n}
+	c.nodes = append(c.nodes, n)
+
+	return func() { c.closeNode(n) }
+}
+
+// markNode and truncateNodes let the compiler drop what it recorded when
+// it backtracks
+func (c *Compiler) markNode() int {
+	if c.nodes == nil {
+		return 0
+	}
+	return len(c.nodes[len(c.nodes)-1].Children)
+}
+
+func (c *Compiler) truncateNodes(mark int) {
+	if c.nodes == nil {
+		return
+	}
+	n := c.nodes[len(c.nodes)-1]
+	n.Children = n.Children[:mark]
+}
@@ -0,0 +1,42 @@
+package compiler
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestParseGolden compares the syntax tree of testdata/ast.tkm, as
+// --emit-ast prints it, with testdata/ast.json. Run with -update after
+// an intended change to the tree.
+func TestParseGolden(t *testing.T) {
+	source, err := os.ReadFile("testdata/ast.tkm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := Parse(string(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.MarshalIndent(tree, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	if *update {
+		if err := os.WriteFile("testdata/ast.json", got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile("testdata/ast.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("syntax tree of testdata/ast.tkm is\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,41 @@
+package compiler
+
+import "fmt"
+
+// closerOf pairs each opening bracket with the one that closes it
+var closerOf = map[TokenType]TokenType{
+	TOKEN_LPAREN:           TOKEN_RPAREN,
+	TOKEN_LBRACKET:         TOKEN_RBRACKET,
+	TOKEN_QUESTION_BRACKET: TOKEN_RBRACKET,
+	TOKEN_LBRACE:           TOKEN_RBRACE,
+}
+
+// checkBalanced makes sure every (, [, ?[ and { in tokens is closed by
+// the matching bracket, so a missing or stray one is reported where it
+// is rather than wherever the parser trips over it later
+func checkBalanced(tokens []Token) error {
+	open := []Token{}
+	for _, token := range tokens {
+		switch token.Type {
+		case TOKEN_LPAREN, TOKEN_LBRACKET, TOKEN_QUESTION_BRACKET, TOKEN_LBRACE:
+			open = append(open, token)
+		case TOKEN_RPAREN, TOKEN_RBRACKET, TOKEN_RBRACE:
+			if len(open) == 0 {
+				return &CompileError{Line: token.Line, Column: token.Column,
+					Message: fmt.Sprintf("unexpected '%s' with no bracket open", token.Value)}
+			}
+			opener := open[len(open)-1]
+			if closerOf[opener.Type] != token.Type {
+				return &CompileError{Line: token.Line, Column: token.Column,
+					Message: fmt.Sprintf("'%s' doesn't match the '%s' opened at line %d", token.Value, opener.Value, opener.Line)}
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	if len(open) > 0 {
+		opener := open[len(open)-1]
+		return &CompileError{Line: opener.Line, Column: opener.Column,
+			Message: fmt.Sprintf("'%s' opened at line %d is never closed", opener.Value, opener.Line)}
+	}
+	return nil
+}
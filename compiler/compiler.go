@@ -0,0 +1,4849 @@
+// Package compiler translates tokimun source into Lua.
+//
+// Most callers only need Compile or CompileTo. The Lexer, Token and
+// Compiler types are exposed for tools that want the token stream or to
+// drive the phases separately.
+package compiler
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Compile compiles tokimun source to Lua
+func Compile(source string, options Options) (string, error) {
+	var output strings.Builder
+	if err := CompileTo(&output, source, options); err != nil {
+		return "", err
+	}
+	return output.String(), nil
+}
+
+// CompileTo compiles tokimun source, writing the Lua to w as it goes
+func CompileTo(w io.Writer, source string, options Options) error {
+	lexer := NewLexer(source)
+	tokens, err := lexer.Tokenize()
+	if err != nil {
+		return err
+	}
+
+	compiler := NewCompiler(tokens, options)
+	return compiler.CompileTo(w)
+}
+
+// Options controls how the compiler generates Lua
+type Options struct {
+	Header          string // Emitted verbatim before the compiled code; with PreserveLines, its lines are joined onto the first one
+	PreserveLines   bool   // Pad output so statements stay on their source line
+	Target          string // Lua version the output runs on: "5.1" rules out goto; empty is DefaultTarget
+	Globals         string // "lua" keeps Lua's global-by-default assignments; "local" (default) declares new names local
+	EmitTarget      bool   // Start the output with a TargetPragma comment naming Target
+	Indent          string // One level of indentation in the output, two spaces by default
+	NoNegativeIndex bool   // Compile t[-1] as Lua would, instead of as the last element
+	SafeFloatLoops  bool   // Count the iterations of numeric for loops with a float step
+	MaxLineLength   int    // Break longer output lines after commas and operators; 0 never does
+	KeepComments    bool   // Copy all comments to the output, not just doc comments
+	WrapMain        bool   // Compile the file into a function called with its varargs, whose result it returns
+	Annotations     bool   // Put ---@param and ---@return comments above function declarations, for EmmyLua-aware tools
+	CheckBalanced   bool   // Check that brackets pair up before compiling, for clearer errors about them
+
+	// ResolveRequire maps a relative require path like "./utils" to the
+	// module name Lua should load. Without it, requires are left as is.
+	ResolveRequire func(path string) (string, error)
+	Lint           bool          // Also report likely mistakes (see the lint* codes)
+	LuacheckIgnore bool          // Wrap statements that declare temporaries in luacheck ignore comments
+	Warn           func(Warning) // Called for each warning; nil discards them
+}
+
+// DefaultTarget is the Lua version compiled for when Options.Target is
+// empty
+const DefaultTarget = "5.4"
+
+// TargetPragma starts the comment that records the Lua version the output
+// was compiled for, as in `-- tokimun-target: 5.1`
+const TargetPragma = "-- tokimun-target: "
+
+// Warning is a non-fatal problem found while compiling. Warnings can be
+// silenced on a line with a `-- tokimun:disable=code` comment.
+type Warning struct {
+	Line    int
+	Column  int
+	Code    string // Stable name of the kind of warning, e.g. "unused"
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("line %d:%d: %s [%s]", w.Line, w.Column, w.Message, w.Code)
+}
+
+// CompileError is an error at a position in the source. Compile and
+// Parse return one for every syntax error.
+type CompileError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *CompileError) Error() string {
+	return fmt.Sprintf("line %d:%d: %s", e.Line, e.Column, e.Message)
+}
+
+// Lint codes, only reported when Options.Lint is set
+const (
+	lintUnused            = "unused"               // Local variable that is never read
+	lintAssignInCondition = "assign-in-condition"  // `if a = b` where `==` was meant
+	lintNilCheck          = "nil-check"            // `a ~= nil and a.b` instead of `a?.b`
+	lintShadowBuiltin     = "shadow-builtin"       // Local named like a Lua builtin
+	lintGlobalShadowsLoc  = "global-shadows-local" // `global x` while a local x is in scope
+	lintFloatStep         = "float-step"           // Numeric for with a fractional step
+	lintShadowSelf        = "shadow-self"          // Function in a method taking its own self parameter
+	lintTruncatedCall     = "truncated-call"       // Call returning several values before the last argument
+)
+
+// luaBuiltins are the standard globals that locals shouldn't hide
+var luaBuiltins = map[string]bool{
+	"_G": true, "_ENV": true, "assert": true, "collectgarbage": true, "coroutine": true,
+	"debug": true, "dofile": true, "error": true, "getmetatable": true, "io": true,
+	"ipairs": true, "load": true, "loadstring": true, "math": true, "next": true,
+	"os": true, "package": true, "pairs": true, "pcall": true, "print": true,
+	"rawequal": true, "rawget": true, "rawlen": true, "rawset": true, "require": true,
+	"select": true, "setmetatable": true, "string": true, "table": true,
+	"tonumber": true, "tostring": true, "type": true, "unpack": true, "utf8": true,
+	"xpcall": true,
+}
+
+// Compiler generates Lua from a token stream in a single pass
+type Compiler struct {
+	tokens         []Token
+	current        int
+	output         strings.Builder
+	indent         int
+	scopes         []map[string]*variable // Track declared variables per scope
+	labelScopes    []*labelScope          // Goto labels of each scope, alongside scopes
+	loopDepth      int                    // Track nested loops for continue
+	continueLabels []int                  // Unique labels for continue
+	usedContinues  map[int]bool           // Continue labels some continue jumps to
+	labelCounter   int
+	loopLabels     []loopLabel      // Enclosing labeled loops, innermost last
+	switchDepth    int              // Track nested switches
+	noMethodCalls  bool             // Disable method call parsing (for case expressions)
+	functions      []*functionFrame // Enclosing function bodies, innermost last
+	lastStatement  TokenType        // Kind of the most recently compiled statement
+	noTableCalls   bool             // Disable f{...} call parsing (for brace block conditions)
+	assignTarget   bool             // The next atom may be assigned to, so inf and nan are names
+	blockValue     bool             // Next statement may be the value of a do expression
+	synthetic      bool             // The current statement declared temporaries of its own
+	inDoExpression bool             // Inside a do expression, where break can't reach outer loops
+	varargUses     int              // Uses of the current function's `...` so far, see forwardVarargs
+	multiReturns   map[string]bool  // Functions declared so far that return several values
+	freezeHelper   string           // Name of the file's freeze function, once there is one
+	helpers        string           // Helper functions to declare before the current top-level statement
+	enumTables     []*enumTable     // Tables of block-scoped const enums in the current top-level statement
+	options        Options
+	directives     []directive
+	docComments    []Token        // Doc comments not yet written, in source order
+	lineComments   map[int]string // Kept comments after code by line, "" once written
+	touching       map[int]string // Comments starting where the code token at an index ends, see decrement
+	metadata       Metadata
+	nodes          []*Node // Open syntax tree nodes when recording for Parse
+}
+
+// loopLabel is a labeled loop that `break name` can exit and
+// `continue name` can go on with
+type loopLabel struct {
+	name string
+	exit int // Number of the __break_N__ label after the loop
+	loop int // Index of the loop's own label in continueLabels
+	used bool
+}
+
+// directive is a `-- tokimun:name codes` comment. Directives that
+// trail code on the same line apply only to that line.
+type directive struct {
+	token    Token
+	name     string
+	codes    []string // Empty means every code
+	trailing bool
+}
+
+// knownDirectives lists the directive names the compiler understands
+var knownDirectives = map[string]bool{
+	"disable":           true, // Whole file, or just its line when trailing code
+	"disable-next-line": true,
+}
+
+// variable is a declared local
+type variable struct {
+	token   Token // Where it was declared
+	param   bool
+	used    bool
+	loopVar bool              // Variable of a for loop, which assigning to doesn't affect
+	enum    map[string]string // Member values of a const enum, inlined where used
+	table   *enumTable        // Where a block-scoped const enum's table may go
+}
+
+// enumTable is the table of a const enum declared in a block. Whether the
+// block uses the enum as a value is only known once it ends, so the
+// output has a marker in its place until then.
+type enumTable struct {
+	marker string // Stands for the declaration's line in the output
+	line   string // The declaration, "" if the enum is never used as a value
+	from   int    // Token after the enum, where its scope starts
+}
+
+// labelScope tracks the goto labels of a block, to check that every goto
+// has a label it can jump to, following Lua's rules: a label is visible
+// in its block and the blocks nested in it, but not in nested functions,
+// and a goto can't jump forward into the scope of a local unless the
+// label ends the block.
+type labelScope struct {
+	function  bool // Outermost block of a function, which gotos can't leave
+	labels    map[string]Token
+	locals    []Token       // Locals declared in the block, in order
+	pending   []pendingGoto // Forward gotos waiting for their label
+	intoLocal []pendingGoto // Gotos into a local's scope, fine if their label ends the block
+}
+
+// pendingGoto is a goto and how many locals its block had at the time
+type pendingGoto struct {
+	token  Token
+	locals int
+	local  Token // For intoLocal, the local being jumped into
+}
+
+func newLabelScope() *labelScope {
+	return &labelScope{labels: map[string]Token{}}
+}
+
+// functionFrame tracks per-function state while compiling its body
+type functionFrame struct {
+	scopeDepth int      // len(scopes) inside the function body
+	defers     []string // Deferred calls in declaration order
+	deferArgs  bool     // Some deferred call uses the function's `...`
+	method     bool     // Declared with ':', so self is its receiver
+	name       string   // Declared name, empty for anonymous functions
+	multi      bool     // Some return gives several values
+}
+
+// touches reports whether comment starts right where token, a name or
+// ']' that could end an assignment target, ends
+func touches(token Token, comment Token) bool {
+	switch token.Type {
+	case TOKEN_IDENT, TOKEN_RBRACKET:
+		return token.Line == comment.Line && token.Column+len(token.Value) == comment.Column
+	}
+	return false
+}
+
+// NewCompiler returns a compiler for tokens, as produced by Tokenize
+func NewCompiler(tokens []Token, options Options) *Compiler {
+	if options.Target == "" {
+		options.Target = DefaultTarget
+	}
+
+	// Directive comments are read by the compiler, not parsed
+	code := make([]Token, 0, len(tokens))
+	codeLines := map[int]bool{}
+	directiveTokens := []Token{}
+	docComments := []Token{}
+	touching := map[int]string{}
+	for _, token := range tokens {
+		switch token.Type {
+		case TOKEN_DIRECTIVE:
+			directiveTokens = append(directiveTokens, token)
+		case TOKEN_DOC_COMMENT:
+			docComments = append(docComments, token)
+		case TOKEN_COMMENT:
+			// i-- lexes as i and an empty comment, which the compiler
+			// tells apart from a comment once it knows i is a statement
+			if n := len(code); n > 0 && touches(code[n-1], token) {
+				touching[n-1] = token.Value
+				if token.Value == "--" {
+					continue
+				}
+			}
+			if options.KeepComments {
+				docComments = append(docComments, token)
+			}
+		case TOKEN_NEWLINE, TOKEN_EOF:
+			code = append(code, token)
+		default:
+			if token.Type == TOKEN_STRING && (options.Target == "5.1" || options.Target == "5.2") {
+				token.Value = unicodeEscapes(token.Value)
+			}
+			if token.Type == TOKEN_STRING && options.Target == "5.1" {
+				token.Value = longStringLevel(stripZEscapes(token.Value))
+			}
+			code = append(code, token)
+			codeLines[token.Line] = true
+		}
+	}
+
+	directives := []directive{}
+	for _, token := range directiveTokens {
+		// Accepts both `disable unused, nil-check` and `disable=unused`
+		name, rest := token.Value, ""
+		if i := strings.IndexAny(token.Value, " \t="); i >= 0 {
+			name, rest = token.Value[:i], token.Value[i+1:]
+		}
+		codes := strings.FieldsFunc(rest, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		directives = append(directives, directive{
+			token:    token,
+			name:     name,
+			codes:    codes,
+			trailing: codeLines[token.Line],
+		})
+	}
+
+	// Doc comments after code on the same line have no statement of
+	// their own to go before, so only whole line ones are kept, unless
+	// all comments are, when they stay at the end of their line
+	ownLine := docComments[:0]
+	lineComments := map[int]string{}
+	for _, token := range docComments {
+		switch {
+		case !codeLines[token.Line]:
+			ownLine = append(ownLine, token)
+		case options.KeepComments && lineComments[token.Line] != "":
+			lineComments[token.Line] += " " + token.Value
+		case options.KeepComments:
+			lineComments[token.Line] = token.Value
+			ownLine = append(ownLine, token)
+		}
+	}
+
+	return &Compiler{
+		tokens:         code,
+		directives:     directives,
+		docComments:    ownLine,
+		lineComments:   lineComments,
+		touching:       touching,
+		metadata:       Metadata{Functions: map[string]Symbol{}, Globals: map[string]Symbol{}, Requires: []string{}},
+		options:        options,
+		current:        0,
+		indent:         0,
+		scopes:         []map[string]*variable{make(map[string]*variable)},
+		labelScopes:    []*labelScope{newLabelScope()},
+		loopDepth:      0,
+		continueLabels: []int{},
+		usedContinues:  map[int]bool{},
+		labelCounter:   0,
+		multiReturns:   map[string]bool{},
+	}
+}
+
+// stripZEscapes applies the \z escapes of a quoted string literal, which
+// Lua 5.1 doesn't understand, by removing them and the whitespace after
+func stripZEscapes(literal string) string {
+	if literal == "" || (literal[0] != '"' && literal[0] != '\'') || !strings.Contains(literal, "\\z") {
+		return literal
+	}
+
+	var result strings.Builder
+	for i := 0; i < len(literal); i++ {
+		if literal[i] != '\\' || i+1 == len(literal) {
+			result.WriteByte(literal[i])
+			continue
+		}
+		if literal[i+1] != 'z' {
+			result.WriteString(literal[i : i+2])
+			i++
+			continue
+		}
+		i += 2
+		for i < len(literal) && strings.IndexByte(" \t\r\n", literal[i]) >= 0 {
+			i++
+		}
+		i--
+	}
+	return result.String()
+}
+
+// unicodeEscapes spells the \u{XXX} escapes of a quoted string literal,
+// which Lua before 5.3 doesn't understand, as their UTF-8 bytes. The
+// bytes are written as decimal escapes because 5.1 has no \xNN either.
+func unicodeEscapes(literal string) string {
+	if literal == "" || (literal[0] != '"' && literal[0] != '\'') || !strings.Contains(literal, "\\u{") {
+		return literal
+	}
+
+	var result strings.Builder
+	for i := 0; i < len(literal); i++ {
+		if literal[i] != '\\' || i+1 == len(literal) {
+			result.WriteByte(literal[i])
+			continue
+		}
+		if literal[i+1] != 'u' {
+			result.WriteString(literal[i : i+2])
+			i++
+			continue
+		}
+		// The lexer has checked the escape is well formed
+		end := i + strings.IndexByte(literal[i:], '}')
+		value, _ := strconv.ParseUint(literal[i+3:end], 16, 32)
+		for _, b := range []byte(string(rune(value))) {
+			fmt.Fprintf(&result, "\\%03d", b)
+		}
+		i = end
+	}
+	return result.String()
+}
+
+// longStringLevel gives a [[...]] literal that contains "[[" a level of
+// equals signs, since Lua 5.1 rejects nested [[ in a level 0 long string.
+// The level is the lowest one that the content can't close early.
+func longStringLevel(literal string) string {
+	if !strings.HasPrefix(literal, "[[") || !strings.Contains(literal[2:len(literal)-2], "[[") {
+		return literal
+	}
+	content := literal[2 : len(literal)-2]
+	for equals := "="; ; equals += "=" {
+		closing := "]" + equals + "]"
+		if strings.Index(content+closing, closing) == len(content) {
+			return "[" + equals + "[" + content + closing
+		}
+	}
+}
+
+// spaceLongString pads a long string literal used as a key, because
+// `t[[[k]]]` would read as t followed by the long string [[[k]]
+func spaceLongString(literal string) string {
+	if strings.HasPrefix(literal, "[") {
+		return " " + literal + " "
+	}
+	return literal
+}
+
+// Compile returns the generated Lua
+func (c *Compiler) Compile() (string, error) {
+	var output strings.Builder
+	if err := c.CompileTo(&output); err != nil {
+		return "", err
+	}
+	return output.String(), nil
+}
+
+// CompileTo writes the generated Lua to w as each top-level statement is
+// compiled. With PreserveLines the whole output is needed for alignment,
+// so it's written once at the end.
+func (c *Compiler) CompileTo(w io.Writer) error {
+	if c.options.CheckBalanced {
+		if err := checkBalanced(c.tokens); err != nil {
+			return err
+		}
+	}
+
+	// Preserved lines have no room for the header, so it goes in front
+	// of the first line at the end
+	if !c.options.PreserveLines {
+		c.output.WriteString(c.header())
+	}
+
+	// Wrapped, top-level locals are the function's, and a top-level
+	// return is the module's value. When preserving lines the function
+	// starts on the first statement's line rather than taking one of its own.
+	if c.options.WrapMain {
+		if c.options.PreserveLines {
+			c.output.WriteString("return (function(...) ")
+		} else {
+			c.output.WriteString("return (function(...)\n")
+			c.indent++
+		}
+	}
+
+	for _, d := range c.directives {
+		if !knownDirectives[d.name] {
+			c.warn(d.token, "unknown-directive", fmt.Sprintf("unknown directive 'tokimun:%s'", d.name))
+		}
+	}
+
+	for !c.isAtEnd() {
+		start, line := c.output.Len(), c.peek().Line
+		if err := c.statement(); err != nil {
+			return err
+		}
+		c.declareHelpers(start, line)
+		c.placeEnumTables()
+		if !c.options.PreserveLines {
+			if err := c.flush(w); err != nil {
+				return err
+			}
+		}
+	}
+	c.writeDocComments(c.peek().Line + 1)
+	c.checkUnused(c.scopes[0])
+	if err := c.checkGotos(); err != nil {
+		return err
+	}
+	if c.options.WrapMain {
+		if !c.options.PreserveLines {
+			c.indent--
+		}
+		c.output.WriteString("end)(...)\n")
+	}
+
+	if c.options.PreserveLines {
+		output := alignLines(c.wrapLong(c.output.String()))
+		header := inlineComments(c.header())
+		if header != "" && (output == "" || output[0] == '\n') {
+			header = strings.TrimSuffix(header, " ")
+		}
+		_, err := io.WriteString(w, header+output)
+		return err
+	}
+	return c.flush(w)
+}
+
+// declareHelpers puts the helper functions the top-level statement at
+// start of the output needs in front of it, so they're declared once for
+// the rest of the file. With preserved lines they share the statement's
+// first line, after its line marker.
+func (c *Compiler) declareHelpers(start int, line int) {
+	if c.helpers == "" {
+		return
+	}
+	output := c.output.String()
+	at, helpers := start, strings.Repeat(c.indentUnit(), c.indent)+c.helpers+"\n"
+	if c.options.PreserveLines {
+		marker := fmt.Sprintf("%c%d%c", lineMarker, line, lineMarker)
+		at, helpers = start+strings.Index(output[start:], marker)+len(marker), c.helpers+" "
+	}
+	c.output.Reset()
+	c.output.WriteString(output[:at] + helpers + output[at:])
+	c.helpers = ""
+}
+
+// placeEnumTables replaces the markers of block-scoped enum tables,
+// whose blocks have all ended with the top-level statement, with their
+// declarations
+func (c *Compiler) placeEnumTables() {
+	if len(c.enumTables) == 0 {
+		return
+	}
+	output := c.output.String()
+	for _, table := range c.enumTables {
+		output = strings.Replace(output, table.marker, table.line, 1)
+	}
+	c.output.Reset()
+	c.output.WriteString(output)
+	c.enumTables = nil
+}
+
+// header returns what goes before the compiled code: the Header option
+// and the TargetPragma comment
+func (c *Compiler) header() string {
+	header := c.options.Header
+	if c.options.EmitTarget && c.options.Target != "" {
+		header += TargetPragma + c.options.Target + "\n"
+	}
+	return header
+}
+
+// inlineComments puts the lines of header on one line, turning each
+// -- comment into a --[[ ]] comment so the code after it isn't
+// commented out:
+//
+//	--[[ Generated by tokimun ]] --[[ tokimun-target: 5.4 ]] local x = 1
+func inlineComments(header string) string {
+	var inline strings.Builder
+	for _, line := range strings.Split(header, "\n") {
+		line = strings.TrimSpace(line)
+		if text, ok := strings.CutPrefix(line, "--"); ok {
+			text = strings.TrimSpace(text)
+			equals := ""
+			for strings.Contains(text, "]"+equals+"]") {
+				equals += "="
+			}
+			line = "--[" + equals + "[ " + text + " ]" + equals + "]"
+		}
+		if line != "" {
+			inline.WriteString(line + " ")
+		}
+	}
+	return inline.String()
+}
+
+// flush moves the compiled output so far to w
+func (c *Compiler) flush(w io.Writer) error {
+	if _, err := io.WriteString(w, c.wrapLong(c.output.String())); err != nil {
+		return err
+	}
+	c.output.Reset()
+	return nil
+}
+
+// wrapLong breaks the long lines of output if MaxLineLength is set
+func (c *Compiler) wrapLong(output string) string {
+	if c.options.MaxLineLength <= 0 {
+		return output
+	}
+	return wrapLines(output, c.options.MaxLineLength, c.indentUnit())
+}
+
+// writeDocComments writes the doc comments from before line, so they
+// come out just above the statement they were above in the source. Ones
+// at the end of a block come out before the statement after it, as do
+// kept comments after code that no statement ended on.
+func (c *Compiler) writeDocComments(line int) {
+	for len(c.docComments) > 0 && c.docComments[0].Line < line {
+		if comment, ok := c.lineComments[c.docComments[0].Line]; ok {
+			c.lineComments[c.docComments[0].Line] = ""
+			c.docComments[0].Value = comment
+			if comment == "" {
+				c.docComments = c.docComments[1:]
+				continue
+			}
+		}
+		if c.options.PreserveLines {
+			c.output.WriteString(fmt.Sprintf("%c%d%c", lineMarker, c.docComments[0].Line, lineMarker))
+		}
+		c.writeIndent()
+		c.output.WriteString(c.docComments[0].Value + "\n")
+		c.docComments = c.docComments[1:]
+	}
+}
+
+// writeAnnotations writes ---@param and ---@return comments for the
+// function the statement ahead declares, if it does. Parameters without
+// a type annotation are any.
+func (c *Compiler) writeAnnotations() {
+	i := c.current
+	if kind := c.tokens[i].Type; kind == TOKEN_LOCAL || kind == TOKEN_GLOBAL {
+		i++
+	}
+	if c.tokens[i].Type != TOKEN_FUNCTION {
+		return
+	}
+	for c.tokens[i].Type != TOKEN_LPAREN {
+		if c.tokens[i].Type == TOKEN_EOF {
+			return
+		}
+		i++
+	}
+
+	// The types are parsed ahead and again when compiling the function,
+	// which reports any errors
+	current, nodes := c.current, c.nodes
+	c.current, c.nodes = i+1, nil
+	defer func() { c.current, c.nodes = current, nodes }()
+
+	var lines []string
+	for c.peek().Type == TOKEN_IDENT || c.peek().Type == TOKEN_DOTDOTDOT {
+		name, spelling := c.advance().Value, "any"
+		if c.peek().Type == TOKEN_COLON {
+			c.advance()
+			var err error
+			if spelling, err = c.typeExpression(); err != nil {
+				return
+			}
+		}
+		lines = append(lines, "---@param "+name+" "+spelling)
+		if c.peek().Type != TOKEN_COMMA {
+			break
+		}
+		c.advance()
+	}
+	if c.peek().Type != TOKEN_RPAREN {
+		return
+	}
+	if c.advance(); c.peek().Type == TOKEN_COLON {
+		c.advance()
+		results, err := c.typeResults()
+		if err != nil {
+			return
+		}
+		for _, result := range results {
+			lines = append(lines, "---@return "+result)
+		}
+	}
+
+	for _, line := range lines {
+		c.writeIndent()
+		c.output.WriteString(line + "\n")
+	}
+}
+
+// writeLineComment puts the kept comment after the code on the line the
+// statement just compiled ended on at the end of its output, if it's the
+// last statement on that line
+func (c *Compiler) writeLineComment() {
+	line := c.previous().Line
+	comment := c.lineComments[line]
+	if comment == "" || (c.peek().Line == line && c.peek().Type != TOKEN_EOF) {
+		return
+	}
+	c.lineComments[line] = ""
+
+	output := c.output.String()
+	if !strings.HasSuffix(output, "\n") {
+		c.output.WriteString(" " + comment)
+		return
+	}
+	c.output.Reset()
+	c.output.WriteString(output[:len(output)-1] + " " + comment + "\n")
+}
+
+// lineMarker delimits the source line numbers that statement() records
+// in the output when lines are being preserved
+const lineMarker = '\x00'
+
+// enumMarker delimits the placeholders of enum tables, see enumTable
+const enumMarker = '\x01'
+
+// alignLines strips the line markers from the output and pads it with
+// blank lines so that each statement starts on the line it came from.
+// Statements that expand to several Lua lines push later ones down.
+func alignLines(output string) string {
+	var result strings.Builder
+	lines := strings.Split(output, "\n")
+	outLine := 1
+
+	for i, line := range lines {
+		// A line may carry several markers (e.g. after a defer, which
+		// emits nothing); the last one belongs to the code on the line
+		target := 0
+		for {
+			start := strings.IndexByte(line, lineMarker)
+			if start == -1 {
+				break
+			}
+			end := start + 1 + strings.IndexByte(line[start+1:], lineMarker)
+			target, _ = strconv.Atoi(line[start+1 : end])
+			line = line[:start] + line[end+1:]
+		}
+
+		for outLine < target {
+			result.WriteString("\n")
+			outLine++
+		}
+		result.WriteString(line)
+		if i < len(lines)-1 {
+			result.WriteString("\n")
+			outLine++
+		}
+	}
+
+	return result.String()
+}
+
+func (c *Compiler) statement() error {
+	// Only a do expression's own statements can be its value
+	blockValue := c.blockValue
+	c.blockValue = false
+
+	// Semicolons can separate statements on one line
+	if c.peek().Type == TOKEN_SEMICOLON {
+		c.advance()
+		return nil
+	}
+
+	c.writeDocComments(c.peek().Line)
+	if c.options.Annotations {
+		c.writeAnnotations()
+	}
+	if c.options.PreserveLines {
+		c.output.WriteString(fmt.Sprintf("%c%d%c", lineMarker, c.peek().Line, lineMarker))
+	}
+
+	kind := c.peek().Type
+	if kind != TOKEN_EOF {
+		defer c.node(statementNodes[kind])()
+	}
+	if kind != TOKEN_DOUBLECOLON && kind != TOKEN_EOF {
+		if into := c.labelScopes[len(c.labelScopes)-1].intoLocal; len(into) > 0 {
+			return c.errorf(into[0].token, "goto '%s' jumps into the scope of local '%s'", into[0].token.Value, into[0].local.Value)
+		}
+	}
+	start := c.output.Len()
+	outerSynthetic := c.synthetic
+	c.synthetic = false
+	defer func() { c.synthetic = outerSynthetic }()
+	var err error
+
+	switch kind {
+	case TOKEN_GLOBAL:
+		err = c.globalDeclaration()
+	case TOKEN_LOCAL:
+		err = c.localDeclaration()
+	case TOKEN_FUNCTION:
+		err = c.functionDeclaration()
+	case TOKEN_IF:
+		err = c.ifStatement()
+	case TOKEN_UNLESS:
+		err = c.unlessStatement()
+	case TOKEN_GUARD:
+		err = c.guardStatement()
+	case TOKEN_WHILE:
+		err = c.whileStatement()
+	case TOKEN_FOR:
+		err = c.forStatement()
+	case TOKEN_REPEAT:
+		err = c.repeatStatement()
+	case TOKEN_DO:
+		if c.isDoWhile() {
+			kind = TOKEN_REPEAT
+			c.setNode("DoWhile", "")
+			err = c.doWhileStatement()
+			break
+		}
+		err = c.doStatement()
+	case TOKEN_DEFER:
+		err = c.deferStatement()
+	case TOKEN_DOUBLECOLON:
+		err = c.labelStatement()
+	case TOKEN_SWITCH:
+		err = c.switchStatement()
+	case TOKEN_EOF:
+		return nil
+	default:
+		if kind == TOKEN_IDENT && c.peek().Value == "const" && c.peekNext().Value == "enum" && c.peekAt(2).Type == TOKEN_IDENT {
+			kind = TOKEN_LOCAL
+			c.setNode("ConstEnum", c.peekAt(2).Value)
+			err = c.constEnum()
+			break
+		}
+		if c.isStaticAssert() {
+			c.setNode("StaticAssert", "")
+			err = c.staticAssert()
+			break
+		}
+		if kind == TOKEN_IDENT && c.peekNext().Type == TOKEN_COLON && isLoopKeyword(c.peekAt(2).Type) {
+			kind = c.peekAt(2).Type
+			c.setNode("LabeledLoop", "")
+			err = c.labeledLoop()
+			break
+		}
+		kind, err = c.simpleStatement(blockValue)
+	}
+
+	if err == nil {
+		c.writeLineComment()
+	}
+	if err == nil && c.synthetic && c.options.LuacheckIgnore {
+		c.luacheckIgnore(start)
+	}
+	c.lastStatement = kind
+	return err
+}
+
+// luacheckIgnorePattern matches the names of the compiler's temporaries
+// (see newTemp) in luacheck's inline options
+const luacheckIgnorePattern = "__.*__"
+
+// luacheckIgnore wraps the statement output after start in comments that
+// stop luacheck from reporting its temporaries, which may shadow each
+// other or go unused. Warnings about the user's own names still show.
+func (c *Compiler) luacheckIgnore(start int) {
+	output := c.output.String()
+	c.output.Reset()
+	c.output.WriteString(output[:start])
+	c.writeIndent()
+	c.output.WriteString("-- luacheck: push ignore " + luacheckIgnorePattern + "\n")
+	c.output.WriteString(output[start:])
+	if !strings.HasSuffix(output, "\n") {
+		c.output.WriteString("\n")
+	}
+	c.writeIndent()
+	c.output.WriteString("-- luacheck: pop\n")
+}
+
+// statementNodes names the syntax tree node of each kind of statement.
+// Statements starting with a name are refined once they're parsed.
+var statementNodes = map[TokenType]string{
+	TOKEN_GLOBAL:      "Global",
+	TOKEN_LOCAL:       "Local",
+	TOKEN_FUNCTION:    "Function",
+	TOKEN_IF:          "If",
+	TOKEN_UNLESS:      "Unless",
+	TOKEN_GUARD:       "Guard",
+	TOKEN_WHILE:       "While",
+	TOKEN_FOR:         "For",
+	TOKEN_REPEAT:      "Repeat",
+	TOKEN_DO:          "Do",
+	TOKEN_DEFER:       "Defer",
+	TOKEN_DOUBLECOLON: "Label",
+	TOKEN_SWITCH:      "Switch",
+	TOKEN_RETURN:      "Return",
+	TOKEN_BREAK:       "Break",
+	TOKEN_CONTINUE:    "Continue",
+	TOKEN_GOTO:        "Goto",
+	TOKEN_IDENT:       "Expression",
+	TOKEN_LPAREN:      "Expression",
+}
+
+// simpleStatement compiles a single-line statement (return, break,
+// continue, goto, assignment or call) along with an optional trailing
+// if/unless/while modifier on the same line: `doThing() unless done`.
+// It returns the kind of statement that was emitted, TOKEN_IF or
+// TOKEN_WHILE when a modifier wrapped it.
+func (c *Compiler) simpleStatement(blockValue bool) (TokenType, error) {
+	kind := c.peek().Type
+
+	savedOutput := c.output.String()
+	c.output.Reset()
+
+	var err error
+	switch kind {
+	case TOKEN_RETURN:
+		err = c.returnStatement()
+	case TOKEN_BREAK:
+		err = c.breakStatement()
+	case TOKEN_CONTINUE:
+		err = c.continueStatement()
+	case TOKEN_GOTO:
+		err = c.gotoStatement()
+	default:
+		var isValue bool
+		isValue, err = c.expressionStatement(blockValue)
+		if isValue {
+			kind = TOKEN_RETURN
+		}
+	}
+	if err != nil {
+		return kind, err
+	}
+
+	stmtStr := c.output.String()
+	c.output.Reset()
+	c.output.WriteString(savedOutput)
+
+	// A modifier must be on the same line, otherwise it starts a new statement
+	modifier := c.peek()
+	if modifier.Line != c.previous().Line ||
+		(modifier.Type != TOKEN_IF && modifier.Type != TOKEN_UNLESS && modifier.Type != TOKEN_WHILE) {
+		c.output.WriteString(stmtStr)
+		return kind, nil
+	}
+	c.advance()
+	defer c.wrap("Modifier", modifier.Value)()
+
+	// A return's own locals, see returnThroughDefers, stay in the if
+	if kind != TOKEN_RETURN && strings.HasPrefix(strings.TrimLeft(stmtStr, " \t"), "local ") {
+		return kind, c.errorf(modifier, "cannot declare a variable in a statement with '%s'", modifier.Value)
+	}
+
+	c.writeIndent()
+	switch modifier.Type {
+	case TOKEN_IF:
+		c.output.WriteString("if ")
+	case TOKEN_UNLESS:
+		c.output.WriteString("if not (")
+	case TOKEN_WHILE:
+		c.output.WriteString("while ")
+	}
+	if err := c.expression(); err != nil {
+		return kind, err
+	}
+	switch modifier.Type {
+	case TOKEN_IF:
+		c.output.WriteString(" then\n")
+	case TOKEN_UNLESS:
+		c.output.WriteString(") then\n")
+	case TOKEN_WHILE:
+		c.output.WriteString(" do\n")
+	}
+
+	// Re-indent the statement inside the generated block
+	for _, line := range strings.SplitAfter(stmtStr, "\n") {
+		if line != "" {
+			c.output.WriteString(c.indentUnit())
+			c.output.WriteString(line)
+		}
+	}
+
+	c.writeIndent()
+	c.output.WriteString("end\n")
+
+	if modifier.Type == TOKEN_WHILE {
+		return TOKEN_WHILE, nil
+	}
+	return TOKEN_IF, nil
+}
+
+func (c *Compiler) globalDeclaration() error {
+	c.advance() // consume 'global'
+
+	if c.peek().Type != TOKEN_IDENT {
+		return c.errorf(c.peek(), "expected identifier after 'global'")
+	}
+
+	nameToken := c.advance()
+	name := nameToken.Value
+	c.leaf("Name", nameToken)
+	c.recordGlobal(nameToken)
+
+	if c.isVariableDeclared(name) {
+		c.lint(nameToken, lintGlobalShadowsLoc, fmt.Sprintf("'global %s' assigns the local '%s' in scope, not a global", name, name))
+	}
+
+	if c.peek().Type == TOKEN_ASSIGN {
+		c.advance() // consume '='
+		c.writeIndent()
+		c.output.WriteString(name)
+		c.output.WriteString(" = ")
+		if err := c.expression(); err != nil {
+			return err
+		}
+		c.output.WriteString("\n")
+	} else {
+		// Just declare as global (in Lua, we don't need to do anything special)
+		c.writeIndent()
+		c.output.WriteString(name)
+		c.output.WriteString(" = nil\n")
+	}
+
+	return nil
+}
+
+func (c *Compiler) localDeclaration() error {
+	c.advance() // consume 'local'
+
+	if c.peek().Type == TOKEN_FUNCTION {
+		c.setNode("LocalFunction", "")
+		return c.localFunctionDeclaration()
+	}
+
+	if c.peek().Type != TOKEN_IDENT {
+		return c.errorf(c.peek(), "expected identifier after 'local'")
+	}
+
+	c.writeIndent()
+	c.output.WriteString("local ")
+
+	// Handle multiple declarations: local a, b, c = 1, 2, 3
+	names := []string{}
+	for {
+		if c.peek().Type != TOKEN_IDENT {
+			return c.errorf(c.peek(), "expected identifier")
+		}
+		nameToken := c.advance()
+		names = append(names, nameToken.Value)
+		c.declareVariable(nameToken)
+		c.leaf("Name", nameToken)
+
+		if c.peek().Type != TOKEN_COMMA {
+			break
+		}
+		c.advance() // consume ','
+	}
+
+	c.output.WriteString(strings.Join(names, ", "))
+
+	if c.peek().Type == TOKEN_ASSIGN {
+		c.advance() // consume '='
+		c.output.WriteString(" = ")
+		if err := c.expressionList(); err != nil {
+			return err
+		}
+	}
+	c.output.WriteString("\n")
+
+	return nil
+}
+
+// constEnum compiles `const enum Name { A = 1, B = 2 }`. Its members are
+// inlined where they're used, so the enum only becomes a local table if
+// the rest of the file uses it as a value.
+func (c *Compiler) constEnum() error {
+	c.advance() // consume 'const'
+	c.advance() // consume 'enum'
+	nameToken := c.advance()
+
+	if c.peek().Type != TOKEN_LBRACE {
+		return c.errorf(c.peek(), "expected '{' after enum name")
+	}
+	c.advance()
+
+	members := map[string]string{}
+	fields := []string{}
+	for c.peek().Type != TOKEN_RBRACE && !c.isAtEnd() {
+		if c.peek().Type != TOKEN_IDENT || c.peekNext().Type != TOKEN_ASSIGN {
+			return c.errorf(c.peek(), "expected 'name = value' in enum '%s'", nameToken.Value)
+		}
+		closeEntry := c.node("Entry")
+		member := c.advance()
+		c.leaf("Key", member)
+		c.advance() // consume '='
+		if _, exists := members[member.Value]; exists {
+			return c.errorf(member, "duplicate member '%s' in enum '%s'", member.Value, nameToken.Value)
+		}
+
+		// Values must be literals so they can be inlined
+		value := ""
+		if c.peek().Type == TOKEN_MINUS && c.peekNext().Type == TOKEN_NUMBER {
+			c.advance()
+			value = "-"
+		}
+		switch c.peek().Type {
+		case TOKEN_NUMBER:
+			converted, warning, err := convertNumber(c.peek().Value, c.options.Target)
+			if err != nil {
+				return c.errorf(c.peek(), "%v", err)
+			}
+			if warning != "" {
+				c.warn(c.peek(), "precision-loss", warning)
+			}
+			value += converted
+			if strings.HasPrefix(value, "-") {
+				value = "(" + value + ")" // So x - E.A can't become x --1
+			}
+		case TOKEN_STRING, TOKEN_TRUE, TOKEN_FALSE:
+			if value == "" {
+				value = c.peek().Value
+				break
+			}
+			fallthrough
+		default:
+			return c.errorf(c.peek(), "enum member '%s' must be a number, string or boolean literal", member.Value)
+		}
+		c.leaf("Value", c.advance())
+		closeEntry()
+
+		members[member.Value] = value
+		fields = append(fields, member.Value+" = "+value)
+
+		if c.peek().Type == TOKEN_COMMA || c.peek().Type == TOKEN_SEMICOLON {
+			c.advance()
+		}
+	}
+
+	if c.peek().Type != TOKEN_RBRACE {
+		return c.errorf(c.peek(), "expected '}' to close enum '%s'", nameToken.Value)
+	}
+	c.advance()
+
+	declaration := strings.Repeat(c.indentUnit(), c.indent) +
+		fmt.Sprintf("local %s = {%s}\n", nameToken.Value, strings.Join(fields, ", "))
+
+	// A top-level enum's scope is the rest of the file. One in a block is
+	// settled when the block ends, by popScope.
+	var table *enumTable
+	if len(c.scopes) > 1 {
+		table = &enumTable{
+			marker: fmt.Sprintf("%c%d%c", enumMarker, len(c.enumTables), enumMarker),
+			line:   declaration,
+			from:   c.current,
+		}
+		c.enumTables = append(c.enumTables, table)
+		c.output.WriteString(table.marker)
+	} else if c.enumUsedAsValue(nameToken.Value, c.current, len(c.tokens)) {
+		c.output.WriteString(declaration)
+	}
+
+	c.declareVariable(nameToken)
+	c.lookupVariable(nameToken.Value).enum = members
+	c.lookupVariable(nameToken.Value).table = table
+	return nil
+}
+
+// enumUsedAsValue reports whether name appears in tokens[from:to] other
+// than as name.member. It ignores shadowing, so a nested variable of the
+// same name also counts, which only costs an unneeded table.
+func (c *Compiler) enumUsedAsValue(name string, from, to int) bool {
+	member := regexp.MustCompile(`\b` + regexp.QuoteMeta(name) + `\b(\.[a-zA-Z_])?`)
+	for i := from; i < to; i++ {
+		token := c.tokens[i]
+		switch token.Type {
+		case TOKEN_IDENT:
+			if token.Value != name {
+				continue
+			}
+			if prev := c.tokens[i-1].Type; prev == TOKEN_DOT || prev == TOKEN_COLON || prev == TOKEN_QUESTION_DOT {
+				continue // A field of the same name
+			}
+			if i+2 < len(c.tokens) && c.tokens[i+1].Type == TOKEN_DOT && c.tokens[i+2].Type == TOKEN_IDENT {
+				continue
+			}
+			return true
+		case TOKEN_TEMPLATE_STRING:
+			for _, match := range member.FindAllStringSubmatch(token.Value, -1) {
+				if match[1] == "" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (c *Compiler) localFunctionDeclaration() error {
+	c.advance() // consume 'function'
+
+	if c.peek().Type != TOKEN_IDENT {
+		return c.errorf(c.peek(), "expected function name")
+	}
+
+	nameToken := c.advance()
+	name := nameToken.Value
+	c.declareVariable(nameToken)
+	c.leaf("Name", nameToken)
+	c.recordFunction(name, nameToken, true)
+
+	c.writeIndent()
+	c.output.WriteString("local function ")
+	c.output.WriteString(name)
+
+	return c.functionBody(name, false)
+}
+
+func (c *Compiler) functionDeclaration() error {
+	c.advance() // consume 'function'
+
+	// Function name (can be dotted: foo.bar.baz)
+	if c.peek().Type != TOKEN_IDENT {
+		return c.errorf(c.peek(), "expected function name")
+	}
+
+	// Only a plain name can be a new local; M.foo sets a field
+	local := c.implicitLocals() && c.peekNext().Type != TOKEN_DOT && c.peekNext().Type != TOKEN_COLON
+	c.writeIndent()
+	if local {
+		c.output.WriteString("local ")
+	}
+	c.output.WriteString("function ")
+
+	nameToken := c.advance()
+	c.output.WriteString(nameToken.Value)
+	if local {
+		c.declareVariable(nameToken)
+	}
+	c.leaf("Name", nameToken)
+
+	// Handle method syntax: function foo:bar()
+	name := nameToken.Value
+	method := false
+	for c.peek().Type == TOKEN_DOT || c.peek().Type == TOKEN_COLON {
+		separator := c.advance().Value
+		c.output.WriteString(separator)
+		if c.peek().Type != TOKEN_IDENT {
+			return c.errorf(c.peek(), "expected identifier after '.' or ':'")
+		}
+		part := c.advance()
+		c.output.WriteString(part.Value)
+		c.leaf("Name", part)
+		name += separator + part.Value
+		method = separator == ":"
+	}
+	c.recordFunction(name, nameToken, local)
+
+	return c.functionBody(name, method)
+}
+
+// functionBody compiles the parameters and body of a function. A method
+// gets self from Lua; functions inside it see that self as an upvalue.
+// name is empty for anonymous functions.
+func (c *Compiler) functionBody(name string, method bool) error {
+	if c.peek().Type != TOKEN_LPAREN {
+		return c.errorf(c.peek(), "expected '(' after function name")
+	}
+	c.advance()
+	c.output.WriteString("(")
+
+	c.pushScope()
+
+	// Parameters
+	first := true
+	for c.peek().Type != TOKEN_RPAREN && !c.isAtEnd() {
+		if !first {
+			c.output.WriteString(", ")
+		}
+		first = false
+
+		if c.peek().Type == TOKEN_DOTDOTDOT {
+			c.leaf("Param", c.advance())
+			c.output.WriteString("...")
+		} else if c.peek().Type == TOKEN_IDENT {
+			nameToken := c.advance()
+			if nameToken.Value == "self" && c.inMethod() {
+				c.lint(nameToken, lintShadowSelf, "parameter 'self' hides the self of the enclosing method; without it the function uses that one")
+			}
+			c.output.WriteString(nameToken.Value)
+			c.declareParameter(nameToken)
+			c.leaf("Param", nameToken)
+		} else {
+			return c.errorf(c.peek(), "expected parameter name")
+		}
+
+		// An optional type, which isn't part of the output
+		if c.peek().Type == TOKEN_COLON {
+			c.advance()
+			if _, err := c.typeAnnotation(); err != nil {
+				return err
+			}
+		}
+
+		if c.peek().Type == TOKEN_COMMA {
+			c.advance()
+		}
+	}
+
+	if c.peek().Type != TOKEN_RPAREN {
+		return c.errorf(c.peek(), "expected ')' after parameters")
+	}
+	c.advance()
+	c.output.WriteString(")\n")
+	if c.peek().Type == TOKEN_COLON {
+		c.advance()
+		if _, err := c.returnTypes(); err != nil {
+			return err
+		}
+	}
+
+	c.indent++
+	frame := &functionFrame{scopeDepth: len(c.scopes), method: method, name: name}
+	c.functions = append(c.functions, frame)
+	c.labelScopes[len(c.labelScopes)-1].function = true
+
+	// Labeled loops outside the function can't be broken out of, and
+	// its `...` is its own
+	savedLabels, savedVarargs := c.loopLabels, c.varargUses
+	c.loopLabels = nil
+
+	// Function body
+	last := TOKEN_EOF
+	for c.peek().Type != TOKEN_END && !c.isAtEnd() {
+		if err := c.statement(); err != nil {
+			return err
+		}
+		last = c.lastStatement
+	}
+
+	// Run deferred calls when falling off the end of the function
+	// (a trailing return has already emitted them)
+	if last != TOKEN_RETURN {
+		c.writeDefers(frame)
+	}
+	if err := c.checkGotos(); err != nil {
+		return err
+	}
+
+	if frame.multi && frame.name != "" {
+		c.multiReturns[frame.name] = true
+	}
+	c.functions = c.functions[:len(c.functions)-1]
+	c.loopLabels, c.varargUses = savedLabels, savedVarargs
+	c.indent--
+	c.popScope()
+
+	if c.peek().Type != TOKEN_END {
+		return c.errorf(c.peek(), "expected 'end' to close function")
+	}
+	c.advance()
+
+	c.writeIndent()
+	c.output.WriteString("end\n")
+
+	return nil
+}
+
+// ifStatement compiles if/elseif/else. The branches stay one flat chain
+// in the output, closed by a single end, however many elseifs there are.
+func (c *Compiler) ifStatement() error {
+	c.advance() // consume 'if'
+
+	c.writeIndent()
+	c.output.WriteString("if ")
+
+	braced := c.bracedBlock(TOKEN_THEN)
+	closing, err := c.blockHead(TOKEN_THEN, braced, "after if condition", c.condition)
+	if err != nil {
+		return err
+	}
+	c.output.WriteString(" then\n")
+	if err := c.ifBranch(closing); err != nil {
+		return err
+	}
+
+	// Handle elseif and else. Between braced branches, else if is the
+	// same as elseif.
+	for c.peek().Type == TOKEN_ELSEIF || (braced && c.peek().Type == TOKEN_ELSE && c.peekNext().Type == TOKEN_IF) {
+		closeElseIf := c.node("ElseIf")
+		elseIf := c.advance()
+		if elseIf.Type == TOKEN_ELSE {
+			c.advance()
+		}
+		c.writeIndent()
+		c.output.WriteString("elseif ")
+
+		if c.bracedBlock(TOKEN_THEN) != braced {
+			if braced {
+				return c.errorf(elseIf, "expected '{' after elseif condition, like the branches before it")
+			}
+			return c.errorf(elseIf, "expected 'then' after elseif condition, like the branches before it")
+		}
+		if _, err := c.blockHead(TOKEN_THEN, braced, "after elseif condition", c.condition); err != nil {
+			return err
+		}
+		c.output.WriteString(" then\n")
+		if err := c.ifBranch(closing); err != nil {
+			return err
+		}
+		closeElseIf()
+	}
+
+	if c.peek().Type == TOKEN_ELSE {
+		defer c.node("Else")()
+		c.advance()
+		c.writeIndent()
+		c.output.WriteString("else\n")
+
+		if braced {
+			if c.peek().Type != TOKEN_LBRACE {
+				return c.errorf(c.peek(), "expected '{' after 'else'")
+			}
+			c.advance()
+		}
+		if err := c.ifBranch(closing); err != nil {
+			return err
+		}
+	}
+
+	if !braced {
+		if c.peek().Type != TOKEN_END {
+			return c.errorf(c.peek(), "expected 'end' to close if statement")
+		}
+		c.advance()
+	}
+
+	c.writeIndent()
+	c.output.WriteString("end\n")
+
+	return nil
+}
+
+// ifBranch compiles the statements of a branch of an if. One in braces
+// ends at and consumes its '}'; otherwise it ends at the else, elseif or
+// end after it, which are left for ifStatement.
+func (c *Compiler) ifBranch(closing TokenType) error {
+	c.indent++
+	c.pushScope()
+
+	for c.peek().Type != closing && !c.isAtEnd() {
+		if closing == TOKEN_END && (c.peek().Type == TOKEN_ELSE || c.peek().Type == TOKEN_ELSEIF) {
+			break
+		}
+		if err := c.statement(); err != nil {
+			return err
+		}
+	}
+
+	c.popScope()
+	c.indent--
+
+	if closing == TOKEN_RBRACE {
+		if c.peek().Type != TOKEN_RBRACE {
+			return c.errorf(c.peek(), "expected '}' to close if block")
+		}
+		c.advance()
+	}
+	return nil
+}
+
+// Blocks of if, while and for can be delimited by braces like those of
+// unless and guard, instead of then or do and end:
+//
+//	while i < 10 { i += 1 }
+//
+// A file can use both forms, but the branches of one if all use the same.
+
+// bracedBlock reports whether the block after the condition or loop head
+// ahead opens with '{' rather than keyword. A '{' whose '}' is followed by
+// the keyword is a table call in the head, as in `for x in each{1, 2} do`.
+func (c *Compiler) bracedBlock(keyword TokenType) bool {
+	depth := 0
+	for i := c.current; i < len(c.tokens); i++ {
+		switch c.tokens[i].Type {
+		case TOKEN_LPAREN, TOKEN_LBRACKET, TOKEN_QUESTION_BRACKET:
+			depth++
+		case TOKEN_RPAREN, TOKEN_RBRACKET, TOKEN_RBRACE:
+			depth--
+		case TOKEN_LBRACE:
+			if depth == 0 && !c.precedesKeyword(i, keyword) {
+				return true
+			}
+			depth++
+		case keyword, TOKEN_EOF:
+			if depth <= 0 {
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// precedesKeyword reports whether the '{' at open is closed by a '}'
+// followed by keyword
+func (c *Compiler) precedesKeyword(open int, keyword TokenType) bool {
+	depth := 0
+	for i := open; i < len(c.tokens); i++ {
+		switch c.tokens[i].Type {
+		case TOKEN_LPAREN, TOKEN_LBRACKET, TOKEN_QUESTION_BRACKET, TOKEN_LBRACE:
+			depth++
+		case TOKEN_RPAREN, TOKEN_RBRACKET, TOKEN_RBRACE:
+			depth--
+			if depth == 0 {
+				return c.tokens[i+1].Type == keyword
+			}
+		case TOKEN_EOF:
+			return false
+		}
+	}
+	return false
+}
+
+// blockHead compiles a condition with head, then consumes the keyword
+// or, if braced, the '{' that opens the block after it. It returns the
+// token that closes the block: TOKEN_END or TOKEN_RBRACE.
+func (c *Compiler) blockHead(keyword TokenType, braced bool, after string, head func() error) (TokenType, error) {
+	// The '{' after the condition opens the block, not a table call
+	saved := c.noTableCalls
+	c.noTableCalls = braced
+	err := head()
+	c.noTableCalls = saved
+	if err != nil {
+		return TOKEN_EOF, err
+	}
+	return c.blockOpen(keyword, braced, after)
+}
+
+// closingText is how the token that closes a block is written in errors
+func closingText(closing TokenType) string {
+	if closing == TOKEN_RBRACE {
+		return "'}'"
+	}
+	return "'end'"
+}
+
+// blockOpen consumes the keyword or '{' that opens a block
+func (c *Compiler) blockOpen(keyword TokenType, braced bool, after string) (TokenType, error) {
+	word := "do"
+	if keyword == TOKEN_THEN {
+		word = "then"
+	}
+	if braced {
+		if c.peek().Type != TOKEN_LBRACE {
+			return TOKEN_EOF, c.errorf(c.peek(), "expected '{' %s", after)
+		}
+		c.advance()
+		return TOKEN_RBRACE, nil
+	}
+	if c.peek().Type != keyword {
+		return TOKEN_EOF, c.errorf(c.peek(), "expected '%s' or '{' %s", word, after)
+	}
+	c.advance()
+	return TOKEN_END, nil
+}
+
+func (c *Compiler) guardStatement() error {
+	c.advance() // consume 'guard'
+
+	c.writeIndent()
+	c.output.WriteString("if not (")
+
+	if err := c.expression(); err != nil {
+		return err
+	}
+
+	if c.peek().Type != TOKEN_ELSE {
+		return c.errorf(c.peek(), "expected 'else' after guard condition")
+	}
+	c.advance()
+
+	if c.peek().Type != TOKEN_LBRACE {
+		return c.errorf(c.peek(), "expected '{' after 'else' in guard")
+	}
+	guardToken := c.advance()
+	c.output.WriteString(") then\n")
+
+	c.indent++
+	c.pushScope()
+
+	// The else block must leave the enclosing scope, so remember
+	// what kind of statement came last
+	last := TOKEN_EOF
+	for c.peek().Type != TOKEN_RBRACE && !c.isAtEnd() {
+		if err := c.statement(); err != nil {
+			return err
+		}
+		last = c.lastStatement
+	}
+
+	c.popScope()
+	c.indent--
+
+	if c.peek().Type != TOKEN_RBRACE {
+		return c.errorf(c.peek(), "expected '}' to close guard block")
+	}
+	c.advance()
+
+	if last != TOKEN_RETURN && last != TOKEN_BREAK && last != TOKEN_CONTINUE {
+		return c.errorf(guardToken, "guard block must end with 'return', 'break' or 'continue'")
+	}
+
+	c.writeIndent()
+	c.output.WriteString("end\n")
+
+	return nil
+}
+
+func (c *Compiler) unlessStatement() error {
+	c.advance() // consume 'unless'
+
+	c.writeIndent()
+	c.output.WriteString("if not (")
+
+	// The '{' after the condition opens the block, not a table call
+	c.noTableCalls = true
+	if err := c.expression(); err != nil {
+		c.noTableCalls = false
+		return err
+	}
+	c.noTableCalls = false
+
+	if c.peek().Type != TOKEN_LBRACE {
+		return c.errorf(c.peek(), "expected '{' after unless condition")
+	}
+	c.advance()
+	c.output.WriteString(") then\n")
+
+	c.indent++
+	c.pushScope()
+
+	for c.peek().Type != TOKEN_RBRACE && !c.isAtEnd() {
+		if err := c.statement(); err != nil {
+			return err
+		}
+	}
+
+	c.popScope()
+	c.indent--
+
+	if c.peek().Type != TOKEN_RBRACE {
+		return c.errorf(c.peek(), "expected '}' to close unless block")
+	}
+	c.advance()
+
+	c.writeIndent()
+	c.output.WriteString("end\n")
+
+	return nil
+}
+
+func (c *Compiler) whileStatement() error {
+	c.advance() // consume 'while'
+
+	c.labelCounter++
+	label := c.labelCounter
+	c.continueLabels = append(c.continueLabels, label)
+	c.loopDepth++
+
+	c.writeIndent()
+	c.output.WriteString("while ")
+
+	closing, err := c.blockHead(TOKEN_DO, c.bracedBlock(TOKEN_DO), "after while condition", c.condition)
+	if err != nil {
+		return err
+	}
+	c.output.WriteString(" do\n")
+
+	c.indent++
+	c.pushScope()
+
+	for c.peek().Type != closing && !c.isAtEnd() {
+		if err := c.statement(); err != nil {
+			return err
+		}
+	}
+
+	// Add continue label before end
+	c.writeContinueLabel(label)
+
+	c.popScope()
+	c.indent--
+	c.loopDepth--
+	c.continueLabels = c.continueLabels[:len(c.continueLabels)-1]
+
+	if c.peek().Type != closing {
+		return c.errorf(c.peek(), "expected %s to close while loop", closingText(closing))
+	}
+	c.advance()
+
+	c.writeIndent()
+	c.output.WriteString("end\n")
+
+	return nil
+}
+
+func (c *Compiler) forStatement() error {
+	c.advance() // consume 'for'
+
+	c.labelCounter++
+	label := c.labelCounter
+	c.continueLabels = append(c.continueLabels, label)
+	c.loopDepth++
+
+	forStart := c.output.Len()
+	c.writeIndent()
+	c.output.WriteString("for ")
+
+	// The '{' after the loop head opens the block, not a table call
+	braced := c.bracedBlock(TOKEN_DO)
+	saved := c.noTableCalls
+	c.noTableCalls = braced
+
+	c.pushScope()
+	countedPrelude := ""
+
+	if c.peek().Type != TOKEN_IDENT {
+		return c.errorf(c.peek(), "expected identifier in for loop")
+	}
+
+	firstName := c.advance()
+	c.output.WriteString(firstName.Value)
+	c.declareVariable(firstName)
+	c.lookupVariable(firstName.Value).loopVar = true
+	c.leaf("Name", firstName)
+
+	if c.peek().Type == TOKEN_COMMA {
+		// for k, v in ... (generic for)
+		c.advance()
+		c.output.WriteString(", ")
+
+		for {
+			if c.peek().Type != TOKEN_IDENT {
+				return c.errorf(c.peek(), "expected identifier")
+			}
+			nameToken := c.advance()
+			c.output.WriteString(nameToken.Value)
+			c.declareVariable(nameToken)
+			c.lookupVariable(nameToken.Value).loopVar = true
+			c.leaf("Name", nameToken)
+
+			if c.peek().Type != TOKEN_COMMA {
+				break
+			}
+			c.advance()
+			c.output.WriteString(", ")
+		}
+
+		if c.peek().Type != TOKEN_IN {
+			return c.errorf(c.peek(), "expected 'in' in for loop")
+		}
+		c.advance()
+		c.output.WriteString(" in ")
+
+		if err := c.expressionList(); err != nil {
+			return err
+		}
+	} else if c.peek().Type == TOKEN_IN {
+		// for v in ... (generic for with single var)
+		c.advance()
+		c.output.WriteString(" in ")
+
+		if err := c.expressionList(); err != nil {
+			return err
+		}
+	} else if c.peek().Type == TOKEN_ASSIGN {
+		// for i = start, end [, step] (numeric for)
+		c.setNode("NumericFor", "")
+		c.advance()
+		c.output.WriteString(" = ")
+
+		// Keep the parts for rewriting loops with a float step
+		parts := []string{}
+		partStart := c.output.Len()
+		if err := c.expression(); err != nil {
+			return err
+		}
+		parts = append(parts, c.output.String()[partStart:])
+
+		if c.peek().Type != TOKEN_COMMA {
+			return c.errorf(c.peek(), "expected ',' in numeric for loop")
+		}
+		c.advance()
+		c.output.WriteString(", ")
+
+		partStart = c.output.Len()
+		if err := c.expression(); err != nil {
+			return err
+		}
+		parts = append(parts, c.output.String()[partStart:])
+
+		if c.peek().Type == TOKEN_COMMA {
+			c.advance()
+			c.output.WriteString(", ")
+			stepToken := c.peek()
+			float := isFloatLiteral(c.peek()) || (c.peek().Type == TOKEN_MINUS && isFloatLiteral(c.peekNext()))
+			partStart = c.output.Len()
+			if err := c.expression(); err != nil {
+				return err
+			}
+			parts = append(parts, c.output.String()[partStart:])
+
+			if float && (c.peek().Type == TOKEN_DO || c.peek().Type == TOKEN_LBRACE) {
+				c.lint(stepToken, lintFloatStep, "a float step adds up rounding errors and may miss the end of the range; --safe-float-loops counts the iterations instead")
+				if c.options.SafeFloatLoops {
+					countedPrelude = c.countedLoop(forStart, firstName.Value, parts)
+				}
+			}
+		}
+	} else {
+		return c.errorf(c.peek(), "invalid for loop syntax")
+	}
+
+	c.noTableCalls = saved
+	closing, err := c.blockOpen(TOKEN_DO, braced, "in for loop")
+	if err != nil {
+		return err
+	}
+	c.output.WriteString(" do\n")
+
+	c.indent++
+	if countedPrelude != "" {
+		c.writeIndent()
+		c.output.WriteString(countedPrelude)
+	}
+
+	for c.peek().Type != closing && !c.isAtEnd() {
+		if err := c.statement(); err != nil {
+			return err
+		}
+	}
+
+	// Add continue label before end
+	c.writeContinueLabel(label)
+
+	c.indent--
+	c.popScope()
+	c.loopDepth--
+	c.continueLabels = c.continueLabels[:len(c.continueLabels)-1]
+
+	if c.peek().Type != closing {
+		return c.errorf(c.peek(), "expected %s to close for loop", closingText(closing))
+	}
+	c.advance()
+
+	c.writeIndent()
+	c.output.WriteString("end\n")
+	if countedPrelude != "" {
+		c.indent--
+		c.writeIndent()
+		c.output.WriteString("end\n")
+	}
+
+	return nil
+}
+
+// isFloatLiteral reports whether token is a decimal number with a
+// fraction or exponent
+func isFloatLiteral(token Token) bool {
+	return token.Type == TOKEN_NUMBER && !strings.HasPrefix(strings.ToLower(token.Value), "0x") &&
+		strings.ContainsAny(token.Value, ".eE")
+}
+
+// countedLoop rewrites the header of `for name = start, stop, step` from
+// forStart on to count whole iterations, computing name from the count,
+// so rounding errors in the step don't add up:
+//
+//	do
+//	  local __start_1__ = start
+//	  for __n_2__ = 0, math.floor((stop - __start_1__) / step + 1e-9) do
+//	    local name = __start_1__ + __n_2__ * step
+//
+// The step is a literal, so it's evaluated once however often it's used.
+// It returns the line declaring name, for the caller to write at the
+// start of the body, and the caller closes both blocks.
+func (c *Compiler) countedLoop(forStart int, name string, parts []string) string {
+	start, stop, step := parts[0], parts[1], parts[2]
+	if !simpleOperandPattern.MatchString(stop) {
+		stop = "(" + stop + ")"
+	}
+
+	output := c.output.String()
+	c.output.Reset()
+	c.output.WriteString(output[:forStart])
+
+	c.writeIndent()
+	c.output.WriteString("do\n")
+	c.indent++
+	startVar := c.newTemp("start")
+	c.writeIndent()
+	c.output.WriteString(fmt.Sprintf("local %s = %s\n", startVar, start))
+
+	count := c.newTemp("n")
+	c.writeIndent()
+	c.output.WriteString(fmt.Sprintf("for %s = 0, math.floor((%s - %s) / %s + 1e-9)", count, stop, startVar, step))
+	return fmt.Sprintf("local %s = %s + %s * %s\n", name, startVar, count, step)
+}
+
+func isLoopKeyword(t TokenType) bool {
+	return t == TOKEN_FOR || t == TOKEN_WHILE || t == TOKEN_REPEAT
+}
+
+// labeledLoop compiles `outer: for ...`. A `break outer` inside it jumps
+// to a label placed right after the loop, and `continue outer` to the
+// loop's continue label.
+func (c *Compiler) labeledLoop() error {
+	name := c.advance()
+	c.advance() // consume ':'
+	c.leaf("Label", name)
+
+	for _, l := range c.loopLabels {
+		if l.name == name.Value {
+			return c.errorf(name, "loop label '%s' is already in use", name.Value)
+		}
+	}
+
+	c.labelCounter++
+	exit := c.labelCounter
+	c.loopLabels = append(c.loopLabels, loopLabel{name: name.Value, exit: exit, loop: len(c.continueLabels)})
+
+	var err error
+	switch c.peek().Type {
+	case TOKEN_FOR:
+		err = c.forStatement()
+	case TOKEN_WHILE:
+		err = c.whileStatement()
+	case TOKEN_REPEAT:
+		err = c.repeatStatement()
+	}
+	used := c.loopLabels[len(c.loopLabels)-1].used
+	c.loopLabels = c.loopLabels[:len(c.loopLabels)-1]
+	if err != nil {
+		return err
+	}
+
+	if used {
+		c.writeIndent()
+		c.output.WriteString(fmt.Sprintf("::__break_%d__::\n", exit))
+	}
+
+	return nil
+}
+
+func (c *Compiler) repeatStatement() error {
+	c.advance() // consume 'repeat'
+
+	c.labelCounter++
+	label := c.labelCounter
+	c.continueLabels = append(c.continueLabels, label)
+	c.loopDepth++
+
+	c.writeIndent()
+	c.output.WriteString("repeat")
+
+	// Capture the body, whose locals may have to be declared up front
+	savedOutput := c.output.String()
+	c.output.Reset()
+
+	c.indent++
+	c.pushScope()
+
+	for c.peek().Type != TOKEN_UNTIL && !c.isAtEnd() {
+		if err := c.statement(); err != nil {
+			return err
+		}
+	}
+
+	bodyStr := c.output.String()
+	c.output.Reset()
+	c.output.WriteString(savedOutput)
+
+	// The until condition is in the scope of the body's locals, so a
+	// continue label before it doesn't end their block, and Lua won't
+	// let the goto jump past their declarations. Declaring them at the
+	// top of the body means it doesn't.
+	if c.usedContinues[label] {
+		var names []string
+		bodyStr, names = hoistLocals(bodyStr, strings.Repeat(c.indentUnit(), c.indent))
+		if len(names) > 0 {
+			c.output.WriteString(" local " + strings.Join(names, ", "))
+		}
+	}
+	c.output.WriteString("\n" + bodyStr)
+
+	// Add continue label before until
+	c.writeContinueLabel(label)
+
+	c.indent--
+	c.loopDepth--
+	c.continueLabels = c.continueLabels[:len(c.continueLabels)-1]
+
+	if c.peek().Type != TOKEN_UNTIL {
+		return c.errorf(c.peek(), "expected 'until' to close repeat loop")
+	}
+	c.advance()
+
+	c.writeIndent()
+	c.output.WriteString("until ")
+
+	if err := c.expression(); err != nil {
+		return err
+	}
+	c.output.WriteString("\n")
+	c.popScope()
+
+	return nil
+}
+
+// hoistLocals turns the local declarations at the top level of a block,
+// the lines starting with indent and 'local', into assignments. It
+// returns the new block and the names, for declaring before it. Locals
+// with attributes like <const> can't be assigned later, so stay as is.
+func hoistLocals(block string, indent string) (string, []string) {
+	names := []string{}
+	declared := map[string]bool{}
+	declare := func(list string) {
+		for _, name := range strings.Split(list, ", ") {
+			if !declared[name] {
+				declared[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	lines := strings.SplitAfter(block, "\n")
+	for i, line := range lines {
+		// Line markers go before the indentation, see alignLines
+		marker := ""
+		for strings.IndexByte(line, lineMarker) == 0 {
+			end := strings.IndexByte(line[1:], lineMarker) + 2
+			marker, line = marker+line[:end], line[end:]
+		}
+		if !strings.HasPrefix(line, indent+"local ") {
+			continue
+		}
+		declaration := strings.TrimPrefix(line, indent+"local ")
+
+		if rest, ok := strings.CutPrefix(declaration, "function "); ok {
+			// local function f(...) is f = function(...)
+			name, params, found := strings.Cut(rest, "(")
+			if !found {
+				continue
+			}
+			declare(name)
+			lines[i] = marker + indent + name + " = function(" + params
+			continue
+		}
+
+		list, value, hasValue := strings.Cut(declaration, " = ")
+		if strings.Contains(list, "<") {
+			continue
+		}
+		if !hasValue {
+			// A bare local starts out nil on every iteration
+			list, value = strings.TrimRight(list, "\n"), "nil\n"
+		}
+		declare(list)
+		lines[i] = marker + indent + list + " = " + value
+	}
+	return strings.Join(lines, ""), names
+}
+
+// doWhileStatement compiles `do { ... } while cond` to
+// `repeat ... until not (cond)`, so the condition reads the natural way
+func (c *Compiler) doWhileStatement() error {
+	c.advance() // consume 'do'
+	c.advance() // consume '{'
+
+	c.labelCounter++
+	label := c.labelCounter
+	c.continueLabels = append(c.continueLabels, label)
+	c.loopDepth++
+
+	c.writeIndent()
+	c.output.WriteString("repeat")
+
+	// Capture the body, whose locals may have to be declared up front
+	savedOutput := c.output.String()
+	c.output.Reset()
+
+	c.indent++
+	c.pushScope()
+
+	for c.peek().Type != TOKEN_RBRACE && !c.isAtEnd() {
+		if err := c.statement(); err != nil {
+			return err
+		}
+	}
+
+	c.loopDepth--
+	c.continueLabels = c.continueLabels[:len(c.continueLabels)-1]
+
+	bodyStr := c.output.String()
+	c.output.Reset()
+	c.output.WriteString(savedOutput)
+
+	// As in repeatStatement, the condition sees the body's locals, so
+	// they're declared at the top for continue to jump past them
+	if c.usedContinues[label] {
+		var names []string
+		bodyStr, names = hoistLocals(bodyStr, strings.Repeat(c.indentUnit(), c.indent))
+		if len(names) > 0 {
+			c.output.WriteString(" local " + strings.Join(names, ", "))
+		}
+	}
+	c.output.WriteString("\n" + bodyStr)
+	c.writeContinueLabel(label)
+	c.indent--
+
+	if c.peek().Type != TOKEN_RBRACE {
+		return c.errorf(c.peek(), "expected '}' to close do block")
+	}
+	closeLine := c.advance().Line
+
+	if c.peek().Type != TOKEN_WHILE || c.peek().Line != closeLine {
+		return c.errorf(c.peek(), "expected 'while' after '}' of do block")
+	}
+	c.advance()
+
+	c.writeIndent()
+	c.output.WriteString("until not (")
+	if err := c.condition(); err != nil {
+		return err
+	}
+	c.output.WriteString(")\n")
+	c.popScope()
+
+	return nil
+}
+
+// isDoWhile reports whether the 'do' ahead starts `do { ... } while cond`,
+// rather than a block in braces
+func (c *Compiler) isDoWhile() bool {
+	if c.peekNext().Type != TOKEN_LBRACE {
+		return false
+	}
+	depth := 0
+	for i := c.current + 1; i < len(c.tokens); i++ {
+		switch c.tokens[i].Type {
+		case TOKEN_LBRACE, TOKEN_QUESTION_BRACKET, TOKEN_LBRACKET, TOKEN_LPAREN:
+			depth++
+		case TOKEN_RBRACE, TOKEN_RBRACKET, TOKEN_RPAREN:
+			depth--
+			if depth == 0 {
+				next := c.tokens[i+1]
+				return next.Type == TOKEN_WHILE && next.Line == c.tokens[i].Line
+			}
+		case TOKEN_EOF:
+			return false
+		}
+	}
+	return false
+}
+
+// doStatement compiles a block that only scopes its locals, written
+// `do ... end` as in Lua or `do { ... }` like the other braced blocks
+func (c *Compiler) doStatement() error {
+	c.advance() // consume 'do'
+	closing, name := TOKEN_END, "'end'"
+	if c.peek().Type == TOKEN_LBRACE {
+		c.advance()
+		closing, name = TOKEN_RBRACE, "'}'"
+	}
+
+	c.writeIndent()
+	c.output.WriteString("do\n")
+
+	c.indent++
+	c.pushScope()
+
+	for c.peek().Type != closing && !c.isAtEnd() {
+		if err := c.statement(); err != nil {
+			return err
+		}
+	}
+
+	c.popScope()
+	c.indent--
+
+	if c.peek().Type != closing {
+		return c.errorf(c.peek(), "expected %s to close do block", name)
+	}
+	c.advance()
+
+	c.writeIndent()
+	c.output.WriteString("end\n")
+
+	return nil
+}
+
+func (c *Compiler) returnStatement() error {
+	c.advance() // consume 'return'
+	return c.returnValues()
+}
+
+// returnValues compiles what follows 'return', running any deferred
+// calls before the function exits
+func (c *Compiler) returnValues() error {
+	var frame *functionFrame
+	if len(c.functions) > 0 && len(c.functions[len(c.functions)-1].defers) > 0 {
+		frame = c.functions[len(c.functions)-1]
+	}
+
+	if frame != nil && c.isStatementEnd() {
+		c.writeDefers(frame)
+	}
+
+	c.writeIndent()
+	c.output.WriteString("return")
+
+	// Check if there's an expression to return
+	if !c.isStatementEnd() {
+		if frame != nil && frame.deferArgs {
+			return c.returnThroughDefers(frame)
+		}
+		c.output.WriteString(" ")
+		if frame != nil {
+			// Evaluate the return values first, then run the deferred
+			// calls and pass the values through
+			c.output.WriteString("(function(...) ")
+			for i := len(frame.defers) - 1; i >= 0; i-- {
+				c.output.WriteString(frame.defers[i])
+				c.output.WriteString("; ")
+			}
+			c.output.WriteString("return ... end)(")
+		}
+		start := c.current
+		if err := c.expressionList(); err != nil {
+			return err
+		}
+		if len(c.functions) > 0 && c.returnsMany(start, c.current) {
+			c.functions[len(c.functions)-1].multi = true
+		}
+		if frame != nil {
+			c.output.WriteString(")")
+		}
+	}
+	c.output.WriteString("\n")
+
+	return nil
+}
+
+// returnThroughDefers compiles the values of a return, after the 'return'
+// already written, for a function whose deferred calls use its `...`. They
+// can't run inside the function that passes the values through, where
+// `...` is the values, so the values are kept in a table instead:
+//
+//	local __ret_1__ = (function(...) return {n = select("#", ...), ...} end)(a, b)
+//	cleanup(...)
+//	return table.unpack(__ret_1__, 1, __ret_1__.n)
+func (c *Compiler) returnThroughDefers(frame *functionFrame) error {
+	output := c.output.String()
+	output = output[:len(output)-len("return")]
+	values := c.newTemp("ret")
+	c.output.Reset()
+	c.output.WriteString(output)
+	c.output.WriteString("local " + values + " = (function(...) return {n = select(\"#\", ...), ...} end)(")
+	start := c.current
+	if err := c.expressionList(); err != nil {
+		return err
+	}
+	if c.returnsMany(start, c.current) {
+		frame.multi = true
+	}
+	c.output.WriteString(")\n")
+	c.writeDefers(frame)
+
+	unpack := "table.unpack"
+	if c.options.Target == "5.1" || c.options.Target == "luajit" {
+		unpack = "unpack"
+	}
+	c.writeIndent()
+	c.output.WriteString(fmt.Sprintf("return %s(%s, 1, %s.n)\n", unpack, values, values))
+
+	return nil
+}
+
+// deferStatement compiles `defer call`. The call is put in a local
+// function, which writeDefers calls at each exit of the function:
+//
+//	local __defer_1__ = function() file:close() end
+func (c *Compiler) deferStatement() error {
+	deferToken := c.advance() // consume 'defer'
+
+	if len(c.functions) == 0 {
+		return c.errorf(c.peek(), "'defer' outside of function")
+	}
+	frame := c.functions[len(c.functions)-1]
+	if len(c.scopes) != frame.scopeDepth {
+		return c.errorf(c.peek(), "'defer' must be at the top level of a function body")
+	}
+
+	// Capture the deferred call
+	savedOutput, varargs := c.output.String(), c.varargUses
+	c.output.Reset()
+	if err := c.primaryExpression(); err != nil {
+		return err
+	}
+	usesVarargs := c.varargUses > varargs
+	frame.deferArgs = frame.deferArgs || usesVarargs
+	call := c.output.String()
+	c.output.Reset()
+	c.output.WriteString(savedOutput)
+
+	// The call goes in a function where the defer is, so its names are
+	// the ones in scope here rather than at the exits it runs from
+	temp := c.newTemp("defer")
+	params := ""
+	if usesVarargs {
+		params = "..."
+	}
+	c.writeIndent()
+	c.output.WriteString(fmt.Sprintf("local %s = function(%s) %s end\n", temp, params, call))
+	block := c.labelScopes[len(c.labelScopes)-1]
+	block.locals = append(block.locals, Token{Type: TOKEN_IDENT, Value: temp, Line: deferToken.Line, Column: deferToken.Column})
+
+	frame.defers = append(frame.defers, temp+"("+params+")")
+
+	return nil
+}
+
+// writeDefers emits a function's deferred calls in LIFO order
+func (c *Compiler) writeDefers(frame *functionFrame) {
+	for i := len(frame.defers) - 1; i >= 0; i-- {
+		c.writeIndent()
+		c.output.WriteString(frame.defers[i])
+		c.output.WriteString("\n")
+	}
+}
+
+func (c *Compiler) breakStatement() error {
+	c.advance() // consume 'break'
+
+	// break name exits the labeled loop
+	if c.peek().Type == TOKEN_IDENT && c.peek().Line == c.previous().Line {
+		name := c.advance()
+		c.leaf("Label", name)
+		if !c.hasGoto() {
+			return c.errorf(name, "'break %s' needs goto, which Lua 5.1 doesn't have", name.Value)
+		}
+		for i := len(c.loopLabels) - 1; i >= 0; i-- {
+			if c.loopLabels[i].name == name.Value {
+				c.loopLabels[i].used = true
+				c.writeIndent()
+				c.output.WriteString(fmt.Sprintf("goto __break_%d__\n", c.loopLabels[i].exit))
+				return nil
+			}
+		}
+		return c.errorf(name, "no enclosing loop labeled '%s'", name.Value)
+	}
+
+	if c.loopDepth == 0 && c.inDoExpression {
+		return c.errorf(c.previous(), "'break' cannot leave a do expression")
+	}
+
+	c.writeIndent()
+	c.output.WriteString("break\n")
+
+	return nil
+}
+
+func (c *Compiler) continueStatement() error {
+	c.advance() // consume 'continue'
+
+	if c.loopDepth == 0 && c.inDoExpression {
+		return c.errorf(c.previous(), "'continue' cannot leave a do expression")
+	}
+	if c.loopDepth == 0 {
+		return c.errorf(c.peek(), "'continue' outside of loop")
+	}
+
+	if !c.hasGoto() {
+		return c.errorf(c.previous(), "'continue' needs goto, which Lua 5.1 doesn't have")
+	}
+
+	label := c.continueLabels[len(c.continueLabels)-1]
+
+	// continue name goes on with the labeled loop
+	if c.peek().Type == TOKEN_IDENT && c.peek().Line == c.previous().Line {
+		name := c.advance()
+		c.leaf("Label", name)
+		found := false
+		for i := len(c.loopLabels) - 1; i >= 0 && !found; i-- {
+			if c.loopLabels[i].name == name.Value {
+				label, found = c.continueLabels[c.loopLabels[i].loop], true
+			}
+		}
+		if !found {
+			return c.errorf(name, "no enclosing loop labeled '%s'", name.Value)
+		}
+	}
+
+	c.usedContinues[label] = true
+	c.writeIndent()
+	c.output.WriteString(fmt.Sprintf("goto __continue_%d__\n", label))
+
+	return nil
+}
+
+// writeContinueLabel places a loop's continue target at the end of its
+// body, if any continue jumps there
+func (c *Compiler) writeContinueLabel(label int) {
+	if c.usedContinues[label] {
+		c.writeIndent()
+		c.output.WriteString(fmt.Sprintf("::__continue_%d__::\n", label))
+	}
+}
+
+// hasFloorDivision reports whether the target Lua version has the //
+// operator; without it a // b is math.floor(a / b)
+func (c *Compiler) hasFloorDivision() bool {
+	return c.options.Target == "5.3" || c.options.Target == "5.4"
+}
+
+// hasGoto reports whether the target Lua version supports goto and labels
+func (c *Compiler) hasGoto() bool {
+	return c.options.Target != "5.1"
+}
+
+func (c *Compiler) gotoStatement() error {
+	c.advance() // consume 'goto'
+
+	if c.peek().Type != TOKEN_IDENT {
+		return c.errorf(c.peek(), "expected label name after 'goto'")
+	}
+	if !c.hasGoto() {
+		return c.errorf(c.previous(), "Lua 5.1 doesn't have goto")
+	}
+
+	nameToken := c.advance()
+	name := nameToken.Value
+	c.leaf("Label", nameToken)
+
+	// Jumping back is always fine; forward jumps wait for their label
+	if _, ok := c.findLabel(name); !ok {
+		block := c.labelScopes[len(c.labelScopes)-1]
+		block.pending = append(block.pending, pendingGoto{token: nameToken, locals: len(block.locals)})
+	}
+
+	c.writeIndent()
+	c.output.WriteString("goto ")
+	c.output.WriteString(name)
+	c.output.WriteString("\n")
+
+	return nil
+}
+
+func (c *Compiler) labelStatement() error {
+	c.advance() // consume '::'
+
+	if !c.hasGoto() {
+		return c.errorf(c.previous(), "Lua 5.1 doesn't have labels")
+	}
+
+	if c.peek().Type != TOKEN_IDENT {
+		return c.errorf(c.peek(), "expected label name")
+	}
+
+	nameToken := c.advance()
+	name := nameToken.Value
+	c.leaf("Label", nameToken)
+
+	if c.peek().Type != TOKEN_DOUBLECOLON {
+		return c.errorf(c.peek(), "expected '::' after label name")
+	}
+	c.advance()
+
+	if previous, ok := c.findLabel(name); ok {
+		return c.errorf(nameToken, "label '%s' already defined on line %d", name, previous.Line)
+	}
+	block := c.labelScopes[len(c.labelScopes)-1]
+	block.labels[name] = nameToken
+
+	pending := block.pending[:0]
+	for _, g := range block.pending {
+		switch {
+		case g.token.Value != name:
+			pending = append(pending, g)
+		case g.locals < len(block.locals):
+			g.local = block.locals[g.locals]
+			block.intoLocal = append(block.intoLocal, g)
+		}
+	}
+	block.pending = pending
+
+	c.writeIndent()
+	c.output.WriteString("::")
+	c.output.WriteString(name)
+	c.output.WriteString("::\n")
+
+	return nil
+}
+
+func (c *Compiler) switchStatement() error {
+	c.advance() // consume 'switch'
+
+	c.switchDepth++
+
+	// Capture the switch expression by temporarily redirecting output
+	savedOutput := c.output.String()
+	c.output.Reset()
+	if err := c.expression(); err != nil {
+		return err
+	}
+	switchExprStr := c.output.String()
+	c.output.Reset()
+	c.output.WriteString(savedOutput)
+
+	// Generate a temp variable to hold the switch value
+	tempVar := c.newTemp("switch")
+
+	c.writeIndent()
+	c.output.WriteString("local ")
+	c.output.WriteString(tempVar)
+	c.output.WriteString(" = ")
+	c.output.WriteString(switchExprStr)
+	c.output.WriteString("\n")
+
+	// Parse cases
+	firstCase := true
+	for c.peek().Type == TOKEN_CASE || c.peek().Type == TOKEN_DEFAULT {
+		closeCase := c.node("Case")
+		if c.peek().Type == TOKEN_CASE {
+			c.advance() // consume 'case'
+
+			c.writeIndent()
+			if firstCase {
+				c.output.WriteString("if ")
+				firstCase = false
+			} else {
+				c.output.WriteString("elseif ")
+			}
+
+			// Handle multiple case values: case "a", "b":
+			// Disable method calls while parsing case expressions
+			c.noMethodCalls = true
+			c.output.WriteString(tempVar)
+			c.output.WriteString(" == ")
+			if err := c.expression(); err != nil {
+				c.noMethodCalls = false
+				return err
+			}
+
+			for c.peek().Type == TOKEN_COMMA {
+				c.advance()
+				c.output.WriteString(" or ")
+				c.output.WriteString(tempVar)
+				c.output.WriteString(" == ")
+				if err := c.expression(); err != nil {
+					c.noMethodCalls = false
+					return err
+				}
+			}
+			c.noMethodCalls = false
+
+			if c.peek().Type != TOKEN_COLON {
+				return c.errorf(c.peek(), "expected ':' after case value")
+			}
+			c.advance()
+
+			c.output.WriteString(" then\n")
+
+			c.indent++
+			c.pushScope()
+
+			// Parse case body
+			for c.peek().Type != TOKEN_CASE && c.peek().Type != TOKEN_DEFAULT && c.peek().Type != TOKEN_END && !c.isAtEnd() {
+				if err := c.statement(); err != nil {
+					return err
+				}
+			}
+
+			c.popScope()
+			c.indent--
+
+		} else if c.peek().Type == TOKEN_DEFAULT {
+			c.setNode("Default", "")
+			c.advance() // consume 'default'
+
+			if c.peek().Type != TOKEN_COLON {
+				return c.errorf(c.peek(), "expected ':' after 'default'")
+			}
+			c.advance()
+
+			c.writeIndent()
+			if firstCase {
+				c.output.WriteString("do\n")
+			} else {
+				c.output.WriteString("else\n")
+			}
+
+			c.indent++
+			c.pushScope()
+
+			// Parse default body
+			for c.peek().Type != TOKEN_END && !c.isAtEnd() {
+				if err := c.statement(); err != nil {
+					return err
+				}
+			}
+
+			c.popScope()
+			c.indent--
+		}
+		closeCase()
+	}
+
+	if c.peek().Type != TOKEN_END {
+		return c.errorf(c.peek(), "expected 'end' to close switch statement")
+	}
+	c.advance()
+
+	c.writeIndent()
+	c.output.WriteString("end\n")
+
+	c.switchDepth--
+
+	return nil
+}
+
+// isAssignment reports whether kind is an operator that follows an
+// assignment target: =, a compound assignment or ++
+func isAssignment(kind TokenType) bool {
+	switch kind {
+	case TOKEN_ASSIGN, TOKEN_PLUS_PLUS, TOKEN_PLUS_ASSIGN, TOKEN_MINUS_ASSIGN, TOKEN_STAR_ASSIGN, TOKEN_STAR_STAR_ASSIGN,
+		TOKEN_SLASH_ASSIGN, TOKEN_SLASH_SLASH_ASSIGN, TOKEN_PERCENT_ASSIGN, TOKEN_DOTDOT_ASSIGN:
+		return true
+	}
+	return false
+}
+
+// decrement reports whether the statement whose target, compiled to
+// target, was just parsed is i--. The lexer reads -- as a comment, so
+// it's a decrement when an empty comment touches the target and nothing
+// else follows. Any other comment touching a bare target is an error.
+func (c *Compiler) decrement(target string) (bool, error) {
+	comment, ok := c.touching[c.current-1]
+	if !ok {
+		return false, nil
+	}
+	if isAssignment(c.peek().Type) || c.peek().Type == TOKEN_COMMA {
+		return false, nil
+	}
+	if comment != "--" {
+		return false, c.errorf(c.tokens[c.current-1], "'%s--' is only a decrement with nothing after it on the line; write '%s -= 1' before a comment", target, target)
+	}
+	return true, nil
+}
+
+// expressionStatement compiles an assignment or call. When blockValue is
+// set and the statement turns out to be a plain expression at the end of
+// a do expression, it's compiled as a return instead and isValue is true.
+func (c *Compiler) expressionStatement(blockValue bool) (isValue bool, err error) {
+	// This could be an assignment or a function call
+	// We need to parse the left side first, then check for assignment
+
+	start := c.current
+	savedOutput := c.output.String()
+	c.output.Reset()
+
+	// Assigning to a variable doesn't count as using it
+	leftToken := c.peek()
+	var target *variable
+	targetUsed := false
+	if leftToken.Type == TOKEN_IDENT && (c.peekNext().Type == TOKEN_ASSIGN || c.peekNext().Type == TOKEN_COMMA) {
+		if target = c.lookupVariable(leftToken.Value); target != nil {
+			targetUsed = target.used
+		}
+	}
+
+	mark := c.markNode()
+	c.assignTarget = true
+	if err := c.primaryExpression(); err != nil {
+		return false, err
+	}
+	if target != nil {
+		target.used = targetUsed
+	}
+
+	leftStr := c.output.String()
+	c.output.Reset()
+	c.output.WriteString(savedOutput)
+
+	decrement, err := c.decrement(leftStr)
+	if err != nil {
+		return false, err
+	}
+
+	// The last expression of a do expression is its value
+	if blockValue && !decrement && (c.peek().Type == TOKEN_RBRACE || isBinaryOperator(c.peek().Type)) {
+		c.current = start
+		c.truncateNodes(mark)
+		c.setNode("Return", "")
+		return true, c.returnValues()
+	}
+
+	// Check for compound assignment
+	compoundOps := map[TokenType]string{
+		TOKEN_PLUS_ASSIGN:        " + ",
+		TOKEN_MINUS_ASSIGN:       " - ",
+		TOKEN_STAR_ASSIGN:        " * ",
+		TOKEN_STAR_STAR_ASSIGN:   " ^ ",
+		TOKEN_SLASH_ASSIGN:       " / ",
+		TOKEN_SLASH_SLASH_ASSIGN: " // ",
+		TOKEN_PERCENT_ASSIGN:     " % ",
+		TOKEN_DOTDOT_ASSIGN:      " .. ",
+	}
+
+	// Increment and decrement: i++ is i += 1
+	incrementOps := map[TokenType]string{
+		TOKEN_PLUS_PLUS:   " + ",
+		TOKEN_MINUS_MINUS: " - ",
+	}
+
+	next := c.peek().Type
+	if decrement {
+		next = TOKEN_MINUS_MINUS
+	}
+	op, isCompound := compoundOps[next]
+	incrementOp, isIncrement := incrementOps[next]
+	if last := c.tokens[c.current-1].Type; (isCompound || isIncrement) && last != TOKEN_IDENT && last != TOKEN_RBRACKET {
+		return false, c.errorf(c.peek(), "can only assign to a name, field or index, not '%s'", leftStr)
+	}
+	if v := c.lookupVariable(leftToken.Value); v != nil && (isCompound || isIncrement || c.peek().Type == TOKEN_ASSIGN || c.peek().Type == TOKEN_COMMA) {
+		if v.enum != nil {
+			return false, c.errorf(leftToken, "cannot assign to const enum '%s'", leftToken.Value)
+		}
+		if v.loopVar && leftStr == leftToken.Value {
+			c.warn(leftToken, "loop-variable", fmt.Sprintf("assigning to loop variable '%s' doesn't change which iteration runs next", leftToken.Value))
+		}
+	}
+	if isCompound || isIncrement {
+		if decrement {
+			c.setNode("Assignment", "--")
+		} else {
+			c.setNode("Assignment", c.advance().Value) // consume compound operator
+		}
+
+		// Check if this is a new variable
+		isNewVar := c.implicitLocals() && c.isNewVariable(leftStr)
+		floor := op == " // " && !c.hasFloorDivision()
+
+		c.writeIndent()
+
+		// t[k] += 2 names t[k] twice in t[k] = t[k] + 2, so an object or
+		// key with side effects is evaluated once, into locals
+		closeBlock := ""
+		if !isNewVar {
+			var hoisted string
+			leftStr, hoisted = c.hoistTarget(leftStr)
+			if hoisted != "" {
+				c.output.WriteString("do " + hoisted + "; ")
+				closeBlock = " end"
+			}
+		}
+		if isNewVar {
+			c.output.WriteString("local ")
+			c.declareVariable(leftToken)
+		}
+		c.output.WriteString(leadingSemicolon(leftStr) + leftStr)
+		c.output.WriteString(" = ")
+		if floor {
+			c.output.WriteString("math.floor(")
+			op = " / "
+		}
+		c.output.WriteString(leftStr)
+
+		if isIncrement {
+			c.output.WriteString(incrementOp)
+			c.output.WriteString("1" + closeBlock + "\n")
+			return false, nil
+		}
+
+		c.output.WriteString(op)
+
+		// x -= a - b is x - (a - b)
+		valueToken := c.current
+		valueStart := c.output.Len()
+		if err := c.expression(); err != nil {
+			return false, err
+		}
+		if c.hasOperatorSince(valueToken) {
+			output := c.output.String()
+			c.output.Reset()
+			c.output.WriteString(output[:valueStart] + "(" + output[valueStart:] + ")")
+		}
+		if floor {
+			c.output.WriteString(")")
+		}
+		c.output.WriteString(closeBlock + "\n")
+		return false, nil
+	}
+
+	// Check for regular assignment
+	if c.peek().Type == TOKEN_ASSIGN {
+		c.advance() // consume '='
+		c.setNode("Assignment", "=")
+
+		// Check if this is a new variable (simple identifier)
+		isNewVar := c.implicitLocals() && c.isNewVariable(leftStr)
+
+		c.writeIndent()
+		if isNewVar && !strings.Contains(leftStr, ".") && !strings.Contains(leftStr, "[") {
+			c.output.WriteString("local ")
+			c.declareVariable(leftToken)
+		}
+		c.output.WriteString(leadingSemicolon(leftStr) + leftStr)
+		c.output.WriteString(" = ")
+
+		if err := c.expression(); err != nil {
+			return false, err
+		}
+		c.output.WriteString("\n")
+		return false, nil
+	}
+
+	// Check for multiple assignment: a, b = 1, 2
+	if c.peek().Type == TOKEN_COMMA {
+		c.setNode("Assignment", "=")
+		vars := []string{leftStr}
+		newVars := []Token{}
+		// _ discards a value, so it's always safe to declare again
+		if c.implicitLocals() && (c.isNewVariable(leftStr) || leftStr == "_") {
+			newVars = append(newVars, leftToken)
+		}
+
+		for c.peek().Type == TOKEN_COMMA {
+			c.advance() // consume ','
+
+			// Capture next variable using save/restore
+			varToken := c.peek()
+			savedOut := c.output.String()
+			c.output.Reset()
+			c.assignTarget = true
+			if err := c.primaryExpression(); err != nil {
+				return false, err
+			}
+			varName := c.output.String()
+			c.output.Reset()
+			c.output.WriteString(savedOut)
+
+			vars = append(vars, varName)
+			if c.implicitLocals() && ((c.isNewVariable(varName) && !strings.Contains(varName, ".") && !strings.Contains(varName, "[")) || varName == "_") {
+				newVars = append(newVars, varToken)
+			}
+		}
+
+		if c.peek().Type != TOKEN_ASSIGN {
+			return false, c.errorf(c.peek(), "expected '=' in assignment")
+		}
+		c.advance()
+
+		// Declare new variables. When some targets already exist, the new
+		// ones are declared first so `local` doesn't shadow the others:
+		// with a declared, a, _ = f() is local _ then a, _ = f().
+		names := []string{}
+		for _, v := range newVars {
+			c.declareVariable(v)
+			names = append(names, v.Value)
+		}
+
+		c.writeIndent()
+		if len(newVars) == len(vars) {
+			c.output.WriteString("local ")
+		} else if len(newVars) > 0 {
+			c.output.WriteString("local " + strings.Join(names, ", ") + "\n")
+			c.writeIndent()
+		}
+		c.output.WriteString(strings.Join(vars, ", "))
+		c.output.WriteString(" = ")
+
+		if err := c.expressionList(); err != nil {
+			return false, err
+		}
+		c.output.WriteString("\n")
+		return false, nil
+	}
+
+	// It's just an expression (probably a function call)
+	c.setNode("CallStatement", "")
+	c.writeIndent()
+	c.output.WriteString(leadingSemicolon(leftStr) + leftStr)
+	c.output.WriteString("\n")
+
+	return false, nil
+}
+
+// simpleKeyPattern matches the index keys that evaluate to the same value
+// without side effects: names, numbers and strings, shifted to 1 based or
+// counted from the end
+var simpleKeyPattern = regexp.MustCompile(`^(\((#?[a-zA-Z_][a-zA-Z0-9_.]*|[0-9.]+)\) \+ 1|#?[a-zA-Z_][a-zA-Z0-9_.]*( - [0-9]+)?|"[^"\\]*"|'[^'\\]*'|\[=*\[.*)$`)
+
+// hoistTarget splits an assignment target like f()[g()] into its object
+// and key, and returns it as __obj_1__[__key_2__] along with the local
+// declaration the two are evaluated into. Names and literals are kept as
+// they are; a target with nothing to hoist is returned with no declaration.
+func (c *Compiler) hoistTarget(target string) (string, string) {
+	// Find the last '[' or '.' outside of brackets and strings
+	depth, open, dot := 0, -1, -1
+	for i := 0; i < len(target); i++ {
+		switch ch := target[i]; ch {
+		case '"', '\'':
+			for i++; i < len(target) && target[i] != ch; i++ {
+				if target[i] == '\\' {
+					i++
+				}
+			}
+		case '(', '{':
+			depth++
+		case ')', '}':
+			depth--
+		case '[':
+			if level, ok := longBracket(target[i:]); ok {
+				i += strings.Index(target[i:], "]"+strings.Repeat("=", level)+"]") + level + 1
+				continue
+			}
+			if depth == 0 {
+				open = i
+			}
+			depth++
+		case ']':
+			depth--
+		case '.':
+			if depth == 0 {
+				dot = i
+			}
+		}
+	}
+
+	object, key, field := target, "", ""
+	switch {
+	case strings.HasSuffix(target, "]") && open > dot:
+		object, key = target[:open], target[open+1:len(target)-1]
+	case dot > 0:
+		object, field = target[:dot], target[dot+1:]
+	default:
+		return target, ""
+	}
+
+	names, values := []string{}, []string{}
+	if !simpleExprPattern.MatchString(object) {
+		temp := c.newTemp("obj")
+		names, values = append(names, temp), append(values, object)
+		object = temp
+	}
+	if key != "" && !simpleKeyPattern.MatchString(strings.TrimSpace(key)) {
+		temp := c.newTemp("key")
+		names, values = append(names, temp), append(values, key)
+		key = temp
+	}
+	if len(names) == 0 {
+		return target, ""
+	}
+	declaration := "local " + strings.Join(names, ", ") + " = " + strings.Join(values, ", ")
+	if field != "" {
+		return object + "." + field, declaration
+	}
+	return object + "[" + key + "]", declaration
+}
+
+// leadingSemicolon returns the ';' a statement starting with '(' needs,
+// as Lua would otherwise read it as a call of the previous line's value
+func leadingSemicolon(statement string) string {
+	if strings.HasPrefix(statement, "(") {
+		return ";"
+	}
+	return ""
+}
+
+func (c *Compiler) expression() error {
+	return c.nullCoalesce()
+}
+
+// isBinaryOperator reports whether t can continue an expression
+func isBinaryOperator(t TokenType) bool {
+	switch t {
+	case TOKEN_PLUS, TOKEN_MINUS, TOKEN_STAR, TOKEN_SLASH, TOKEN_SLASH_SLASH, TOKEN_PERCENT, TOKEN_CARET, TOKEN_STAR_STAR,
+		TOKEN_EQ, TOKEN_NEQ, TOKEN_LT, TOKEN_GT, TOKEN_LE, TOKEN_GE, TOKEN_DOTDOT,
+		TOKEN_AND, TOKEN_OR, TOKEN_DOUBLE_QUESTION:
+		return true
+	}
+	return false
+}
+
+// hasOperatorSince reports whether the tokens from start to the current
+// one have a binary operator outside of brackets
+func (c *Compiler) hasOperatorSince(start int) bool {
+	depth := 0
+	for _, token := range c.tokens[start:c.current] {
+		switch {
+		case token.Type == TOKEN_LPAREN || token.Type == TOKEN_LBRACKET || token.Type == TOKEN_LBRACE:
+			depth++
+		case token.Type == TOKEN_RPAREN || token.Type == TOKEN_RBRACKET || token.Type == TOKEN_RBRACE:
+			depth--
+		case depth == 0 && (isBinaryOperator(token.Type) || token.Type == TOKEN_IN):
+			return true
+		}
+	}
+	return false
+}
+
+// condition compiles an if/while condition. A '=' after it is almost
+// certainly a typo for '=='; lint mode points that out before the caller
+// reports the syntax error.
+func (c *Compiler) condition() error {
+	if err := c.expression(); err != nil {
+		return err
+	}
+
+	if c.peek().Type == TOKEN_ASSIGN {
+		c.lint(c.peek(), lintAssignInCondition, "'=' in condition, did you mean '=='?")
+	}
+
+	return nil
+}
+
+func (c *Compiler) nullCoalesce() error {
+	// Capture left side using save/restore pattern
+	defer c.node("Binary")()
+	varargs := c.varargUses
+	savedOutput := c.output.String()
+	c.output.Reset()
+
+	if err := c.logicalOr(); err != nil {
+		return err
+	}
+
+	leftStr := c.output.String()
+	c.output.Reset()
+	c.output.WriteString(savedOutput)
+
+	if c.peek().Type == TOKEN_DOUBLE_QUESTION {
+		c.advance() // consume '??'
+		c.binaryOp("??")
+
+		// Generate: (function() local __t = left; if __t ~= nil then return __t else return right end end)()
+		tempVar := c.newTemp("nc")
+
+		start := c.output.Len()
+		c.output.WriteString("(function() local ")
+		c.output.WriteString(tempVar)
+		c.output.WriteString(" = ")
+		c.output.WriteString(leftStr)
+		c.output.WriteString("; if ")
+		c.output.WriteString(tempVar)
+		c.output.WriteString(" ~= nil then return ")
+		c.output.WriteString(tempVar)
+		c.output.WriteString(" else return ")
+
+		if err := c.nullCoalesce(); err != nil {
+			return err
+		}
+
+		c.output.WriteString(" end end)()")
+		c.forwardVarargs(start, varargs)
+	} else {
+		c.output.WriteString(leftStr)
+	}
+
+	return nil
+}
+
+func (c *Compiler) logicalOr() error {
+	defer c.node("Binary")()
+	if err := c.logicalAnd(); err != nil {
+		return err
+	}
+
+	for c.peek().Type == TOKEN_OR {
+		c.advance()
+		c.binaryOp("or")
+		c.output.WriteString(" or ")
+		if err := c.logicalAnd(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var nilCheckPattern = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_.]*) ~= nil$`)
+
+func (c *Compiler) logicalAnd() error {
+	defer c.node("Binary")()
+	start := c.output.Len()
+	if err := c.comparison(); err != nil {
+		return err
+	}
+
+	for c.peek().Type == TOKEN_AND {
+		left := c.output.String()[start:]
+		andToken := c.advance()
+		c.binaryOp("and")
+		c.output.WriteString(" and ")
+		start = c.output.Len()
+		if err := c.comparison(); err != nil {
+			return err
+		}
+
+		// `a ~= nil and a.b` is what optional chaining is for
+		if m := nilCheckPattern.FindStringSubmatch(left); m != nil {
+			if right := c.output.String()[start:]; strings.HasPrefix(right, m[1]+".") {
+				c.lint(andToken, lintNilCheck, fmt.Sprintf("use '%s?.' instead of checking '%s ~= nil' first", m[1], m[1]))
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Compiler) comparison() error {
+	defer c.node("Compare")()
+	start, varargs := c.output.Len(), c.varargUses
+	if err := c.concatenation(); err != nil {
+		return err
+	}
+
+	// Operands and operators of a chain like a < b <= c
+	operands := []string{c.output.String()[start:]}
+	ops := []Token{}
+
+	for {
+		op := c.peek()
+		negate := op.Type == TOKEN_NOT && c.peekNext().Type == TOKEN_IN
+		switch {
+		case op.Type == TOKEN_IN || negate:
+			if negate {
+				c.advance() // consume 'not'
+				c.binaryOp("not in")
+			} else {
+				c.binaryOp("in")
+			}
+			c.advance()
+			if len(ops) > 1 {
+				if err := c.chainComparison(start, operands, ops, c.varargUses > varargs); err != nil {
+					return err
+				}
+			}
+			if err := c.membership(start, negate); err != nil {
+				return err
+			}
+			operands = []string{c.output.String()[start:]}
+			ops = ops[:0]
+			continue
+		case op.Type == TOKEN_LT:
+			c.output.WriteString(" < ")
+		case op.Type == TOKEN_GT:
+			c.output.WriteString(" > ")
+		case op.Type == TOKEN_LE:
+			c.output.WriteString(" <= ")
+		case op.Type == TOKEN_GE:
+			c.output.WriteString(" >= ")
+		case op.Type == TOKEN_EQ:
+			c.output.WriteString(" == ")
+		case op.Type == TOKEN_NEQ:
+			c.output.WriteString(" ~= ")
+		default:
+			if len(ops) > 1 {
+				return c.chainComparison(start, operands, ops, c.varargUses > varargs)
+			}
+			return nil
+		}
+		c.advance()
+		c.compareOp(op.Value)
+
+		operandStart := c.output.Len()
+		if err := c.concatenation(); err != nil {
+			return err
+		}
+		operands = append(operands, c.output.String()[operandStart:])
+		ops = append(ops, op)
+	}
+}
+
+var simpleOperandPattern = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_.]*|[0-9][0-9a-fA-FxX.]*)$`)
+
+// chainComparison replaces the output since start with a chain like
+// `a < b <= c` as `a < b and b <= c`. Middle operands that aren't plain
+// names or numbers are evaluated once, through a function parameter, and
+// later operands are only evaluated if the earlier comparisons held. With
+// varargs the operands use `...`, which the function is passed too.
+//
+// == and ~= don't chain. Lua reads `1 < 2 == true` as `(1 < 2) == true`,
+// but here it's an error asking for those parentheses, since it reads
+// like a chain that means something else.
+func (c *Compiler) chainComparison(start int, operands []string, ops []Token, varargs bool) error {
+	for _, op := range ops {
+		if op.Type == TOKEN_EQ || op.Type == TOKEN_NEQ {
+			return c.errorf(op, "'%s' can't be chained with other comparisons; add parentheses", op.Value)
+		}
+	}
+
+	params, args := "", ""
+	if varargs {
+		params, args = ", ...", ", ..."
+	}
+
+	var chain func(left string, i int) string
+	chain = func(left string, i int) string {
+		op, right := " "+ops[i].Value+" ", operands[i+1]
+		if i == len(ops)-1 {
+			return left + op + right
+		}
+		if simpleOperandPattern.MatchString(right) {
+			return left + op + right + " and " + chain(right, i+1)
+		}
+
+		temp := c.newTemp("cmp")
+		if simpleOperandPattern.MatchString(left) {
+			return fmt.Sprintf("(function(%s%s) return %s%s%s and %s end)(%s%s)", temp, params, left, op, temp, chain(temp, i+1), right, args)
+		}
+
+		// Keep the left operand evaluated before the right
+		leftTemp := c.newTemp("cmp")
+		return fmt.Sprintf("(function(%s, %s%s) return %s%s%s and %s end)(%s, %s%s)",
+			leftTemp, temp, params, leftTemp, op, temp, chain(temp, i+1), left, right, args)
+	}
+
+	prefix := c.output.String()[:start]
+	c.output.Reset()
+	c.output.WriteString(prefix)
+	c.output.WriteString(chain(operands[0], 0))
+
+	return nil
+}
+
+var simpleExprPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.]*$`)
+
+// membership compiles `x in t`, with x being the output since start.
+//
+// The key form, `key in set`, is `set[key] ~= nil`. Keys are used as is,
+// without the +1 that indexing adds. When the right side is a table
+// literal or a pairs/ipairs call, the value form checks the values:
+// `c in {"a", "b"}` and `v in ipairs(list)`. With negate it's `not in`.
+func (c *Compiler) membership(start int, negate bool) error {
+	output := c.output.String()
+	prefix, left := output[:start], output[start:]
+
+	iterator := ""
+	switch next := c.peek(); {
+	case next.Type == TOKEN_LBRACE:
+		iterator = "ipairs"
+	case next.Type == TOKEN_IDENT && (next.Value == "pairs" || next.Value == "ipairs") && c.peekNext().Type == TOKEN_LPAREN:
+		iterator = next.Value
+	}
+
+	varargs := c.varargUses
+	c.output.Reset()
+	if err := c.concatenation(); err != nil {
+		return err
+	}
+	right := c.output.String()
+	c.output.Reset()
+	c.output.WriteString(prefix)
+
+	if iterator == "" {
+		if !simpleExprPattern.MatchString(right) {
+			right = "(" + right + ")"
+		}
+		if negate {
+			c.output.WriteString(fmt.Sprintf("%s[%s] == nil", right, left))
+		} else {
+			c.output.WriteString(fmt.Sprintf("%s[%s] ~= nil", right, left))
+		}
+		return nil
+	}
+
+	if !strings.HasPrefix(right, iterator+"(") {
+		right = iterator + "(" + right + ")"
+	}
+	value := c.newTemp("in")
+	c.output.WriteString(fmt.Sprintf("(function(%s) for _, __v__ in %s do if __v__ == %s then return %t end end return %t end)(%s)",
+		value, right, value, !negate, negate, left))
+	c.forwardVarargs(len(prefix), varargs)
+
+	return nil
+}
+
+func (c *Compiler) concatenation() error {
+	defer c.node("Binary")()
+	if err := c.addition(); err != nil {
+		return err
+	}
+
+	for c.peek().Type == TOKEN_DOTDOT {
+		c.advance()
+		c.binaryOp("..")
+		c.output.WriteString(" .. ")
+		if err := c.addition(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Compiler) addition() error {
+	defer c.node("Binary")()
+	if err := c.multiplication(); err != nil {
+		return err
+	}
+
+	for {
+		switch c.peek().Type {
+		case TOKEN_PLUS:
+			c.advance()
+			c.output.WriteString(" + ")
+		case TOKEN_MINUS:
+			c.advance()
+			c.output.WriteString(" - ")
+		default:
+			return nil
+		}
+		c.binaryOp(c.previous().Value)
+
+		if err := c.multiplication(); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Compiler) multiplication() error {
+	defer c.node("Binary")()
+	start := c.output.Len()
+	if err := c.unary(); err != nil {
+		return err
+	}
+
+	for {
+		switch c.peek().Type {
+		case TOKEN_STAR:
+			c.advance()
+			c.output.WriteString(" * ")
+		case TOKEN_SLASH:
+			c.advance()
+			c.output.WriteString(" / ")
+		case TOKEN_SLASH_SLASH:
+			c.advance()
+			if !c.hasFloorDivision() {
+				// Everything so far is the left operand, as // groups left
+				c.binaryOp("//")
+				output := c.output.String()
+				c.output.Reset()
+				c.output.WriteString(output[:start] + "math.floor(" + output[start:] + " / ")
+				if err := c.unary(); err != nil {
+					return err
+				}
+				c.output.WriteString(")")
+				continue
+			}
+			c.output.WriteString(" // ")
+		case TOKEN_PERCENT:
+			c.advance()
+			c.output.WriteString(" % ")
+		default:
+			return nil
+		}
+		c.binaryOp(c.previous().Value)
+
+		if err := c.unary(); err != nil {
+			return err
+		}
+	}
+}
+
+// unary handles the prefix operators not, - and #. Like Lua they bind
+// tighter than the arithmetic operators (#t + 1 is (#t) + 1) but looser
+// than ^ (-x ^ 2 is -(x ^ 2)), so the operand is parsed by power().
+func (c *Compiler) unary() error {
+	switch c.peek().Type {
+	case TOKEN_NOT:
+		defer c.node("Unary")()
+		c.setNode("Unary", c.advance().Value)
+		c.output.WriteString("not ")
+		return c.unary()
+	case TOKEN_MINUS:
+		defer c.node("Unary")()
+		c.setNode("Unary", c.advance().Value)
+		if c.options.Target == "5.1" && c.peek().Type == TOKEN_NUMBER && isZero(c.peek().Value) && c.peekNext().Type != TOKEN_CARET && c.peekNext().Type != TOKEN_STAR_STAR {
+			// Lua 5.1 stores -0 and 0 as one constant, so whichever comes
+			// first wins; dividing by math.huge happens at run time
+			c.leaf("Number", c.advance())
+			c.output.WriteString("(-1/math.huge)")
+			return nil
+		}
+		c.output.WriteString("-")
+		if c.peek().Type == TOKEN_MINUS {
+			c.output.WriteString(" ") // - -x, not the comment --x
+		}
+		return c.unary()
+	case TOKEN_HASH:
+		defer c.node("Unary")()
+		c.setNode("Unary", c.advance().Value)
+		c.output.WriteString("#")
+		return c.unary()
+	}
+
+	return c.power()
+}
+
+func (c *Compiler) power() error {
+	defer c.node("Binary")()
+	if err := c.primaryExpression(); err != nil {
+		return err
+	}
+
+	// ** is the same as ^
+	if c.peek().Type == TOKEN_CARET || c.peek().Type == TOKEN_STAR_STAR {
+		c.advance()
+		c.binaryOp("^")
+		c.output.WriteString(" ^ ")
+		if err := c.unary(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Compiler) primaryExpression() error {
+	defer c.node("Primary")()
+	start := c.output.Len()
+	first := c.current
+	varargs := c.varargUses
+	target := c.assignTarget
+	if err := c.atom(); err != nil {
+		return err
+	}
+
+	// Lua only allows suffixes on a literal in parens: ("x"):rep(3).
+	// Template strings are compiled in parens already.
+	literal := TOKEN_EOF
+	grouped := false
+	if kind := c.tokens[first].Type; c.current == first+1 && (kind == TOKEN_STRING || kind == TOKEN_NUMBER) {
+		literal = kind
+	} else if c.current == first+1 && kind == TOKEN_TEMPLATE_STRING {
+		literal, grouped = TOKEN_STRING, true
+	}
+	// Whether the expression so far can be evaluated twice, for t[-1]:
+	// names, fields and indices by names or literals
+	pure := c.tokens[first].Type == TOKEN_IDENT
+
+	// A string literal, alone or in parentheses, which has no length to
+	// count a negative index back from
+	atomEnd := c.current
+	stringLiteral := c.tokens[first].Type == TOKEN_STRING || c.tokens[first].Type == TOKEN_TEMPLATE_STRING ||
+		c.tokens[first].Type == TOKEN_LPAREN && atomEnd == first+3 &&
+			(c.tokens[first+1].Type == TOKEN_STRING || c.tokens[first+1].Type == TOKEN_TEMPLATE_STRING)
+
+	group := func() {
+		if literal != TOKEN_EOF && !grouped {
+			output := c.output.String()
+			c.output.Reset()
+			c.output.WriteString(output[:start] + "(" + output[start:] + ")")
+		}
+		literal = TOKEN_EOF
+	}
+
+	// Handle suffixes: calls, indexing, field access, optional chaining.
+	// A suffix may start a new line, so chains can be split before a '.',
+	// '?.' or ':'. Only '(' and strings, which can also start a statement,
+	// look at the line they're on.
+	for {
+		switch c.peek().Type {
+		case TOKEN_DOT:
+			// "x".upper() calls the string method, like "x":upper()
+			if literal == TOKEN_STRING && c.peekNext().Type == TOKEN_IDENT && c.peekAt(2).Type == TOKEN_LPAREN {
+				group()
+				if err := c.methodCall(); err != nil {
+					return err
+				}
+				pure = false
+				continue
+			}
+			group()
+			c.advance()
+			c.output.WriteString(".")
+			if c.peek().Type != TOKEN_IDENT {
+				return c.errorf(c.peek(), "expected identifier after '.'")
+			}
+			c.wrap("Field", c.peek().Value)()
+			c.output.WriteString(c.advance().Value)
+
+		case TOKEN_QUESTION_DOT:
+			pure = false
+			// Optional chaining: obj?.field
+			c.advance()
+			c.optionalChain(start)
+			c.output.WriteString(".")
+
+			if c.peek().Type != TOKEN_IDENT {
+				return c.errorf(c.peek(), "expected identifier after '?.'")
+			}
+			c.wrap("OptionalField", c.peek().Value)()
+			c.output.WriteString(c.advance().Value)
+			c.output.WriteString(" end)()")
+			c.forwardVarargs(start, varargs)
+
+		case TOKEN_LBRACKET:
+			if stringLiteral && c.current == atomEnd && !c.options.NoNegativeIndex && c.peekNext().Type == TOKEN_MINUS && c.peekAt(2).Type == TOKEN_NUMBER {
+				return c.errorf(c.peekNext(), "negative indices aren't allowed on a string literal; use string.sub")
+			}
+			group()
+			closeIndex := c.wrap("Index", "")
+			key := c.current + 1
+			if err := c.index(c.output.String()[start:], pure, target); err != nil {
+				return err
+			}
+			closeIndex()
+			pure = pure && simpleKey(c.tokens[key:c.current-1])
+
+		case TOKEN_QUESTION_BRACKET:
+			// Optional indexing: t?[k]
+			closeIndex := c.wrap("OptionalIndex", "")
+			if err := c.index(c.optionalChain(start), true, false); err != nil {
+				return err
+			}
+			c.output.WriteString(" end)()")
+			c.forwardVarargs(start, varargs)
+			closeIndex()
+			pure = false
+
+		case TOKEN_COLON:
+			// Only treat as method call if followed by identifier and method calls are enabled
+			if c.noMethodCalls || c.peekNext().Type != TOKEN_IDENT {
+				return nil
+			}
+			group()
+			if err := c.methodCall(); err != nil {
+				return err
+			}
+			pure = false
+
+		case TOKEN_LPAREN:
+			if c.peek().Line != c.previous().Line {
+				c.warn(c.peek(), "ambiguous-call", "'(' at the start of a line calls the value before it; put ';' before the '(' to start a new statement")
+			}
+			closeCall := c.wrap("Call", "")
+			if err := c.callArguments(); err != nil {
+				return err
+			}
+			closeCall()
+			pure = false
+
+		case TOKEN_STRING:
+			// Function call with string argument: print "hello". On the
+			// next line, the string starts a statement like "x".upper()
+			if c.peek().Line != c.previous().Line {
+				return nil
+			}
+			closeCall := c.wrap("Call", "")
+			c.leaf("String", c.peek())
+			c.output.WriteString("(")
+			c.output.WriteString(c.advance().Value)
+			c.output.WriteString(")")
+			closeCall()
+			pure = false
+
+		case TOKEN_LBRACE:
+			// Function call with table argument: func{...}
+			if c.noTableCalls {
+				return nil
+			}
+			closeCall := c.wrap("Call", "")
+			if err := c.tableConstructor(); err != nil {
+				return err
+			}
+			closeCall()
+			pure = false
+
+		default:
+			return nil
+		}
+	}
+}
+
+// methodCall compiles the `:name(args)` suffix of a method call, also
+// written `.name(args)` on a string literal
+func (c *Compiler) methodCall() error {
+	c.advance()
+	closeCall := c.wrap("MethodCall", c.peek().Value)
+	c.output.WriteString(":")
+	c.output.WriteString(c.advance().Value)
+
+	// Method call must be followed by arguments
+	if c.peek().Type != TOKEN_LPAREN && c.peek().Type != TOKEN_STRING && c.peek().Type != TOKEN_LBRACE {
+		return c.errorf(c.peek(), "expected arguments after method name")
+	}
+	if err := c.callArguments(); err != nil {
+		return err
+	}
+	closeCall()
+	return nil
+}
+
+// newTemp returns a fresh name for a temporary the compiler declares,
+// like __nc_3__ for the left side of a ??
+func (c *Compiler) newTemp(kind string) string {
+	c.labelCounter++
+	c.synthetic = true
+	return fmt.Sprintf("__%s_%d__", kind, c.labelCounter)
+}
+
+// forwardVarargs passes the enclosing function's `...` to the immediately
+// invoked function that starts at start and ends the output, if its body
+// used `...` since varargUses was uses. Lua closures can't capture `...`,
+// so without this the body would see the closure's own, empty, varargs:
+//
+//	(function(__match_1__, ...) ... end)(x, ...)
+func (c *Compiler) forwardVarargs(start int, uses int) {
+	if c.varargUses == uses {
+		return
+	}
+	output := c.output.String()
+	open := start + len("(function(")
+	params := open + strings.IndexByte(output[open:], ')')
+	call := len(output) - 1
+	param, arg := ", ...", ", ..."
+	if params == open {
+		param = "..."
+	}
+	if output[call-1] == '(' {
+		arg = "..."
+	}
+	c.output.Reset()
+	c.output.WriteString(output[:params] + param + output[params:call] + arg + output[call:])
+}
+
+// optionalChain starts the nil check of obj?.field or obj?[key], with
+// obj being the output after start. The caller writes the access to
+// complete `(function() local t = obj; ... return t` and closes it.
+// It returns the name that now holds obj.
+func (c *Compiler) optionalChain(start int) string {
+	tempVar := c.newTemp("oc")
+
+	output := c.output.String()
+	c.output.Reset()
+	c.output.WriteString(output[:start])
+	c.output.WriteString(fmt.Sprintf("(function() local %s = %s; if %s == nil then return nil end; return %s", tempVar, output[start:], tempVar, tempVar))
+	return tempVar
+}
+
+// simpleKey reports whether tokens, the key of an index, is a name or a
+// literal, which can be evaluated twice
+func simpleKey(tokens []Token) bool {
+	if len(tokens) == 2 && tokens[0].Type == TOKEN_MINUS {
+		tokens = tokens[1:]
+	}
+	if len(tokens) != 1 {
+		return false
+	}
+	switch tokens[0].Type {
+	case TOKEN_IDENT, TOKEN_NUMBER, TOKEN_STRING, TOKEN_TRUE, TOKEN_FALSE:
+		return true
+	}
+	return false
+}
+
+// index compiles [expr] or ?[expr] after the value being indexed, object.
+// Arrays are 0-indexed, so the key is offset by 1 unless it's a string
+// literal. A literal negative key counts from the end, naming object
+// twice, so unless it's pure the object is evaluated once in a function:
+//
+//	(function(__obj_1__) return __obj_1__[#__obj_1__] end)(f())
+//
+// That can't be assigned to, so target says the index may be.
+func (c *Compiler) index(object string, pure bool, target bool) error {
+	indexToken := c.advance() // consume '[' or '?['
+
+	savedOut := c.output.String()
+	c.output.Reset()
+
+	// A literal negative index counts from the end: t[-1] is t[#t]
+	startToken := c.peek()
+	fromEnd := int64(0)
+	if !c.options.NoNegativeIndex && startToken.Type == TOKEN_MINUS && c.peekNext().Type == TOKEN_NUMBER && c.peekAt(2).Type == TOKEN_RBRACKET {
+		if number, _, err := convertNumber(c.peekNext().Value, c.options.Target); err == nil {
+			fromEnd, _ = strconv.ParseInt(number, 0, 64)
+		}
+	}
+	hoisted := ""
+	if fromEnd > 0 && !pure {
+		hoisted = object
+		object = c.newTemp("obj")
+		savedOut = savedOut[:len(savedOut)-len(hoisted)] + "(function(" + object + ") return " + object
+	}
+
+	if err := c.expression(); err != nil {
+		return err
+	}
+
+	indexStr := c.output.String()
+	c.output.Reset()
+	c.output.WriteString(savedOut)
+
+	c.output.WriteString("[")
+	if fromEnd == 1 {
+		c.output.WriteString("#" + object)
+	} else if fromEnd > 1 {
+		c.output.WriteString(fmt.Sprintf("#%s - %d", object, fromEnd-1))
+	} else if startToken.Type == TOKEN_STRING {
+		c.output.WriteString(spaceLongString(indexStr))
+	} else {
+		c.output.WriteString("(")
+		c.output.WriteString(indexStr)
+		c.output.WriteString(") + 1")
+	}
+	c.output.WriteString("]")
+
+	if c.peek().Type != TOKEN_RBRACKET {
+		return c.errorf(c.peek(), "expected ']'")
+	}
+	c.advance()
+
+	if hoisted != "" {
+		if target && (isAssignment(c.peek().Type) || c.peek().Type == TOKEN_COMMA || c.touching[c.current-1] == "--") {
+			return c.errorf(indexToken, "can't assign to a negative index of '%s', which has side effects; store it in a local first", hoisted)
+		}
+		c.output.WriteString(" end)(" + hoisted + ")")
+	}
+	return nil
+}
+
+func (c *Compiler) callArguments() error {
+	if c.peek().Type != TOKEN_LPAREN {
+		return nil
+	}
+	c.advance()
+	c.output.WriteString("(")
+
+	first := true
+	for c.peek().Type != TOKEN_RPAREN && !c.isAtEnd() {
+		if !first {
+			c.output.WriteString(", ")
+		}
+		first = false
+
+		start := c.current
+		if err := c.expression(); err != nil {
+			return err
+		}
+		if c.peek().Type == TOKEN_COMMA && c.peekNext().Type != TOKEN_RPAREN {
+			if name, end := c.multiReturnCall(start); name != "" && end == c.current {
+				c.lint(c.tokens[start], lintTruncatedCall, "multiple return values of "+name+"() are truncated here; only the last argument keeps them all")
+			}
+		}
+
+		// A trailing comma is allowed but Lua rejects it, so drop it
+		if c.peek().Type != TOKEN_COMMA {
+			break
+		}
+		c.advance()
+	}
+
+	if c.peek().Type != TOKEN_RPAREN {
+		return c.errorf(c.peek(), "expected ')' after arguments")
+	}
+	c.advance()
+	c.output.WriteString(")")
+
+	return nil
+}
+
+// isZero reports whether a number literal is zero
+func isZero(literal string) bool {
+	converted, _, err := convertNumber(literal, "")
+	if err != nil {
+		return false
+	}
+	if n, err := strconv.ParseInt(converted, 0, 64); err == nil {
+		return n == 0
+	}
+	f, err := strconv.ParseFloat(converted, 64)
+	return err == nil && f == 0
+}
+
+// specialFloats are the float values Lua has no literal for
+var specialFloats = map[string]string{
+	"inf": "math.huge",
+	"nan": "(0/0)",
+}
+
+func (c *Compiler) atom() error {
+	assignTarget := c.assignTarget
+	c.assignTarget = false
+
+	switch c.peek().Type {
+	case TOKEN_NIL:
+		c.leaf("Nil", c.advance())
+		c.output.WriteString("nil")
+
+	case TOKEN_TRUE:
+		c.leaf("Boolean", c.advance())
+		c.output.WriteString("true")
+
+	case TOKEN_FALSE:
+		c.leaf("Boolean", c.advance())
+		c.output.WriteString("false")
+
+	case TOKEN_NUMBER:
+		c.leaf("Number", c.peek())
+		numToken := c.advance()
+		converted, warning, err := convertNumber(numToken.Value, c.options.Target)
+		if err != nil {
+			return c.errorf(numToken, "%v", err)
+		}
+		if warning != "" {
+			c.warn(numToken, "precision-loss", warning)
+		}
+		c.output.WriteString(converted)
+
+	case TOKEN_STRING:
+		c.leaf("String", c.peek())
+		c.output.WriteString(c.advance().Value)
+
+	case TOKEN_TEMPLATE_STRING:
+		c.leaf("Template", c.peek())
+		if err := c.compileTemplateString(c.advance().Value); err != nil {
+			return err
+		}
+
+	case TOKEN_IDENT:
+		// 'match' is contextual so string.match and friends keep working
+		if c.peek().Value == "match" && c.isMatchStart() {
+			return c.matchExpression()
+		}
+		if c.peek().Value == "when" && c.isWhenStart() {
+			return c.whenExpression()
+		}
+		if c.isFreeze() {
+			return c.freezeCall()
+		}
+		// So are inf and nan, which are names once declared
+		if value, ok := specialFloats[c.peek().Value]; ok && !assignTarget && !c.isVariableDeclared(c.peek().Value) {
+			c.leaf("Number", c.advance())
+			c.output.WriteString(value)
+			return nil
+		}
+		c.leaf("Identifier", c.peek())
+		name := c.advance().Value
+		v := c.lookupVariable(name)
+		if v != nil {
+			v.used = true
+		}
+		if v != nil && v.enum != nil && c.peek().Type == TOKEN_DOT && c.peekNext().Type == TOKEN_IDENT {
+			c.advance()
+			member := c.advance()
+			value, ok := v.enum[member.Value]
+			if !ok {
+				return c.errorf(member, "enum '%s' has no member '%s'", name, member.Value)
+			}
+			c.wrap("Field", member.Value)()
+			c.output.WriteString(value)
+			return nil
+		}
+		if name == "require" && c.options.ResolveRequire != nil && !c.isVariableDeclared(name) {
+			return c.requireCall()
+		}
+		c.output.WriteString(name)
+
+	case TOKEN_DOTDOTDOT:
+		c.leaf("Vararg", c.advance())
+		c.output.WriteString("...")
+		c.varargUses++
+
+	case TOKEN_LPAREN:
+		defer c.node("Paren")()
+		c.advance()
+		c.output.WriteString("(")
+		if err := c.expression(); err != nil {
+			return err
+		}
+		if c.peek().Type != TOKEN_RPAREN {
+			return c.errorf(c.peek(), "expected ')'")
+		}
+		c.advance()
+		c.output.WriteString(")")
+
+	case TOKEN_LBRACE:
+		if err := c.tableConstructor(); err != nil {
+			return err
+		}
+
+	case TOKEN_LBRACKET:
+		return c.comprehension()
+
+	case TOKEN_DO:
+		if c.peekNext().Type != TOKEN_LBRACE {
+			return c.errorf(c.peek(), "expected '{' after 'do' in expression")
+		}
+		return c.doExpression()
+
+	case TOKEN_FUNCTION:
+		defer c.node("Function")()
+		c.advance()
+		c.output.WriteString("function")
+		if err := c.functionBody("", false); err != nil {
+			return err
+		}
+		// Remove the trailing newline that functionBody adds
+		str := c.output.String()
+		if strings.HasSuffix(str, "\n") {
+			c.output.Reset()
+			c.output.WriteString(strings.TrimSuffix(str, "\n"))
+		}
+
+	default:
+		return c.errorf(c.peek(), "unexpected token %v", c.peek().Value)
+	}
+
+	return nil
+}
+
+// requireCall rewrites `require "./path"` or `require("./path")` to load
+// the resolved module name. Other requires are compiled as normal calls.
+func (c *Compiler) requireCall() error {
+	arg := c.peek()
+	parens := false
+	if arg.Type == TOKEN_LPAREN && c.peekNext().Type == TOKEN_STRING && c.peekAt(2).Type == TOKEN_RPAREN {
+		arg = c.peekNext()
+		parens = true
+	}
+
+	quoted := arg.Type == TOKEN_STRING && (arg.Value[0] == '"' || arg.Value[0] == '\'')
+	if !quoted {
+		c.output.WriteString("require")
+		return nil
+	}
+	path := arg.Value[1 : len(arg.Value)-1]
+	if !strings.HasPrefix(path, "./") && !strings.HasPrefix(path, "../") {
+		c.recordRequire(path)
+		c.output.WriteString("require")
+		return nil
+	}
+
+	module, err := c.options.ResolveRequire(path)
+	if err != nil {
+		return c.errorf(arg, "%v", err)
+	}
+	c.recordRequire(module)
+	defer c.wrap("Call", "")()
+	c.leaf("String", arg)
+
+	c.advance()
+	if parens {
+		c.advance()
+		c.advance()
+	}
+	c.output.WriteString(fmt.Sprintf("require(%q)", module))
+
+	return nil
+}
+
+// doExpression compiles `do { local a = f(); a * 2 }` into an immediately
+// invoked function. The block's value is its last expression, or what it
+// explicitly returns.
+func (c *Compiler) doExpression() error {
+	defer c.node("DoExpression")()
+	c.advance() // consume 'do'
+	c.advance() // consume '{'
+	start, varargs := c.output.Len(), c.varargUses
+	c.output.WriteString("(function()\n")
+
+	// Loops outside the function can't be broken out of or continued
+	savedLoopDepth, savedInDo, savedLabels := c.loopDepth, c.inDoExpression, c.loopLabels
+	c.loopDepth = 0
+	c.inDoExpression = true
+	c.loopLabels = nil
+
+	c.indent++
+	c.pushScope()
+	frame := &functionFrame{scopeDepth: len(c.scopes)}
+	c.functions = append(c.functions, frame)
+	c.labelScopes[len(c.labelScopes)-1].function = true
+
+	last := TOKEN_EOF
+	for c.peek().Type != TOKEN_RBRACE && !c.isAtEnd() {
+		if last == TOKEN_RETURN {
+			return c.errorf(c.peek(), "unreachable code after the value of a do expression")
+		}
+		c.blockValue = true
+		if err := c.statement(); err != nil {
+			return err
+		}
+		last = c.lastStatement
+	}
+
+	// An if or other statement at the end has no value to give
+	if last != TOKEN_RETURN {
+		return c.errorf(c.peek(), "do expression must end in an expression")
+	}
+	if err := c.checkGotos(); err != nil {
+		return err
+	}
+
+	c.functions = c.functions[:len(c.functions)-1]
+	c.popScope()
+	c.indent--
+	c.loopDepth, c.inDoExpression, c.loopLabels = savedLoopDepth, savedInDo, savedLabels
+
+	if c.peek().Type != TOKEN_RBRACE {
+		return c.errorf(c.peek(), "expected '}' to close do expression")
+	}
+	c.advance()
+
+	c.writeIndent()
+	c.output.WriteString("end)()")
+	c.forwardVarargs(start, varargs)
+
+	return nil
+}
+
+// isMatchStart reports whether the 'match' identifier at the current
+// position begins a match expression rather than naming a variable. The
+// subject has to be on the same line, so `local m = match` followed by a
+// statement is the variable.
+func (c *Compiler) isMatchStart() bool {
+	if c.peekNext().Line != c.peek().Line {
+		return false
+	}
+	switch c.peekNext().Type {
+	case TOKEN_IDENT, TOKEN_NUMBER, TOKEN_STRING, TOKEN_TEMPLATE_STRING, TOKEN_TRUE, TOKEN_FALSE,
+		TOKEN_NIL, TOKEN_NOT, TOKEN_HASH:
+		return true
+	}
+	return false
+}
+
+// matchExpression compiles
+//
+//	match shape { Circle(r) => r * r, Rect(w, h) => w * h, 0 => "zero", _ => nil }
+//
+// into an immediately invoked function. A `Tag(a, b)` arm matches a table
+// whose tag field is "Tag" and binds a and b to its elements 0 and 1,
+// literal arms compare with ==, and `_` matches anything.
+func (c *Compiler) matchExpression() error {
+	defer c.node("Match")()
+	matchToken := c.advance() // consume 'match'
+
+	// Capture the subject; the '{' after it opens the arms, not a table call
+	savedOutput := c.output.String()
+	c.output.Reset()
+	c.noTableCalls = true
+	if err := c.expression(); err != nil {
+		c.noTableCalls = false
+		return err
+	}
+	c.noTableCalls = false
+	subjectStr := c.output.String()
+	c.output.Reset()
+	c.output.WriteString(savedOutput)
+
+	if c.peek().Type != TOKEN_LBRACE {
+		return c.errorf(c.peek(), "expected '{' after match subject")
+	}
+	c.advance()
+
+	tempVar := c.newTemp("match")
+
+	start, varargs := c.output.Len(), c.varargUses
+	c.output.WriteString("(function(")
+	c.output.WriteString(tempVar)
+	c.output.WriteString(") ")
+
+	firstArm := true
+	exhaustive := false
+	for c.peek().Type != TOKEN_RBRACE && !c.isAtEnd() {
+		if exhaustive {
+			return c.errorf(c.peek(), "unreachable match arm after '_'")
+		}
+
+		closeArm := c.node("MatchArm")
+		condition := ""
+		bindings := []Token{}
+
+		switch pattern := c.peek(); {
+		case pattern.Type == TOKEN_IDENT && pattern.Value == "_":
+			c.leaf("Wildcard", c.advance())
+			exhaustive = true
+
+		case pattern.Type == TOKEN_IDENT && c.peekNext().Type == TOKEN_LPAREN:
+			// Tag pattern: Name(a, b)
+			c.leaf("Tag", c.advance())
+			c.advance() // consume '('
+			condition = fmt.Sprintf("type(%s) == \"table\" and %s.tag == %q", tempVar, tempVar, pattern.Value)
+			for c.peek().Type != TOKEN_RPAREN && !c.isAtEnd() {
+				if c.peek().Type != TOKEN_IDENT {
+					return c.errorf(c.peek(), "expected name in '%s' pattern", pattern.Value)
+				}
+				c.leaf("Name", c.peek())
+				bindings = append(bindings, c.advance())
+				if c.peek().Type == TOKEN_COMMA {
+					c.advance()
+				}
+			}
+			if c.peek().Type != TOKEN_RPAREN {
+				return c.errorf(c.peek(), "expected ')' after '%s' pattern", pattern.Value)
+			}
+			c.advance()
+
+		case pattern.Type == TOKEN_NUMBER || pattern.Type == TOKEN_STRING || pattern.Type == TOKEN_TRUE ||
+			pattern.Type == TOKEN_FALSE || pattern.Type == TOKEN_NIL || pattern.Type == TOKEN_MINUS:
+			// Literal pattern
+			savedOut := c.output.String()
+			c.output.Reset()
+			if err := c.unary(); err != nil {
+				return err
+			}
+			literalStr := c.output.String()
+			c.output.Reset()
+			c.output.WriteString(savedOut)
+			condition = fmt.Sprintf("%s == %s", tempVar, literalStr)
+
+		default:
+			return c.errorf(pattern, "invalid match pattern %v", pattern.Value)
+		}
+
+		if c.peek().Type != TOKEN_ARROW {
+			return c.errorf(c.peek(), "expected '=>' after match pattern")
+		}
+		c.advance()
+
+		switch {
+		case condition == "" && firstArm:
+			c.output.WriteString("do ")
+		case condition == "":
+			c.output.WriteString("else ")
+		case firstArm:
+			c.output.WriteString("if " + condition + " then ")
+		default:
+			c.output.WriteString("elseif " + condition + " then ")
+		}
+		firstArm = false
+
+		c.pushScope()
+		if len(bindings) > 0 {
+			names := []string{}
+			values := []string{}
+			for i, binding := range bindings {
+				names = append(names, binding.Value)
+				values = append(values, fmt.Sprintf("%s[%d]", tempVar, i+1))
+				c.declareVariable(binding)
+			}
+			c.output.WriteString("local ")
+			c.output.WriteString(strings.Join(names, ", "))
+			c.output.WriteString(" = ")
+			c.output.WriteString(strings.Join(values, ", "))
+			c.output.WriteString("; ")
+		}
+
+		c.output.WriteString("return ")
+		if err := c.expression(); err != nil {
+			return err
+		}
+		c.output.WriteString(" ")
+		c.popScope()
+		closeArm()
+
+		// Optional comma between arms
+		if c.peek().Type == TOKEN_COMMA {
+			c.advance()
+		}
+	}
+
+	if c.peek().Type != TOKEN_RBRACE {
+		return c.errorf(c.peek(), "expected '}' to close match")
+	}
+	c.advance()
+
+	if !exhaustive {
+		c.warn(matchToken, "non-exhaustive", "match has no '_' arm and yields nil when nothing matches")
+	}
+
+	if !firstArm {
+		c.output.WriteString("end ")
+	}
+	c.output.WriteString("end)(")
+	c.output.WriteString(subjectStr)
+	c.output.WriteString(")")
+	c.forwardVarargs(start, varargs)
+
+	return nil
+}
+
+// isWhenStart reports whether 'when' starts a when expression rather than
+// being a name called with a table, by looking for '=>' in the first arm
+func (c *Compiler) isWhenStart() bool {
+	if c.peekNext().Type != TOKEN_LBRACE || c.isVariableDeclared("when") {
+		return false
+	}
+	depth := 0
+	for i := c.current + 2; i < len(c.tokens); i++ {
+		switch c.tokens[i].Type {
+		case TOKEN_LPAREN, TOKEN_LBRACKET, TOKEN_LBRACE:
+			depth++
+		case TOKEN_RPAREN, TOKEN_RBRACKET, TOKEN_RBRACE:
+			if depth == 0 {
+				return false
+			}
+			depth--
+		case TOKEN_COMMA, TOKEN_EOF:
+			if depth == 0 {
+				return false
+			}
+		case TOKEN_ARROW:
+			return depth == 0
+		}
+	}
+	return false
+}
+
+// whenExpression compiles
+//
+//	when { score >= 90 => "A", score >= 80 => "B", else => "F" }
+//
+// into an immediately invoked function. The guards are tried in order
+// and the first true one picks the value, so the else arm is required.
+func (c *Compiler) whenExpression() error {
+	defer c.node("When")()
+	c.advance() // consume 'when'
+	c.advance() // consume '{'
+
+	start, varargs := c.output.Len(), c.varargUses
+	c.output.WriteString("(function() ")
+
+	firstArm := true
+	hasElse := false
+	for c.peek().Type != TOKEN_RBRACE && !c.isAtEnd() {
+		if hasElse {
+			return c.errorf(c.peek(), "unreachable when arm after 'else'")
+		}
+
+		closeArm := c.node("WhenArm")
+		if c.peek().Type == TOKEN_ELSE {
+			c.leaf("Else", c.advance())
+			hasElse = true
+			if firstArm {
+				c.output.WriteString("do ")
+			} else {
+				c.output.WriteString("else ")
+			}
+		} else {
+			if firstArm {
+				c.output.WriteString("if ")
+			} else {
+				c.output.WriteString("elseif ")
+			}
+			if err := c.condition(); err != nil {
+				return err
+			}
+			c.output.WriteString(" then ")
+		}
+		firstArm = false
+
+		if c.peek().Type != TOKEN_ARROW {
+			return c.errorf(c.peek(), "expected '=>' after when guard")
+		}
+		c.advance()
+
+		c.output.WriteString("return ")
+		if err := c.expression(); err != nil {
+			return err
+		}
+		c.output.WriteString(" ")
+		closeArm()
+
+		// Optional comma between arms
+		if c.peek().Type == TOKEN_COMMA {
+			c.advance()
+		}
+	}
+
+	if c.peek().Type != TOKEN_RBRACE {
+		return c.errorf(c.peek(), "expected '}' to close when")
+	}
+	if !hasElse {
+		return c.errorf(c.peek(), "when expression needs an 'else' arm")
+	}
+	c.advance()
+
+	c.output.WriteString("end end)()")
+	c.forwardVarargs(start, varargs)
+	return nil
+}
+
+func (c *Compiler) tableConstructor() error {
+	if c.isTableComprehension() {
+		return c.comprehension()
+	}
+	defer c.node("Table")()
+	c.advance() // consume '{'
+	c.output.WriteString("{")
+
+	first := true
+	index := 0
+	keys := map[string]int{} // Line each literal key was set on
+
+	// A repeated key silently overwrites the first, so it's an error
+	checkKey := func(key string, name string, token Token) error {
+		if firstLine, exists := keys[key]; exists {
+			return c.errorf(token, "duplicate key %s in table (first set on line %d)", name, firstLine)
+		}
+		keys[key] = token.Line
+		return nil
+	}
+
+	for c.peek().Type != TOKEN_RBRACE && !c.isAtEnd() {
+		if !first {
+			c.output.WriteString(", ")
+		}
+		first = false
+
+		closeEntry := c.node("Entry")
+
+		// Check for [expr] = value syntax
+		if c.peek().Type == TOKEN_LBRACKET {
+			c.advance()
+			if c.peekNext().Type == TOKEN_RBRACKET {
+				if key, ok := literalKey(c.peek()); ok {
+					if err := checkKey(key, c.peek().Value, c.peek()); err != nil {
+						return err
+					}
+				}
+			}
+
+			// Check if it's a numeric index that needs offsetting
+			startToken := c.peek()
+			savedOut := c.output.String()
+			c.output.Reset()
+
+			if err := c.expression(); err != nil {
+				return err
+			}
+
+			indexStr := c.output.String()
+			c.output.Reset()
+			c.output.WriteString(savedOut)
+			c.output.WriteString("[")
+
+			isStringLiteral := startToken.Type == TOKEN_STRING
+
+			if isStringLiteral {
+				c.output.WriteString(spaceLongString(indexStr))
+			} else {
+				c.output.WriteString("(")
+				c.output.WriteString(indexStr)
+				c.output.WriteString(") + 1")
+			}
+
+			c.output.WriteString("]")
+
+			if c.peek().Type != TOKEN_RBRACKET {
+				return c.errorf(c.peek(), "expected ']' in table constructor")
+			}
+			c.advance()
+
+			if c.peek().Type != TOKEN_ASSIGN {
+				return c.errorf(c.peek(), "expected '=' after table key")
+			}
+			c.advance()
+			c.output.WriteString(" = ")
+
+			if err := c.expression(); err != nil {
+				return err
+			}
+		} else if c.peek().Type == TOKEN_IDENT && c.peekNext().Type == TOKEN_ASSIGN {
+			// name = value syntax
+			if err := checkKey("s:"+c.peek().Value, "'"+c.peek().Value+"'", c.peek()); err != nil {
+				return err
+			}
+			c.leaf("Key", c.peek())
+			c.output.WriteString(c.advance().Value)
+			c.advance() // consume '='
+			c.output.WriteString(" = ")
+			if err := c.expression(); err != nil {
+				return err
+			}
+		} else {
+			// Array element - these are 0-indexed in tokimun
+			// So we need to store them with explicit indices
+			// t[0] in tokimun = t[1] in Lua
+			if err := checkKey(fmt.Sprintf("n:%d", index), fmt.Sprintf("[%d]", index), c.peek()); err != nil {
+				return err
+			}
+			c.output.WriteString(fmt.Sprintf("[%d] = ", index+1))
+			if err := c.expression(); err != nil {
+				return err
+			}
+			index++
+		}
+		closeEntry()
+
+		// Optional comma or semicolon
+		if c.peek().Type == TOKEN_COMMA || c.peek().Type == TOKEN_SEMICOLON {
+			c.advance()
+		}
+	}
+
+	if c.peek().Type != TOKEN_RBRACE {
+		return c.errorf(c.peek(), "expected '}' to close table")
+	}
+	c.advance()
+	c.output.WriteString("}")
+
+	return nil
+}
+
+// literalKey returns a key that's equal for table keys Lua treats as the
+// same, like "a" and 'a' or 1 and 0x1, and false if the token can't be
+// compared without evaluating it
+func literalKey(token Token) (string, bool) {
+	switch token.Type {
+	case TOKEN_STRING:
+		value := token.Value
+		if len(value) < 2 || (value[0] != '"' && value[0] != '\'') || strings.Contains(value, "\\") {
+			return "", false
+		}
+		return "s:" + value[1:len(value)-1], true
+	case TOKEN_NUMBER:
+		converted, _, err := convertNumber(token.Value, "")
+		if err != nil {
+			return "", false
+		}
+		if n, err := strconv.ParseInt(converted, 0, 64); err == nil {
+			return fmt.Sprintf("n:%d", n), true
+		}
+		if f, err := strconv.ParseFloat(converted, 64); err == nil {
+			return "n:" + strconv.FormatFloat(f, 'g', -1, 64), true
+		}
+	case TOKEN_TRUE, TOKEN_FALSE:
+		return "b:" + token.Value, true
+	}
+	return "", false
+}
+
+func (c *Compiler) expressionList() error {
+	if err := c.expression(); err != nil {
+		return err
+	}
+
+	for c.peek().Type == TOKEN_COMMA {
+		c.advance()
+		c.output.WriteString(", ")
+		if err := c.expression(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Compiler) compileTemplateString(template string) error {
+	// Remove backticks
+	template = template[1 : len(template)-1]
+
+	// Parse and compile template string with ${...} interpolations
+	var result strings.Builder
+	result.WriteString("(")
+
+	parts := []string{}
+	current := ""
+	i := 0
+
+	for i < len(template) {
+		if i+1 < len(template) && template[i] == '$' && template[i+1] == '{' {
+			// Found interpolation
+			if current != "" {
+				parts = append(parts, fmt.Sprintf("%q", current))
+				current = ""
+			}
+
+			// Find matching }
+			i += 2 // skip ${
+			braceDepth := 1
+			exprStart := i
+
+			for i < len(template) && braceDepth > 0 {
+				if template[i] == '{' {
+					braceDepth++
+				} else if template[i] == '}' {
+					braceDepth--
+				}
+				if braceDepth > 0 {
+					i++
+				}
+			}
+
+			expr, spec, ok := splitFormatSpec(template[exprStart:i])
+			if !ok && spec == "" {
+				return c.errorf(c.previous(), "in template string: empty format spec in '${%s}'", template[exprStart:i])
+			}
+			if !ok {
+				return c.errorf(c.previous(), "in template string: invalid format spec '%s' in '${%s}'", spec, template[exprStart:i])
+			}
+			i++ // skip closing }
+
+			// Compile the expression using a fresh compiler
+			lexer := NewLexer(expr)
+			tokens, err := lexer.Tokenize()
+			if err != nil {
+				return c.errorf(c.previous(), "in template string: %s", errorMessage(err))
+			}
+
+			// Line numbers inside the template don't map to the source
+			options := c.options
+			options.Header = ""
+			options.PreserveLines = false
+			if warn := c.options.Warn; warn != nil {
+				templateLine := c.previous().Line
+				options.Warn = func(w Warning) {
+					w.Line = templateLine
+					warn(w)
+				}
+			}
+			compiler := NewCompiler(tokens, options)
+			compiler.scopes = c.scopes // Share scope
+
+			if err := compiler.expression(); err != nil {
+				return c.errorf(c.previous(), "in template string: %s", errorMessage(err))
+			}
+			if !compiler.isAtEnd() {
+				return c.errorf(c.previous(), "in template string: unexpected '%s' in '${%s}'", compiler.peek().Value, expr)
+			}
+			c.synthetic = c.synthetic || compiler.synthetic
+
+			if spec != "" {
+				parts = append(parts, fmt.Sprintf("string.format(%q, %s)", "%"+spec, compiler.output.String()))
+			} else {
+				parts = append(parts, fmt.Sprintf("tostring(%s)", compiler.output.String()))
+			}
+		} else if template[i] == '\\' && i+1 < len(template) {
+			// Handle escape sequences
+			i++
+			switch template[i] {
+			case 'n':
+				current += "\n"
+			case 't':
+				current += "\t"
+			case 'r':
+				current += "\r"
+			case '\\':
+				current += "\\"
+			case '$':
+				current += "$"
+			case '`':
+				current += "`"
+			case 'u':
+				end := i + strings.IndexByte(template[i:], '}')
+				value, _ := strconv.ParseUint(template[i+2:end], 16, 32)
+				current += string(rune(value))
+				i = end
+			default:
+				current += string(template[i])
+			}
+			i++
+		} else {
+			current += string(template[i])
+			i++
+		}
+	}
+
+	if current != "" {
+		parts = append(parts, fmt.Sprintf("%q", current))
+	}
+
+	if len(parts) == 0 {
+		result.WriteString(`""`)
+	} else {
+		result.WriteString(strings.Join(parts, " .. "))
+	}
+
+	result.WriteString(")")
+	c.output.WriteString(result.String())
+
+	return nil
+}
+
+var formatSpecPattern = regexp.MustCompile(`^[-+ #0]*[0-9]*(\.[0-9]+)?[diouxXeEfgGcsqaA]$`)
+
+// splitFormatSpec separates an optional trailing format spec from a
+// template interpolation: "pi:.2f" yields ("pi", ".2f"). Only a colon
+// outside of brackets and string literals counts, and one followed by a
+// name that isn't a spec is a method call like obj:name(), left alone.
+// Anything else after the colon is returned with ok false.
+func splitFormatSpec(expr string) (string, string, bool) {
+	depth := 0
+	colon := -1
+	for i := 0; i < len(expr); i++ {
+		switch ch := expr[i]; ch {
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case '"', '\'':
+			// Skip over string literal
+			for i++; i < len(expr) && expr[i] != ch; i++ {
+				if expr[i] == '\\' {
+					i++
+				}
+			}
+		case ':':
+			if depth == 0 {
+				colon = i
+			}
+		}
+	}
+
+	if colon == -1 {
+		return expr, "", true
+	}
+	spec := strings.TrimSpace(expr[colon+1:])
+	switch {
+	case formatSpecPattern.MatchString(spec):
+		return expr[:colon], spec, true
+	case spec != "" && isAlpha(spec[0]):
+		return expr, "", true
+	}
+	return expr, spec, false
+}
+
+// Helper methods
+func (c *Compiler) errorf(token Token, format string, args ...interface{}) error {
+	return &CompileError{Line: token.Line, Column: token.Column, Message: fmt.Sprintf(format, args...)}
+}
+
+// errorMessage is the message of err without its position
+func errorMessage(err error) string {
+	if compileErr, ok := err.(*CompileError); ok {
+		return compileErr.Message
+	}
+	return err.Error()
+}
+
+func (c *Compiler) warn(token Token, code string, message string) {
+	if c.options.Warn == nil || c.isSuppressed(token.Line, code) {
+		return
+	}
+	c.options.Warn(Warning{Line: token.Line, Column: token.Column, Code: code, Message: message})
+}
+
+// lint reports a warning that only applies in lint mode
+// inMethod reports whether the code being compiled is inside a method
+func (c *Compiler) inMethod() bool {
+	for _, frame := range c.functions {
+		if frame.method {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Compiler) lint(token Token, code string, message string) {
+	if c.options.Lint {
+		c.warn(token, code, message)
+	}
+}
+
+// isSuppressed checks whether a disable directive covers code on line
+func (c *Compiler) isSuppressed(line int, code string) bool {
+	for _, d := range c.directives {
+		switch {
+		case d.name == "disable" && d.trailing && d.token.Line != line:
+			continue
+		case d.name == "disable-next-line" && d.token.Line+1 != line:
+			continue
+		case d.name != "disable" && d.name != "disable-next-line":
+			continue
+		}
+
+		if len(d.codes) == 0 {
+			return true
+		}
+		for _, disabled := range d.codes {
+			if disabled == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Compiler) peek() Token {
+	if c.current >= len(c.tokens) {
+		return Token{Type: TOKEN_EOF}
+	}
+	return c.tokens[c.current]
+}
+
+func (c *Compiler) peekNext() Token {
+	if c.current+1 >= len(c.tokens) {
+		return Token{Type: TOKEN_EOF}
+	}
+	return c.tokens[c.current+1]
+}
+
+func (c *Compiler) peekAt(offset int) Token {
+	if c.current+offset >= len(c.tokens) {
+		return Token{Type: TOKEN_EOF}
+	}
+	return c.tokens[c.current+offset]
+}
+
+func (c *Compiler) previous() Token {
+	if c.current == 0 {
+		return Token{Type: TOKEN_EOF}
+	}
+	return c.tokens[c.current-1]
+}
+
+func (c *Compiler) advance() Token {
+	if !c.isAtEnd() {
+		c.current++
+	}
+	return c.tokens[c.current-1]
+}
+
+func (c *Compiler) isAtEnd() bool {
+	return c.peek().Type == TOKEN_EOF
+}
+
+func (c *Compiler) writeIndent() {
+	for i := 0; i < c.indent; i++ {
+		c.output.WriteString(c.indentUnit())
+	}
+}
+
+func (c *Compiler) indentUnit() string {
+	if c.options.Indent == "" {
+		return "  "
+	}
+	return c.options.Indent
+}
+
+func (c *Compiler) pushScope() {
+	c.scopes = append(c.scopes, make(map[string]*variable))
+	c.labelScopes = append(c.labelScopes, newLabelScope())
+}
+
+func (c *Compiler) popScope() {
+	if len(c.scopes) > 1 {
+		c.checkUnused(c.scopes[len(c.scopes)-1])
+		for name, v := range c.scopes[len(c.scopes)-1] {
+			if v.table != nil && !c.enumUsedAsValue(name, v.table.from, c.current) {
+				v.table.line = ""
+			}
+		}
+		c.scopes = c.scopes[:len(c.scopes)-1]
+	}
+	if len(c.labelScopes) > 1 {
+		// Gotos still looking for their label continue in the outer block,
+		// as if they were where this block is
+		inner := c.labelScopes[len(c.labelScopes)-1]
+		c.labelScopes = c.labelScopes[:len(c.labelScopes)-1]
+		outer := c.labelScopes[len(c.labelScopes)-1]
+		for _, g := range inner.pending {
+			outer.pending = append(outer.pending, pendingGoto{token: g.token, locals: len(outer.locals)})
+		}
+	}
+}
+
+// checkGotos returns an error for any goto in the current function whose
+// label was never found, for use at the end of the function
+func (c *Compiler) checkGotos() error {
+	if pending := c.labelScopes[len(c.labelScopes)-1].pending; len(pending) > 0 {
+		return c.errorf(pending[0].token, "no visible label '%s' for goto", pending[0].token.Value)
+	}
+	return nil
+}
+
+// findLabel returns the label name visible from the current block
+func (c *Compiler) findLabel(name string) (Token, bool) {
+	for i := len(c.labelScopes) - 1; i >= 0; i-- {
+		if label, ok := c.labelScopes[i].labels[name]; ok {
+			return label, true
+		}
+		if c.labelScopes[i].function {
+			break
+		}
+	}
+	return Token{}, false
+}
+
+func (c *Compiler) declareVariable(token Token) {
+	if luaBuiltins[token.Value] {
+		c.lint(token, lintShadowBuiltin, fmt.Sprintf("local '%s' shadows the Lua builtin", token.Value))
+	}
+	if len(c.scopes) > 0 {
+		c.scopes[len(c.scopes)-1][token.Value] = &variable{token: token}
+	}
+	block := c.labelScopes[len(c.labelScopes)-1]
+	block.locals = append(block.locals, token)
+}
+
+func (c *Compiler) declareParameter(token Token) {
+	c.declareVariable(token)
+	c.scopes[len(c.scopes)-1][token.Value].param = true
+}
+
+// lookupVariable finds the innermost declaration of name, or nil
+func (c *Compiler) lookupVariable(name string) *variable {
+	for i := len(c.scopes) - 1; i >= 0; i-- {
+		if v := c.scopes[i][name]; v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+func (c *Compiler) isVariableDeclared(name string) bool {
+	return c.lookupVariable(name) != nil
+}
+
+// checkUnused reports the locals in a scope that were never read.
+// Parameters and names starting with '_' are exempt.
+func (c *Compiler) checkUnused(scope map[string]*variable) {
+	if !c.options.Lint {
+		return
+	}
+	unused := []*variable{}
+	for name, v := range scope {
+		if !v.used && !v.param && !strings.HasPrefix(name, "_") {
+			unused = append(unused, v)
+		}
+	}
+	// Report in source order
+	sort.Slice(unused, func(i, j int) bool {
+		a, b := unused[i].token, unused[j].token
+		return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+	})
+	for _, v := range unused {
+		c.lint(v.token, lintUnused, fmt.Sprintf("local '%s' is never used", v.token.Value))
+	}
+}
+
+// implicitLocals reports whether assigning to an undeclared name declares
+// a local, as opposed to Lua's global-by-default
+func (c *Compiler) implicitLocals() bool {
+	return c.options.Globals != "lua"
+}
+
+func (c *Compiler) isNewVariable(name string) bool {
+	// Check if name is a simple identifier (not a table access)
+	matched, _ := regexp.MatchString(`^[a-zA-Z_][a-zA-Z0-9_]*$`, name)
+	if !matched {
+		return false
+	}
+	return !c.isVariableDeclared(name)
+}
+
+func (c *Compiler) isStatementEnd() bool {
+	switch c.peek().Type {
+	case TOKEN_EOF, TOKEN_END, TOKEN_ELSE, TOKEN_ELSEIF, TOKEN_UNTIL, TOKEN_CASE, TOKEN_DEFAULT, TOKEN_RBRACE:
+		return true
+	}
+	// Check if next token could start a new statement
+	switch c.peek().Type {
+	case TOKEN_IF, TOKEN_WHILE, TOKEN_FOR, TOKEN_REPEAT, TOKEN_DO, TOKEN_FUNCTION,
+		TOKEN_LOCAL, TOKEN_GLOBAL, TOKEN_RETURN, TOKEN_BREAK, TOKEN_CONTINUE, TOKEN_GOTO,
+		TOKEN_GUARD, TOKEN_DEFER, TOKEN_UNLESS:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,1754 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+// compile compiles source with options, failing the test on an error
+func compile(t *testing.T, source string, options Options) string {
+	t.Helper()
+	output, err := Compile(source, options)
+	if err != nil {
+		t.Fatalf("Compile(%q): %v", source, err)
+	}
+	return output
+}
+
+// compileError compiles source with options, failing the test unless
+// it's an error, and returns the error's message
+func compileError(t *testing.T, source string, options Options) string {
+	t.Helper()
+	output, err := Compile(source, options)
+	if err == nil {
+		t.Fatalf("Compile(%q) = %q, want an error", source, output)
+	}
+	return err.Error()
+}
+
+func TestPreserveLinesHeader(t *testing.T) {
+	// The header and target comments share the first line, so code
+	// stays on its source line
+	options := Options{PreserveLines: true, Header: "-- Generated by tokimun\n\n", EmitTarget: true, Target: "5.1"}
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{
+			"x = 1\n\nprint(x)\n",
+			"--[[ Generated by tokimun ]] --[[ tokimun-target: 5.1 ]] local x = 1\n\nprint(x)\n",
+		},
+		{
+			"\n\nprint(1)\n",
+			"--[[ Generated by tokimun ]] --[[ tokimun-target: 5.1 ]]\n\nprint(1)\n",
+		},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, options); got != test.want {
+			t.Errorf("Compile(%q) =\n%s\nwant\n%s", test.source, got, test.want)
+		}
+	}
+}
+
+func TestInlineCommentsLevel(t *testing.T) {
+	got := inlineComments("-- a ]] b\nlocal x = 1\n")
+	want := "--[=[ a ]] b ]=] local x = 1 "
+	if got != want {
+		t.Errorf("inlineComments = %q, want %q", got, want)
+	}
+}
+
+func TestVarargsForwarded(t *testing.T) {
+	// Lua closures can't capture `...`, so the functions expressions
+	// compile to are passed it
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"null coalesce", "function f(...) return a ?? ... end\n", "(function(...) local __nc_1__ = a; if __nc_1__ ~= nil then return __nc_1__ else return ... end end)(...)"},
+		{"null coalesce without varargs", "function f(...) return a ?? 1 end\n", "(function() local __nc_1__ = a;"},
+		{"nested function", "function f(...)\n  local g = function(...) return ... end\n  return a ?? 1\nend\n", "(function() local __nc_1__ = a;"},
+		{"do expression", "function f(...)\n  local v = do {\n    local n = select(\"#\", ...)\n    n\n  }\n  return v\nend\n", "  end)(...)\n"},
+		{"when", "function f(...) return when { x > 1 => ..., else => 0 } end\n", "(function(...) if x > 1 then return ... else return 0 end end)(...)"},
+		{"match", "function f(...) return match x { 1 => ..., _ => 0 } end\n", "(function(__match_1__, ...) if __match_1__ == 1 then return ... else return 0 end end)(x, ...)"},
+		{"chained comparison", "function f(...) return 1 < g(x) < ... end\n", "(function(__cmp_1__, ...) return 1 < __cmp_1__ and __cmp_1__ < ... end)(g(x), ...)"},
+		{"membership", "function f(...) return x in {..., 1} end\n", "end return false end)(x, ...)"},
+		{"optional field", "function f(...) return (...)?.b end\n", "(function(...) local __oc_1__ = (...); if __oc_1__ == nil then return nil end; return __oc_1__.b end)(...)"},
+		{"optional index", "function f(...) return a?[...] end\n", "return __oc_1__[(...) + 1] end)(...)"},
+		{"comprehension", "function f(...) return [x * 2 for x in {...}] end\n", "return __list_1__ end)(...)"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant it to contain\n%s", test.name, test.source, got, test.want)
+		}
+	}
+}
+
+func TestDeferredVarargs(t *testing.T) {
+	// A deferred call using `...` runs outside the function passing the
+	// return values through, which would take its `...`
+	source := "function f(...)\n  defer print(...)\n  return 1 if x\n  return g()\nend\n"
+	want := `local function f(...)
+  local __defer_1__ = function(...) print(...) end
+  if x then
+    local __ret_2__ = (function(...) return {n = select("#", ...), ...} end)(1)
+    __defer_1__(...)
+    return table.unpack(__ret_2__, 1, __ret_2__.n)
+  end
+  local __ret_3__ = (function(...) return {n = select("#", ...), ...} end)(g())
+  __defer_1__(...)
+  return table.unpack(__ret_3__, 1, __ret_3__.n)
+end
+`
+	if got := compile(t, source, Options{Target: "5.4"}); got != want {
+		t.Errorf("Compile(%q) =\n%s\nwant\n%s", source, got, want)
+	}
+	if got := compile(t, source, Options{Target: "5.1"}); !strings.Contains(got, "return unpack(__ret_2__, 1, __ret_2__.n)") {
+		t.Errorf("Compile(%q) for 5.1 doesn't use unpack:\n%s", source, got)
+	}
+
+	// Without `...` the values pass through a function as before
+	source = "function f(...)\n  defer print(1)\n  return ...\nend\n"
+	if got := compile(t, source, Options{}); !strings.Contains(got, "return (function(...) __defer_1__(); return ... end)(...)") {
+		t.Errorf("Compile(%q) =\n%s", source, got)
+	}
+}
+
+func TestDefer(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"last in first out",
+			"function f()\n  defer print(1)\n  defer print(2)\n  work()\nend\n",
+			`local function f()
+  local __defer_1__ = function() print(1) end
+  local __defer_2__ = function() print(2) end
+  work()
+  __defer_2__()
+  __defer_1__()
+end
+`,
+		},
+		{
+			// The deferred call's a is the one in scope at the defer
+			"early return from nested blocks",
+			"function f()\n  local a = 1\n  defer print(a)\n  while x do\n    if y then\n      local a = 2\n      return a\n    end\n  end\n  return\nend\n",
+			`local function f()
+  local a = 1
+  local __defer_1__ = function() print(a) end
+  while x do
+    if y then
+      local a = 2
+      return (function(...) __defer_1__(); return ... end)(a)
+    end
+  end
+  __defer_1__()
+  return
+end
+`,
+		},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	errors := []struct {
+		source string
+		want   string
+	}{
+		{"defer print(1)\n", "'defer' outside of function"},
+		{"function f()\n  if x then\n    defer print(1)\n  end\nend\n", "'defer' must be at the top level of a function body"},
+	}
+	for _, test := range errors {
+		if got := compileError(t, test.source, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("Compile(%q) error = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestDoWhileContinueLocals(t *testing.T) {
+	// Like repeat, the condition sees the body's locals, which continue
+	// can't jump past, so they're declared before the body
+	source := "do {\n  local done = f()\n  continue if done\n  print(1)\n} while not done\n"
+	want := `repeat local done
+  done = f()
+  if done then
+    goto __continue_1__
+  end
+  print(1)
+  ::__continue_1__::
+until not (not done)
+`
+	if got := compile(t, source, Options{Target: "5.4"}); got != want {
+		t.Errorf("Compile(%q) =\n%s\nwant\n%s", source, got, want)
+	}
+}
+
+func TestMatchStart(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		// A subject on the next line is another statement
+		{"local m = match\nprint(m)\n", "local m = match\nprint(m)\n"},
+		{"x = match \"a\" { \"a\" => 1, _ => 2 }\n", "local x = (function(__match_1__) if __match_1__ == \"a\" then return 1 else return 2 end end)(\"a\")\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("Compile(%q) =\n%s\nwant\n%s", test.source, got, test.want)
+		}
+	}
+}
+
+func TestFloorDivisionAssignOnce(t *testing.T) {
+	// t[k] //= 2 names its target twice, so calls in it are evaluated
+	// into locals first, whether // is native or math.floor
+	tests := []struct {
+		source string
+		want51 string
+		want54 string
+	}{
+		{
+			"t[k] //= 2\n",
+			"t[(k) + 1] = math.floor(t[(k) + 1] / 2)\n",
+			"t[(k) + 1] = t[(k) + 1] // 2\n",
+		},
+		{
+			"t[f()] //= 2\n",
+			"do local __key_1__ = (f()) + 1; t[__key_1__] = math.floor(t[__key_1__] / 2) end\n",
+			"do local __key_1__ = (f()) + 1; t[__key_1__] = t[__key_1__] // 2 end\n",
+		},
+		{
+			"g().x //= 3\n",
+			"do local __obj_1__ = g(); __obj_1__.x = math.floor(__obj_1__.x / 3) end\n",
+			"do local __obj_1__ = g(); __obj_1__.x = __obj_1__.x // 3 end\n",
+		},
+		{
+			"g()[h(\"]\")] //= 2\n",
+			"do local __obj_1__, __key_2__ = g(), (h(\"]\")) + 1; __obj_1__[__key_2__] = math.floor(__obj_1__[__key_2__] / 2) end\n",
+			"do local __obj_1__, __key_2__ = g(), (h(\"]\")) + 1; __obj_1__[__key_2__] = __obj_1__[__key_2__] // 2 end\n",
+		},
+		{
+			"t[\"a\"] //= 2\n",
+			"t[\"a\"] = math.floor(t[\"a\"] / 2)\n",
+			"t[\"a\"] = t[\"a\"] // 2\n",
+		},
+		{
+			"g().n += 1\n",
+			"do local __obj_1__ = g(); __obj_1__.n = __obj_1__.n + 1 end\n",
+			"do local __obj_1__ = g(); __obj_1__.n = __obj_1__.n + 1 end\n",
+		},
+		{
+			"g().n++\n",
+			"do local __obj_1__ = g(); __obj_1__.n = __obj_1__.n + 1 end\n",
+			"do local __obj_1__ = g(); __obj_1__.n = __obj_1__.n + 1 end\n",
+		},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{Target: "5.1"}); got != test.want51 {
+			t.Errorf("5.1: Compile(%q) =\n%s\nwant\n%s", test.source, got, test.want51)
+		}
+		if got := compile(t, test.source, Options{Target: "5.4"}); got != test.want54 {
+			t.Errorf("5.4: Compile(%q) =\n%s\nwant\n%s", test.source, got, test.want54)
+		}
+	}
+}
+
+func TestLabeledContinue(t *testing.T) {
+	source := "outer: for i = 1, 3 do\n  for j = 1, 3 do\n    continue outer if j == i\n    print(i, j)\n  end\nend\n"
+	want := `for i = 1, 3 do
+  for j = 1, 3 do
+    if j == i then
+      goto __continue_2__
+    end
+    print(i, j)
+  end
+  ::__continue_2__::
+end
+`
+	if got := compile(t, source, Options{Target: "5.4"}); got != want {
+		t.Errorf("Compile(%q) =\n%s\nwant\n%s", source, got, want)
+	}
+
+	source = "for i = 1, 3 do\n  continue outer\nend\n"
+	if _, err := Compile(source, Options{Target: "5.4"}); err == nil || !strings.Contains(err.Error(), "no enclosing loop labeled 'outer'") {
+		t.Errorf("Compile(%q) error = %v", source, err)
+	}
+}
+
+func TestLabeledBreak(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"from the inner loop",
+			"outer: for i = 1, 3 do\n  for j = 1, 3 do\n    break outer if i * j == 4\n    print(i, j)\n  end\nend\nprint(\"done\")\n",
+			"for i = 1, 3 do\n  for j = 1, 3 do\n    if i * j == 4 then\n      goto __break_1__\n    end\n    print(i, j)\n  end\nend\n::__break_1__::\nprint(\"done\")\n",
+		},
+		{
+			"from a while loop in a function",
+			"function f()\n  outer: while true do\n    for j = 1, 3 do\n      break outer\n    end\n  end\nend\n",
+			"local function f()\n  while true do\n    for j = 1, 3 do\n      goto __break_1__\n    end\n  end\n  ::__break_1__::\nend\n",
+		},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{Target: "5.4"}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	errors := []struct {
+		source string
+		target string
+		want   string
+	}{
+		{"for i = 1, 3 do\n  break outer\nend\n", "5.4", "2:9: no enclosing loop labeled 'outer'"},
+		{"outer: for i = 1, 3 do\nend\nfor j = 1, 3 do\n  break outer\nend\n", "5.4", "4:9: no enclosing loop labeled 'outer'"},
+		{"outer: for i = 1, 3 do\n  for j = 1, 3 do\n    break outer\n  end\nend\n", "5.1", "'break outer' needs goto, which Lua 5.1 doesn't have"},
+	}
+	for _, test := range errors {
+		if got := compileError(t, test.source, Options{Target: test.target}); !strings.Contains(got, test.want) {
+			t.Errorf("Compile(%q) error = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestMaxLineLength(t *testing.T) {
+	// Lines break after operators and commas, never inside strings
+	options := Options{MaxLineLength: 40}
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{
+			"message = \"alpha \" .. first .. \" beta \" .. second .. \" gamma \" .. third .. \" delta\"\n",
+			"local message = \"alpha \" .. first ..\n  \" beta \" .. second .. \" gamma \" ..\n  third .. \" delta\"\n",
+		},
+		{
+			"print(message, \"a long string argument\", another_argument, yet_another)\n",
+			"print(message,\n  \"a long string argument\",\n  another_argument, yet_another)\n",
+		},
+		{"s = \"a, b, c, d, e, f .. g .. h .. i .. j\" .. x\n", "local s = \"a, b, c, d, e, f .. g .. h .. i .. j\" ..\n  x\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, options); got != test.want {
+			t.Errorf("Compile(%q) =\n%s\nwant\n%s", test.source, got, test.want)
+		}
+	}
+}
+
+func TestNegativeIndexErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"print(\"abc\"[-1])\n", "negative indices aren't allowed on a string literal"},
+		{"print((\"abc\")[-1])\n", "negative indices aren't allowed on a string literal"},
+		{"f(\"abc\")[-1] = 1\n", "can't assign to a negative index of 'f(\"abc\")'"},
+	}
+	for _, test := range tests {
+		if _, err := Compile(test.source, Options{}); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Compile(%q) error = %v, want %q", test.source, err, test.want)
+		}
+	}
+}
+
+func TestNegativeIndex(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"last", "print(t[-1])\n", "print(t[#t])\n"},
+		{"from the end", "print(t.items[-2])\n", "print(t.items[#t.items - 1])\n"},
+		{"indexed by a name", "print(t[i][-1])\n", "print(t[(i) + 1][#t[(i) + 1]])\n"},
+		{"variables untouched", "print(t[-i], t[n - 1])\n", "print(t[(-i) + 1], t[(n - 1) + 1])\n"},
+		{"assigned to", "t[-1] = 0\n", "t[#t] = 0\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	// Objects with side effects are evaluated once, in a function
+	calls := []struct {
+		source string
+		call   string
+	}{
+		{"print(f()[-1])\n", "f()"},
+		{"print(a[f()][-1])\n", "f()"},
+		{"print(a[i:next()][-1])\n", "next()"},
+		{"print(t?.x[-1])\n", "__oc_1__.x"},
+	}
+	for _, test := range calls {
+		got := compile(t, test.source, Options{})
+		if n := strings.Count(got, test.call); n != 1 {
+			t.Errorf("Compile(%q) evaluates %s %d times:\n%s", test.source, test.call, n, got)
+		}
+		if !strings.Contains(got, "(function(__obj_") {
+			t.Errorf("Compile(%q) doesn't hoist the object:\n%s", test.source, got)
+		}
+	}
+
+	if got := compile(t, "print(t[-1])\n", Options{NoNegativeIndex: true}); got != "print(t[(-1) + 1])\n" {
+		t.Errorf("Compile with NoNegativeIndex = %q", got)
+	}
+}
+
+func TestConstEnum(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"members inlined",
+			"const enum Flags { A = 1, B = -2 }\nprint(Flags.A, x - Flags.B)\n",
+			"print(1, x - (-2))\n",
+		},
+		{
+			"used as a value",
+			"const enum Flags { A = 1 }\nprint(Flags.A, Flags)\n",
+			"local Flags = {A = 1}\nprint(1, Flags)\n",
+		},
+		{
+			"in a function",
+			"function f()\n  const enum Flags { A = 1 }\n  return Flags\nend\n",
+			"local function f()\n  local Flags = {A = 1}\n  return Flags\nend\n",
+		},
+		{
+			// Flags after the block is a global, not the enum
+			"out of its block",
+			"function f()\n  if x then\n    const enum Flags { A = 1 }\n    print(Flags.A)\n  end\n  print(Flags)\nend\n",
+			"local function f()\n  if x then\n    print(1)\n  end\n  print(Flags)\nend\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compile(t, tt.source, Options{}); got != tt.want {
+				t.Errorf("Compile(%q) =\n%s\nwant\n%s", tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnaryOperators(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"print(#t)", "print(#t)\n"},
+		{`print(#"string")`, "print(#\"string\")\n"},
+		{"print(#t + 1)", "print(#t + 1)\n"},
+		{"print(#t.items, #f())", "print(#t.items, #f())\n"},
+		{"print(-#t, not #t)", "print(-#t, not #t)\n"},
+		{"print(- -x)", "print(- -x)\n"},
+	}
+	for _, tt := range tests {
+		if got := compile(t, tt.source, Options{}); got != tt.want {
+			t.Errorf("Compile(%q) = %q, want %q", tt.source, got, tt.want)
+		}
+	}
+
+	// # binds tighter than arithmetic: #t + 1 is (#t) + 1
+	tree, err := Parse("x = #t + 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := tree.Children[0].Children[1]
+	if sum.Type != "Binary" || sum.Value != "+" || sum.Children[0].Type != "Unary" || sum.Children[0].Value != "#" {
+		t.Errorf("#t + 1 doesn't parse as (#t) + 1")
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"increment", "i = 0\ni++\n", "local i = 0\ni = i + 1\n"},
+		{"decrement", "i = 0\ni--\nprint(i)\n", "local i = 0\ni = i - 1\nprint(i)\n"},
+		{"field and index", "t.n--\nt[k]++\n", "t.n = t.n - 1\nt[(k) + 1] = t[(k) + 1] + 1\n"},
+		{"comment", "-- comment\ni = 1\n", "local i = 1\n"},
+		{"comment after a value", "x = 1--\nprint(x)--\n", "local x = 1\nprint(x)\n"},
+		{"comment after a name", "x = y--\n", "local x = y\n"},
+		{"comment after a call", "f()--\n", "f()\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	errors := []struct {
+		source string
+		want   string
+	}{
+		{"f()++\n", "can only assign to a name, field or index, not 'f()'"},
+		{"i-- comment\n", "'i--' is only a decrement with nothing after it on the line"},
+		{"i--[[ comment ]]\n", "'i--' is only a decrement with nothing after it on the line"},
+	}
+	for _, test := range errors {
+		if got := compileError(t, test.source, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("Compile(%q) error = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestDoExpression(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"implicit value",
+			"x = do {\n  local a = f()\n  a * 2\n}\n",
+			"local x = (function()\n  local a = f()\n  return a * 2\nend)()\n",
+		},
+		{
+			"explicit return",
+			"x = do {\n  local a = f()\n  return a\n}\n",
+			"local x = (function()\n  local a = f()\n  return a\nend)()\n",
+		},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	errors := []struct {
+		source string
+		want   string
+	}{
+		{"x = do { if a then 1 else 2 end }\n", "do expression must end in an expression"},
+		{"x = do { local a = 1 }\n", "do expression must end in an expression"},
+		{"x = do { return 1\n  f() }\n", "unreachable code after the value of a do expression"},
+		{"while true do\n  x = do { break }\nend\n", "'break' cannot leave a do expression"},
+		{"while true do\n  x = do { continue }\nend\n", "'continue' cannot leave a do expression"},
+	}
+	for _, test := range errors {
+		if got := compileError(t, test.source, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("Compile(%q) error = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestTemplateFormatSpec(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"float precision", "print(`${pi:.2f}`)\n", `print((string.format("%.2f", pi)))` + "\n"},
+		{"hex", "print(`${n:x}`)\n", `print((string.format("%x", n)))` + "\n"},
+		{"integer", "print(`${n:d}`)\n", `print((string.format("%d", n)))` + "\n"},
+		{"padded", "print(`${v:08.3f}`)\n", `print((string.format("%08.3f", v)))` + "\n"},
+		{"mixed", "print(`${a}: ${b:x}!`)\n", `print((tostring(a) .. ": " .. string.format("%x", b) .. "!"))` + "\n"},
+		{"method call", "print(`${obj:name()}`)\n", `print((tostring(obj:name())))` + "\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) = %q, want %q", test.name, test.source, got, test.want)
+		}
+	}
+
+	errors := []struct {
+		source string
+		want   string
+	}{
+		{"print(`${x:%d}`)\n", "invalid format spec '%d' in '${x:%d}'"},
+		{"print(`${x::}`)\n", "empty format spec in '${x::}'"},
+		{"print(`${a b}`)\n", "unexpected 'b' in '${a b}'"},
+	}
+	for _, test := range errors {
+		if got := compileError(t, test.source, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("Compile(%q) error = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestDefaultTarget(t *testing.T) {
+	// An empty target is DefaultTarget throughout, not a mix of versions
+	source := "x = a // b\ny = \"\\u{48}\"\nz = 0b" + strings.Repeat("1", 64) + "\n"
+	got := compile(t, source, Options{})
+	if want := compile(t, source, Options{Target: DefaultTarget}); got != want {
+		t.Errorf("Compile with no target =\n%s\nwant, as with %s,\n%s", got, DefaultTarget, want)
+	}
+	if !strings.Contains(got, "a // b") {
+		t.Errorf("Compile with no target lowers //:\n%s", got)
+	}
+}
+
+func TestChainedComparison(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"two way", "print(1 <= x <= 10)", "print(1 <= x and x <= 10)\n"},
+		{"mixed", "print(a < b <= c)", "print(a < b and b <= c)\n"},
+		{
+			"middle call evaluated once",
+			"print(a < f() < c)",
+			"print((function(__cmp_1__) return a < __cmp_1__ and __cmp_1__ < c end)(f()))\n",
+		},
+		{
+			"left call evaluated first",
+			"print(g() < f() < c)",
+			"print((function(__cmp_2__, __cmp_1__) return __cmp_2__ < __cmp_1__ and __cmp_1__ < c end)(g(), f()))\n",
+		},
+		{
+			// h() is only called once a < g() held
+			"three way",
+			"print(a < g() <= h() < d)",
+			"print((function(__cmp_1__) return a < __cmp_1__ and (function(__cmp_2__) return __cmp_1__ <= __cmp_2__ and __cmp_2__ < d end)(h()) end)(g()))\n",
+		},
+		{"parenthesised equality", "print((1 < 2) == true)", "print((1 < 2) == true)\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	// Lua would read these as (1 < 2) == true, which looks like a chain
+	errors := []struct {
+		source string
+		want   string
+	}{
+		{"print(1 < 2 == true)", "1:13: '==' can't be chained with other comparisons; add parentheses"},
+		{"print(a == b < c)", "1:9: '==' can't be chained with other comparisons; add parentheses"},
+		{"print(a ~= b ~= c)", "1:9: '~=' can't be chained with other comparisons; add parentheses"},
+	}
+	for _, test := range errors {
+		if got := compileError(t, test.source, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("Compile(%q) error = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestGuard(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"return",
+			"function f(x)\n  guard x ~= nil else { return }\n  print(x)\nend\n",
+			"local function f(x)\n  if not (x ~= nil) then\n    return\n  end\n  print(x)\nend\n",
+		},
+		{
+			"return after other statements",
+			"function f(x)\n  guard x else { print(1); return false }\n  return x\nend\n",
+			"local function f(x)\n  if not (x) then\n    print(1)\n    return false\n  end\n  return x\nend\n",
+		},
+		{
+			"break",
+			"for i = 1, 3 do\n  guard i < 3 else { break }\n  print(i)\nend\n",
+			"for i = 1, 3 do\n  if not (i < 3) then\n    break\n  end\n  print(i)\nend\n",
+		},
+		{
+			"continue with a compound condition",
+			"for i = 1, 3 do\n  guard i > 1 and i < 3 else { continue }\n  print(i)\nend\n",
+			"for i = 1, 3 do\n  if not (i > 1 and i < 3) then\n    goto __continue_1__\n  end\n  print(i)\n  ::__continue_1__::\nend\n",
+		},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{Target: "5.4"}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	errors := []struct {
+		source string
+		want   string
+	}{
+		{"function f(x)\n  guard x else { print(1) }\nend\n", "2:16: guard block must end with 'return', 'break' or 'continue'"},
+		{"function f(x)\n  guard x else { }\nend\n", "guard block must end with 'return', 'break' or 'continue'"},
+		{"function f(x)\n  guard x else return\nend\n", "2:16: expected '{' after 'else' in guard"},
+	}
+	for _, test := range errors {
+		if got := compileError(t, test.source, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("Compile(%q) error = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestUnless(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"statement", "unless x {\n  print(1)\n}\n", "if not (x) then\n  print(1)\nend\n"},
+		{"compound condition", "unless a and b or c { print(1) }\n", "if not (a and b or c) then\n  print(1)\nend\n"},
+		{"comparison", "unless x == 1 { print(1) }\n", "if not (x == 1) then\n  print(1)\nend\n"},
+		{"modifier", "doThing() unless done\n", "if not (done) then\n  doThing()\nend\n"},
+		{
+			"modifier with a compound condition",
+			"function f()\n  return 1 unless a or b\nend\n",
+			"local function f()\n  if not (a or b) then\n    return 1\n  end\nend\n",
+		},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	source := "unless x then\n  print(1)\nend\n"
+	if got, want := compileError(t, source, Options{}), "1:10: expected '{' after unless condition"; !strings.Contains(got, want) {
+		t.Errorf("Compile(%q) error = %q, want %q", source, got, want)
+	}
+}
+
+func TestStatementModifiers(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"return if", "function f(x)\n  return x if done\n  return 0\nend\n", "local function f(x)\n  if done then\n    return x\n  end\n  return 0\nend\n"},
+		{"call while", "step() while running\n", "while running do\n  step()\nend\n"},
+		{"assignment if", "local x = 0\nx = 1 if y\n", "local x = 0\nif y then\n  x = 1\nend\n"},
+		{"compound assignment while", "t.n += 1 while t.n < 10\n", "while t.n < 10 do\n  t.n = t.n + 1\nend\n"},
+		{
+			// Only the one statement before the modifier is guarded
+			"single statement",
+			"print(1)\nprint(2) if x\nprint(3)\n",
+			"print(1)\nif x then\n  print(2)\nend\nprint(3)\n",
+		},
+		{
+			"statements starting a line",
+			"if x then print(1) end\nwhile y do step() end\n",
+			"if x then\n  print(1)\nend\nwhile y do\n  step()\nend\n",
+		},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	source := "x = 1 if y\n"
+	if got, want := compileError(t, source, Options{}), "cannot declare a variable in a statement with 'if'"; !strings.Contains(got, want) {
+		t.Errorf("Compile(%q) error = %q, want %q", source, got, want)
+	}
+}
+
+func TestTrailingCommas(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"call", "f(a, b,)\n", "f(a, b)\n"},
+		{"method call", "t:m(1,)\n", "t:m(1)\n"},
+		{"multiline call", "f(\n  a,\n  b,\n)\n", "f(a, b)\n"},
+		{"table", "t = {1, 2, 3,}\n", "local t = {[1] = 1, [2] = 2, [3] = 3}\n"},
+		{"multiline table", "t = {\n  a = 1,\n  b = 2,\n}\n", "local t = {a = 1, b = 2}\n"},
+		{"parameters", "function g(\n  x,\n  y,\n) end\n", "local function g(x, y)\nend\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	// A comma needs something before it
+	errors := []struct {
+		source string
+		want   string
+	}{
+		{"f(,)\n", "1:3: unexpected token ,"},
+		{"t = {,}\n", "1:6: unexpected token ,"},
+	}
+	for _, test := range errors {
+		if got := compileError(t, test.source, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("Compile(%q) error = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestMultipleAssignment(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"swap", "local a, b = 1, 2\na, b = b, a\n", "local a, b = 1, 2\na, b = b, a\n"},
+		{"discard", "local a, _, c = f()\n", "local a, _, c = f()\n"},
+		{"discard first", "_, x = h()\n", "local _, x = h()\n"},
+		{"undersupply", "local a, b, c = 1, 2\n", "local a, b, c = 1, 2\n"},
+		{"oversupply", "local a, b = 1, 2, 3\n", "local a, b = 1, 2, 3\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	// _ is a throwaway, never reported as unused
+	lints := []struct {
+		source string
+		want   string
+	}{
+		{"local a, _, c = f()\nprint(a, c)\n", ""},
+		{"local _ = f()\n", ""},
+		{"local a, _, c = f()\nprint(a)\n", "1:unused"},
+	}
+	for _, test := range lints {
+		if got := lintCodes(t, test.source); got != test.want {
+			t.Errorf("lint of %q = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestDuplicateTableKeys(t *testing.T) {
+	errors := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"name", "t = {\n  x = 1,\n  y = 2,\n  x = 3,\n}\n", "4:3: duplicate key 'x' in table (first set on line 2)"},
+		{"string and name", "t = {[\"a\"] = 1, a = 2}\n", "1:17: duplicate key 'a' in table (first set on line 1)"},
+		{"bracketed number", "t = {[1] = 1, [1] = 2}\n", "1:16: duplicate key 1 in table (first set on line 1)"},
+		{"bracketed bool", "t = {[true] = 1, [true] = 2}\n", "duplicate key true in table"},
+		{"positional and keyed", "t = {10, [0] = 2}\n", "1:11: duplicate key 0 in table (first set on line 1)"},
+	}
+	for _, test := range errors {
+		if got := compileError(t, test.source, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("%s: Compile(%q) error = %q, want %q", test.name, test.source, got, test.want)
+		}
+	}
+
+	// Keys that aren't literals, or are in another table, are fine
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"t = {[k] = 1, [k] = 2}\n", "local t = {[(k) + 1] = 1, [(k) + 1] = 2}\n"},
+		{"t = {a = 1, b = {a = 2}}\n", "local t = {a = 1, b = {a = 2}}\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("Compile(%q) =\n%s\nwant\n%s", test.source, got, test.want)
+		}
+	}
+}
+
+func TestIn(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"key set", "if x in set then print(1) end\n", "if set[x] ~= nil then\n  print(1)\nend\n"},
+		{"binary key", "local ok = x + 1 in set\n", "local ok = set[x + 1] ~= nil\n"},
+		{"call result", "print(x in f(a, b))\n", "print((f(a, b))[x] ~= nil)\n"},
+		{"with and", "print(a and x in s)\n", "print(a and s[x] ~= nil)\n"},
+		{
+			"value list",
+			"print(c in {\"a\", \"b\"})\n",
+			"print((function(__in_1__) for _, __v__ in ipairs({[1] = \"a\", [2] = \"b\"}) do if __v__ == __in_1__ then return true end end return false end)(c))\n",
+		},
+		{
+			"ipairs",
+			"print(v in ipairs(list))\n",
+			"print((function(__in_1__) for _, __v__ in ipairs(list) do if __v__ == __in_1__ then return true end end return false end)(v))\n",
+		},
+		// The loop's in is still the loop's
+		{"in a for loop", "for k in pairs(t) do print(k in t) end\n", "for k in pairs(t) do\n  print(t[k] ~= nil)\nend\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+}
+
+func TestNotIn(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"key set", "if x not in set then print(1) end\n", "if set[x] == nil then\n  print(1)\nend\n"},
+		{"field and call", "print(f() not in t.set)\n", "print(t.set[f()] == nil)\n"},
+		{"negated in", "print(not (x in set))\n", "print(not (set[x] ~= nil))\n"},
+		{
+			"value list",
+			"print(c not in {\"a\", \"b\"})\n",
+			"print((function(__in_1__) for _, __v__ in ipairs({[1] = \"a\", [2] = \"b\"}) do if __v__ == __in_1__ then return false end end return true end)(c))\n",
+		},
+		{
+			"ipairs",
+			"print(v not in ipairs(list))\n",
+			"print((function(__in_1__) for _, __v__ in ipairs(list) do if __v__ == __in_1__ then return false end end return true end)(v))\n",
+		},
+		{
+			"negated value list",
+			"print(not (v in ipairs(list)))\n",
+			"print(not ((function(__in_1__) for _, __v__ in ipairs(list) do if __v__ == __in_1__ then return true end end return false end)(v)))\n",
+		},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+}
+
+func TestCompileErrorPosition(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		line   int
+		column int
+	}{
+		{"lexer", "x = 1 + @\n", 1, 9},
+		{"lexer on a later line", "print(1)\n  y = \"a\" ~ b\n", 2, 11},
+		{"number", "x = 0b12\n", 1, 5},
+		{"parser", "local x = = 2\n", 1, 11},
+		{"compiler", "print(1)\nt = {a = 1, a = 2}\n", 2, 13},
+	}
+	for _, test := range tests {
+		_, err := Compile(test.source, Options{})
+		var compileErr *CompileError
+		if !errors.As(err, &compileErr) {
+			t.Errorf("%s: Compile(%q) error = %v, want a *CompileError", test.name, test.source, err)
+			continue
+		}
+		if compileErr.Line != test.line || compileErr.Column != test.column {
+			t.Errorf("%s: Compile(%q) error at %d:%d, want %d:%d", test.name, test.source, compileErr.Line, compileErr.Column, test.line, test.column)
+		}
+		if want := fmt.Sprintf("line %d:%d: %s", test.line, test.column, compileErr.Message); err.Error() != want {
+			t.Errorf("%s: error is %q, want %q", test.name, err.Error(), want)
+		}
+	}
+}
+
+func TestGlobalsMode(t *testing.T) {
+	source := "x = 1\nfunction f()\n  y = 2\n  return x + y\nend\nglobal z = 3\n"
+	tests := []struct {
+		globals string
+		want    string
+	}{
+		{"", "local x = 1\nlocal function f()\n  local y = 2\n  return x + y\nend\nz = 3\n"},
+		{"local", "local x = 1\nlocal function f()\n  local y = 2\n  return x + y\nend\nz = 3\n"},
+		{"lua", "x = 1\nfunction f()\n  y = 2\n  return x + y\nend\nz = 3\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, source, Options{Globals: test.globals}); got != test.want {
+			t.Errorf("Compile with Globals %q =\n%s\nwant\n%s", test.globals, got, test.want)
+		}
+	}
+}
+
+func TestPowerOperator(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"print(2 ** 10)", "print(2 ^ 10)\n"},
+		{"print(2 ^ 10)", "print(2 ^ 10)\n"},
+		{"print(2 ** 3 ** 2, -2 ** 2, 2 * 3 ** 2)", "print(2 ^ 3 ^ 2, -2 ^ 2, 2 * 3 ^ 2)\n"},
+		{"local x = 2\nx **= 3\nx *= 2\n", "local x = 2\nx = x ^ 3\nx = x * 2\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("Compile(%q) = %q, want %q", test.source, got, test.want)
+		}
+	}
+
+	// ** is right associative: 2 ** 3 ** 2 is 2 ** (3 ** 2)
+	tree, err := Parse("x = 2 ** 3 ** 2\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	power := tree.Children[0].Children[1]
+	if power.Type != "Binary" || power.Value != "^" || power.Children[0].Value != "2" || power.Children[1].Type != "Binary" {
+		t.Errorf("2 ** 3 ** 2 doesn't parse as 2 ** (3 ** 2)")
+	}
+}
+
+func TestGoto(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"forward in a loop",
+			"for i = 1, 3 do\n  if i == 2 then goto skip end\n  print(i)\n  ::skip::\nend\n",
+			"for i = 1, 3 do\n  if i == 2 then\n    goto skip\n  end\n  print(i)\n  ::skip::\nend\n",
+		},
+		{"backward", "::top::\nprint(1)\ngoto top\n", "::top::\nprint(1)\ngoto top\n"},
+		// Lua allows it when the label ends the block
+		{"past a local to the end", "goto later\nlocal x = 1\n::later::\n", "goto later\nlocal x = 1\n::later::\n"},
+		{
+			"next to continue",
+			"for i = 1, 3 do\n  continue if i == 2\n  goto done\nend\n::done::\n",
+			"for i = 1, 3 do\n  if i == 2 then\n    goto __continue_1__\n  end\n  goto done\n  ::__continue_1__::\nend\n::done::\n",
+		},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{Target: "5.4"}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	errors := []struct {
+		source string
+		target string
+		want   string
+	}{
+		{"goto nowhere\n", "5.4", "1:6: no visible label 'nowhere' for goto"},
+		{"do\n  ::inner::\nend\ngoto inner\n", "5.4", "4:6: no visible label 'inner' for goto"},
+		{"goto later\nlocal x = 1\n::later::\nprint(x)\n", "5.4", "1:6: goto 'later' jumps into the scope of local 'x'"},
+		{"::a::\n::a::\n", "5.4", "2:3: label 'a' already defined on line 1"},
+		{"goto a\n", "5.1", "1:1: Lua 5.1 doesn't have goto"},
+		{"::a::\n", "5.1", "1:1: Lua 5.1 doesn't have labels"},
+	}
+	for _, test := range errors {
+		if got := compileError(t, test.source, Options{Target: test.target}); !strings.Contains(got, test.want) {
+			t.Errorf("Compile(%q) error = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestLuacheckIgnore(t *testing.T) {
+	options := Options{LuacheckIgnore: true}
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"desugared statement",
+			"print(a < f() < c)\nprint(1)\n",
+			"-- luacheck: push ignore __.*__\nprint((function(__cmp_1__) return a < __cmp_1__ and __cmp_1__ < c end)(f()))\n-- luacheck: pop\nprint(1)\n",
+		},
+		{
+			"indented",
+			"function f()\n  local x = t?.a\n  return x\nend\n",
+			"local function f()\n  -- luacheck: push ignore __.*__\n  local x = (function() local __oc_1__ = t; if __oc_1__ == nil then return nil end; return __oc_1__.a end)()\n  -- luacheck: pop\n  return x\nend\n",
+		},
+		{"plain code", "local a, b = 1, 2\nprint(a + b)\n", "local a, b = 1, 2\nprint(a + b)\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, options); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	// Without the option there are no comments
+	if got := compile(t, "print(a < f() < c)\n", Options{}); strings.Contains(got, "luacheck") {
+		t.Errorf("output without LuacheckIgnore has luacheck comments:\n%s", got)
+	}
+}
+
+func TestDocComments(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		options Options
+		want    string
+	}{
+		{
+			"header",
+			"--- Licensed under MIT\n--! keep me\n-- dropped\nlocal x = 1 -- gone\n",
+			Options{},
+			"--- Licensed under MIT\n--! keep me\nlocal x = 1\n",
+		},
+		{
+			"indented",
+			"function f()\n  --- inner doc\n  -- dropped\n  return x\nend\n",
+			Options{},
+			"local function f()\n  --- inner doc\n  return x\nend\n",
+		},
+		{"block comment", "--[[ block ]]\nprint(1)\n", Options{}, "print(1)\n"},
+		{
+			"keep all comments",
+			"--- Licensed under MIT\n-- kept\nlocal x = 1 -- kept too\n",
+			Options{KeepComments: true},
+			"--- Licensed under MIT\n-- kept\nlocal x = 1 -- kept too\n",
+		},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, test.options); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+}
+
+func TestIndent(t *testing.T) {
+	source := "function f(x)\n  if x then\n    for i = 1, 2 do\n      print(i)\n    end\n  end\nend\n"
+	tests := []struct {
+		indent string
+		want   string
+	}{
+		{"", "local function f(x)\n  if x then\n    for i = 1, 2 do\n      print(i)\n    end\n  end\nend\n"},
+		{"\t", "local function f(x)\n\tif x then\n\t\tfor i = 1, 2 do\n\t\t\tprint(i)\n\t\tend\n\tend\nend\n"},
+		{"    ", "local function f(x)\n    if x then\n        for i = 1, 2 do\n            print(i)\n        end\n    end\nend\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, source, Options{Indent: test.indent}); got != test.want {
+			t.Errorf("Compile with Indent %q =\n%s\nwant\n%s", test.indent, got, test.want)
+		}
+	}
+}
+
+func TestLiteralMethodCalls(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"dot call", `print("x".len(), "foo".upper())`, `print(("x"):len(), ("foo"):upper())` + "\n"},
+		{"colon call", `print("foo":upper(), [[a]]:rep(2))`, `print(("foo"):upper(), ([[a]]):rep(2))` + "\n"},
+		{"arguments", `print("a,b".split(","))`, `print(("a,b"):split(","))` + "\n"},
+		{"already in parens", `print(("foo"):upper())`, `print(("foo"):upper())` + "\n"},
+		{"field", `print("foo".len)`, `print(("foo").len)` + "\n"},
+		{"template", "print(`x${y}`.len(), `abc`:upper())", `print(("x" .. tostring(y)):len(), ("abc"):upper())` + "\n"},
+		{"only the first suffix", `print("a".b.c())`, `print(("a").b.c())` + "\n"},
+		{"number", "print((5).foo(), 5:foo(), 5 .foo)", "print((5).foo(), (5):foo(), (5).foo)\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) = %q, want %q", test.name, test.source, got, test.want)
+		}
+	}
+}
+
+func TestLongStringLevel(t *testing.T) {
+	tests := []struct {
+		source string
+		target string
+		want   string
+	}{
+		// The level is kept, so content with ]] or ]=] survives
+		{"x = [==[a]]b]=]c]==]\n", "5.4", "local x = [==[a]]b]=]c]==]\n"},
+		{"x = [=[]]]=]\n", "5.4", "local x = [=[]]]=]\n"},
+		{"x = [=[x]]=]\n", "5.1", "local x = [=[x]]=]\n"},
+		{"x = [[a[[b]]\n", "5.4", "local x = [[a[[b]]\n"},
+		// 5.1 rejects [[ in a level 0 long string, so the level goes up
+		// to one the content can't close
+		{"x = [[a[[b]]\n", "5.1", "local x = [=[a[[b]=]\n"},
+		{"x = [[a[[b]=]]\n", "5.1", "local x = [==[a[[b]=]==]\n"},
+		{"x = [[a[[b]\n]]\n", "5.1", "local x = [=[a[[b]\n]=]\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{Target: test.target}); got != test.want {
+			t.Errorf("Compile(%q) for %s = %q, want %q", test.source, test.target, got, test.want)
+		}
+	}
+}
+
+func TestElseifChain(t *testing.T) {
+	flat := "if a then\n  print(1)\nelseif b then\n  print(2)\nelseif c then\n  print(3)\nelse\n  print(4)\nend\n"
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"elseif", flat, flat},
+		{"braces", "if a { print(1) } elseif b { print(2) } else if c { print(3) } else { print(4) }\n", flat},
+		// An if in an else block has its own end, so it stays nested
+		{"nested if", "if a then print(1) else if b then print(2) end end\n", "if a then\n  print(1)\nelse\n  if b then\n    print(2)\n  end\nend\n"},
+	}
+	for _, test := range tests {
+		got := compile(t, test.source, Options{})
+		if got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+	if got := compile(t, flat, Options{}); strings.Count(got, "end") != 1 {
+		t.Errorf("four branch if has %d ends, want 1:\n%s", strings.Count(got, "end"), got)
+	}
+}
+
+func TestSafeFloatLoops(t *testing.T) {
+	options := Options{SafeFloatLoops: true}
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"float step",
+			"for i = 0.0, 1.0, 0.1 do print(i) end\n",
+			"do\n  local __start_2__ = 0.0\n  for __n_3__ = 0, math.floor((1.0 - __start_2__) / 0.1 + 1e-9) do\n    local i = __start_2__ + __n_3__ * 0.1\n    print(i)\n  end\nend\n",
+		},
+		{
+			"negative step",
+			"for i = a, b, -0.25 do print(i) end\n",
+			"do\n  local __start_2__ = a\n  for __n_3__ = 0, math.floor((b - __start_2__) / -0.25 + 1e-9) do\n    local i = __start_2__ + __n_3__ * -0.25\n    print(i)\n  end\nend\n",
+		},
+		{"integer step", "for i = 0, 10, 2 do print(i) end\n", "for i = 0, 10, 2 do\n  print(i)\nend\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, options); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	// The count the rewritten loop runs to, worked out as its Lua does,
+	// reaches the end that adding up the step can miss
+	counts := []struct {
+		start, stop, step float64
+		want              int
+	}{
+		{0, 1, 0.1, 11},
+		{0, 0.3, 0.1, 4},
+		{1, 0, -0.25, 5},
+		{0, 0.95, 0.1, 10},
+	}
+	for _, test := range counts {
+		if got := int(math.Floor((test.stop-test.start)/test.step+1e-9)) + 1; got != test.want {
+			t.Errorf("for i = %v, %v, %v runs %d times, want %d", test.start, test.stop, test.step, got, test.want)
+		}
+	}
+}
+
+func TestKeepComments(t *testing.T) {
+	options := Options{KeepComments: true}
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"above statements",
+			"-- about x\nlocal x = 1\n\n-- about f\nfunction f()\n  -- inside\n  return x\nend\n",
+			"-- about x\nlocal x = 1\n-- about f\nlocal function f()\n  -- inside\n  return x\nend\n",
+		},
+		{"after code", "local x = 1 -- one\nprint(x) --[[ block ]]\n", "local x = 1 -- one\nprint(x) --[[ block ]]\n"},
+		{"two statements on a line", "a = 1; b = 2 -- both\n", "local a = 1\nlocal b = 2 -- both\n"},
+		{"end of the file", "print(1)\n-- trailing\n", "print(1)\n-- trailing\n"},
+		// With no statement after it in the block, it goes before the next
+		{"end of a block", "if x then\n  -- c\nend\nprint(1)\n", "if x then\nend\n-- c\nprint(1)\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, options); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	source := "-- about x\nlocal x = 1 -- one\n"
+	if got, want := compile(t, source, Options{}), "local x = 1\n"; got != want {
+		t.Errorf("Compile(%q) without KeepComments = %q, want %q", source, got, want)
+	}
+}
+
+func TestSpecialFloats(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"literals", "print(inf, -inf, nan, -0.0)\n", "print(math.huge, -math.huge, (0/0), -0.0)\n"},
+		{"arithmetic", "x = inf * 2 + 1 / -inf\ny = inf ^ 2\nz = -nan\n", "local x = math.huge * 2 + 1 / -math.huge\nlocal y = math.huge ^ 2\nlocal z = -(0/0)\n"},
+		// Declared names and fields are left alone
+		{"local", "local inf = 5\nprint(inf)\n", "local inf = 5\nprint(inf)\n"},
+		{"implicit local", "inf = 3\nprint(inf)\n", "local inf = 3\nprint(inf)\n"},
+		{"parameter", "function f(inf) return inf + 1 end\n", "local function f(inf)\n  return inf + 1\nend\n"},
+		{"loop variable", "for nan = 1, 2 do print(nan) end\n", "for nan = 1, 2 do\n  print(nan)\nend\n"},
+		{"fields", "t.inf = 1\nprint(t.inf, {inf = 1})\n", "t.inf = 1\nprint(t.inf, {inf = 1})\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+}
+
+func TestStaticAssert(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"passing", "static_assert(1 + 1 == 2, \"math\")\nprint(1)\n", "print(1)\n"},
+		{
+			"enum members",
+			"const enum Size { Small = 1, Large = 8 }\nstatic_assert(Size.Large / Size.Small == 8, \"ratio\")\n",
+			"",
+		},
+		{"strings and booleans", "static_assert(\"a\" .. \"b\" == \"ab\" and not false)\n", ""},
+		{"declared function", "local static_assert = print\nstatic_assert(x)\n", "local static_assert = print\nstatic_assert(x)\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) = %q, want %q", test.name, test.source, got, test.want)
+		}
+	}
+
+	errors := []struct {
+		source string
+		want   string
+	}{
+		{"static_assert(2 > 3, \"too small\")\n", "1:1: static assertion failed: too small"},
+		{"static_assert(nil)\n", "1:1: static assertion failed"},
+		{"static_assert(x, \"x\")\n", "1:15: static_assert requires a constant condition, but 'x' isn't known at compile time"},
+		{"static_assert(1, msg)\n", "1:18: static_assert message must be a string literal"},
+		{"static_assert(1 < 2 < 3)\n", "1:21: cannot apply '<' to a boolean and a number"},
+	}
+	for _, test := range errors {
+		if got := compileError(t, test.source, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("Compile(%q) error = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestRepeatContinue(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"counter",
+			"local i = 0\nrepeat\n  i += 1\n  continue if i == 2\n  print(i)\nuntil i >= 3\n",
+			"local i = 0\nrepeat\n  i = i + 1\n  if i == 2 then\n    goto __continue_1__\n  end\n  print(i)\n  ::__continue_1__::\nuntil i >= 3\n",
+		},
+		{
+			// The body's locals are declared before the first statement,
+			// so the goto doesn't jump into their scope and until sees them
+			"until uses a body local",
+			"repeat\n  local done = f()\n  continue if done\n  local y = 1\nuntil done\n",
+			"repeat local done, y\n  done = f()\n  if done then\n    goto __continue_1__\n  end\n  y = 1\n  ::__continue_1__::\nuntil done\n",
+		},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{Target: "5.4"}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+}
+
+func TestWrapMain(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		options Options
+		want    string
+	}{
+		{
+			// Top-level names are locals of the function, not globals,
+			// and its return is the module's
+			"locals and return",
+			"local x = 1\ny = 2\nfunction f() return x + y end\nreturn f\n",
+			Options{WrapMain: true},
+			"return (function(...)\n  local x = 1\n  local y = 2\n  local function f()\n    return x + y\n  end\n  return f\nend)(...)\n",
+		},
+		{"varargs", "print(...)\n", Options{WrapMain: true}, "return (function(...)\n  print(...)\nend)(...)\n"},
+		{"globals", "global y = 2\n", Options{WrapMain: true}, "return (function(...)\n  y = 2\nend)(...)\n"},
+		{"preserve lines", "print(1)\n", Options{WrapMain: true, PreserveLines: true}, "return (function(...) print(1)\nend)(...)\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, test.options); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+}
+
+func TestMultilineChains(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"dots", "x = builder\n  .add(1)\n  .add(2)\n  .build()\n", "local x = builder.add(1).add(2).build()\n"},
+		{"methods", "obj\n  :add(1)\n  :build()\n", "obj:add(1):build()\n"},
+		{
+			"optional chaining",
+			"y = a\n  ?.b\n  ?.c\n",
+			"local y = (function() local __oc_2__ = (function() local __oc_1__ = a; if __oc_1__ == nil then return nil end; return __oc_1__.b end)(); if __oc_2__ == nil then return nil end; return __oc_2__.c end)()\n",
+		},
+		{"comment between", "x = a\n-- comment\n  .b\n", "local x = a.b\n"},
+		// A line starting with anything else is a new statement
+		{"new statements", "y = a\nf()\nz = b\nprint(z)\n", "local y = a\nf()\nlocal z = b\nprint(z)\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	options := Options{Annotations: true}
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"typed",
+			"function add(a: number, b: number?): number\n  return a + b\nend\n",
+			"---@param a number\n---@param b number?\n---@return number\nlocal function add(a, b)\n  return a + b\nend\n",
+		},
+		{
+			"method with varargs and results",
+			"function M:get(key: string, ...): (string?, number)\n  return nil\nend\n",
+			"---@param key string\n---@param ... any\n---@return string?\n---@return number\nfunction M:get(key, ...)\n  return nil\nend\n",
+		},
+		{
+			"table and function types",
+			"function each(t: {[string]: Item}, f: function(Item): boolean, opts: {x: number}, list: {number}, m: Map<string, number>)\nend\n",
+			"---@param t table<string, Item>\n---@param f fun(_: Item): boolean\n---@param opts {x: number}\n---@param list number[]\n---@param m Map<string, number>\nlocal function each(t, f, opts, list, m)\nend\n",
+		},
+		{"untyped", "local function plain(a, b)\nend\n", "---@param a any\n---@param b any\nlocal function plain(a, b)\nend\n"},
+		{"no parameters", "function f()\nend\n", "local function f()\nend\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, options); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+}
+
+func TestTypeAnnotationsCompileAway(t *testing.T) {
+	tests := []struct {
+		annotated string
+		plain     string
+	}{
+		{"function add(a: number, b: number?): number\n  return a + b\nend\n", "function add(a, b)\n  return a + b\nend\n"},
+		{"function M:get(key: string, ...): (string?, number)\n  return nil\nend\n", "function M:get(key, ...)\n  return nil\nend\n"},
+		{
+			"local function each(t: {[string]: Item}, f: function(x: Item, ...): boolean, r: {x: number, y: number}, l: {number}, e: {})\nend\n",
+			"local function each(t, f, r, l, e)\nend\n",
+		},
+		{"function f(m: Map<string, {number}>, u: (A | B)?, s: \"on\" | nil): (A | B)?\nend\n", "function f(m, u, s)\nend\n"},
+	}
+	for _, test := range tests {
+		got, want := compile(t, test.annotated, Options{}), compile(t, test.plain, Options{})
+		if got != want {
+			t.Errorf("Compile(%q) =\n%s\nwant the same as without types\n%s", test.annotated, got, want)
+		}
+	}
+
+	errors := []struct {
+		source string
+		want   string
+	}{
+		{"function f(a: ) end\n", "1:15: expected a type, got ')'"},
+		{"function f(a: {[string] number}) end\n", "expected ']:' after the key type"},
+		{"function f(a: function number) end\n", "expected '(' after 'function' in type"},
+	}
+	for _, test := range errors {
+		if got := compileError(t, test.source, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("Compile(%q) error = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestDoBlock(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"braces", "do {\n  x = 1\n  print(x)\n}\n", "do\n  local x = 1\n  print(x)\nend\n"},
+		{"end", "do\n  x = 1\n  print(x)\nend\n", "do\n  local x = 1\n  print(x)\nend\n"},
+		// x after the block isn't the block's, so it's declared again
+		{"local doesn't leak", "do { x = 1 }\nx = 2\n", "do\n  local x = 1\nend\nlocal x = 2\n"},
+		{"outer local", "x = 0\ndo {\n  x = 1\n}\nprint(x)\n", "local x = 0\ndo\n  x = 1\nend\nprint(x)\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	// y after the block is a global, so the block's y is never used
+	if got := lintCodes(t, "do\n  local y = 1\nend\nprint(y)\n"); got != "2:unused" {
+		t.Errorf("warnings %q, want the block's y unused", got)
+	}
+}
+
+func TestBracedBlocks(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"if",
+			"if x > 1 {\n  print(1)\n} elseif x > 0 {\n  print(2)\n} else {\n  print(3)\n}\n",
+			"if x > 1 then\n  print(1)\nelseif x > 0 then\n  print(2)\nelse\n  print(3)\nend\n",
+		},
+		{"else if", "if a {\n  print(1)\n} else if b {\n  print(2)\n}\n", "if a then\n  print(1)\nelseif b then\n  print(2)\nend\n"},
+		{"one line", "if a { print(1) } else { print(2) }\n", "if a then\n  print(1)\nelse\n  print(2)\nend\n"},
+		{"while", "local x = 0\nwhile x < 3 {\n  x = x + 1\n}\n", "local x = 0\nwhile x < 3 do\n  x = x + 1\nend\n"},
+		{"numeric for", "for i = 1, 3 { print(i) }\n", "for i = 1, 3 do\n  print(i)\nend\n"},
+		{"generic for", "for k, v in pairs(t) {\n  print(k)\n}\n", "for k, v in pairs(t) do\n  print(k)\nend\n"},
+		{
+			"mixed with keywords",
+			"while a {\n  if b then\n    break\n  end\n}\nfor i = 1, 2 do\n  if i > 1 { print(i) }\nend\n",
+			"while a do\n  if b then\n    break\n  end\nend\nfor i = 1, 2 do\n  if i > 1 then\n    print(i)\n  end\nend\n",
+		},
+		// A table call followed by do is in the head, not the block
+		{"table call in the head", "for _, v in ipairs{1, 2} do\n  print(v)\nend\n", "for _, v in ipairs{[1] = 1, [2] = 2} do\n  print(v)\nend\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	errors := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"unclosed", "while true {\n  break\n", "3:1: expected '}' to close while loop"},
+		{"else without braces", "if a {\n  print(1)\n} else\n  print(2)\nend\n", "4:3: expected '{' after 'else'"},
+		{"braces after then", "if a then\n  print(1)\nelse {\n  print(2)\n}\n", "6:1: expected 'end' to close if statement"},
+	}
+	for _, test := range errors {
+		if got := compileError(t, test.source, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("%s: Compile(%q) error = %q, want %q", test.name, test.source, got, test.want)
+		}
+	}
+}
+
+func TestCheckBalanced(t *testing.T) {
+	// Brackets in strings don't count
+	source := "print(\"(\", \"{\")\nlocal t = {a = f(1)}\n"
+	if got, want := compile(t, source, Options{CheckBalanced: true}), "print(\"(\", \"{\")\nlocal t = {a = f(1)}\n"; got != want {
+		t.Errorf("Compile(%q) =\n%s\nwant\n%s", source, got, want)
+	}
+
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"unclosed", "if a {\n  print(1)\n", "1:6: '{' opened at line 1 is never closed"},
+		{"unclosed safe index", "print(t?[1)\n", "1:11: ')' doesn't match the '?[' opened at line 1"},
+		{"mismatched", "local t = {\n  a = (1,\n}\n", "3:1: '}' doesn't match the '(' opened at line 2"},
+		{"stray closer", "x = 1)\n", "1:6: unexpected ')' with no bracket open"},
+	}
+	for _, test := range tests {
+		if got := compileError(t, test.source, Options{CheckBalanced: true}); !strings.Contains(got, test.want) {
+			t.Errorf("%s: Compile(%q) error = %q, want %q", test.name, test.source, got, test.want)
+		}
+	}
+
+	// Without the check the parser reports where it gives up instead
+	source = "local t = {\n  a = (1,\n}\n"
+	if got, want := compileError(t, source, Options{}), "2:9: expected ')'"; !strings.Contains(got, want) {
+		t.Errorf("Compile(%q) error = %q, want %q", source, got, want)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"literal arms",
+			"print(match n { 0 => \"zero\", \"one\" => 1, true => 2, nil => 3, _ => 4 })\n",
+			"print((function(__match_1__) if __match_1__ == 0 then return \"zero\" elseif __match_1__ == \"one\" then return 1 elseif __match_1__ == true then return 2 elseif __match_1__ == nil then return 3 else return 4 end end)(n))\n",
+		},
+		// Tag arms check the tag field and bind the elements in order
+		{
+			"tag arms",
+			"print(match shape { Circle(r) => r * r, Rect(w, h) => w * h, _ => 0 })\n",
+			"print((function(__match_1__) if type(__match_1__) == \"table\" and __match_1__.tag == \"Circle\" then local r = __match_1__[1]; return r * r elseif type(__match_1__) == \"table\" and __match_1__.tag == \"Rect\" then local w, h = __match_1__[1], __match_1__[2]; return w * h else return 0 end end)(shape))\n",
+		},
+		{"only a wildcard", "print(match x { _ => 1 })\n", "print((function(__match_1__) do return 1 end end)(x))\n"},
+		{"match as a method", "print(s:match(\"a\"), string.match(s, \"b\"))\n", "print(s:match(\"a\"), string.match(s, \"b\"))\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	warnings := []struct {
+		source string
+		want   string
+	}{
+		{"print(match n { 0 => 1, 1 => 2 })\n", "1:non-exhaustive"},
+		{"print(match n { 0 => 1, _ => 2 })\n", ""},
+	}
+	for _, test := range warnings {
+		codes := []string{}
+		compile(t, test.source, Options{Warn: func(w Warning) {
+			codes = append(codes, fmt.Sprintf("%d:%s", w.Line, w.Code))
+		}})
+		if got := strings.Join(codes, " "); got != test.want {
+			t.Errorf("Compile(%q) warnings %q, want %q", test.source, got, test.want)
+		}
+	}
+
+	errors := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"arm after the wildcard", "print(match n { _ => 1, 0 => 2 })\n", "1:25: unreachable match arm after '_'"},
+		{"missing arrow", "print(match x { 1 2 })\n", "1:19: expected '=>' after match pattern"},
+		{"bad binding", "print(match x { Circle(r, => 1, _ => 2 })\n", "1:27: expected name in 'Circle' pattern"},
+		{"expression pattern", "print(match x { a + 1 => 2 })\n", "1:17: invalid match pattern a"},
+		{"unclosed", "print(match n { 0 => 1\n", "2:1: expected '}' to close match"},
+	}
+	for _, test := range errors {
+		if got := compileError(t, test.source, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("%s: Compile(%q) error = %q, want %q", test.name, test.source, got, test.want)
+		}
+	}
+}
+
+func TestWhen(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"grades",
+			"local grade = when { score >= 90 => \"A\", score >= 80 => \"B\", else => \"F\" }\n",
+			"local grade = (function() if score >= 90 then return \"A\" elseif score >= 80 then return \"B\" else return \"F\" end end)()\n",
+		},
+		// An elseif chain calls b() only when a() is false, and c() only
+		// when neither is true
+		{
+			"guards in order",
+			"print(when { a() => 1, b() => 2, else => c() })\n",
+			"print((function() if a() then return 1 elseif b() then return 2 else return c() end end)())\n",
+		},
+		{"table values", "print(when { x => { a = 1 }, else => {} })\n", "print((function() if x then return {a = 1} else return {} end end)())\n"},
+		{"call with a table", "when {1, 2}\n", "when{[1] = 1, [2] = 2}\n"},
+		{"local named when", "local when = 1\nprint(when)\n", "local when = 1\nprint(when)\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	errors := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"no else", "print(when { a => 1 })\n", "1:21: when expression needs an 'else' arm"},
+		{"arm after else", "print(when { a => 1, else => 2, b => 3 })\n", "1:33: unreachable when arm after 'else'"},
+	}
+	for _, test := range errors {
+		if got := compileError(t, test.source, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("%s: Compile(%q) error = %q, want %q", test.name, test.source, got, test.want)
+		}
+	}
+}
+
+func TestSafeIndex(t *testing.T) {
+	// The table is evaluated once into a local, and the index is skipped
+	// when it's nil, so a nil table and a missing key both give nil
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"name key", "print(t?[k])\n", "print((function() local __oc_1__ = t; if __oc_1__ == nil then return nil end; return __oc_1__[(k) + 1] end)())\n"},
+		{"string key", "print(t?[\"a\"])\n", "print((function() local __oc_1__ = t; if __oc_1__ == nil then return nil end; return __oc_1__[\"a\"] end)())\n"},
+		{"call evaluated once", "print(f()?[\"a\"])\n", "print((function() local __oc_1__ = f(); if __oc_1__ == nil then return nil end; return __oc_1__[\"a\"] end)())\n"},
+		{
+			"with a default",
+			"print(t?[\"a\"] ?? 0)\n",
+			"print((function() local __nc_2__ = (function() local __oc_1__ = t; if __oc_1__ == nil then return nil end; return __oc_1__[\"a\"] end)(); if __nc_2__ ~= nil then return __nc_2__ else return 0 end end)())\n",
+		},
+		{
+			"chained with ?.",
+			"print(a.b?[\"x\"]?.c)\n",
+			"print((function() local __oc_2__ = (function() local __oc_1__ = a.b; if __oc_1__ == nil then return nil end; return __oc_1__[\"x\"] end)(); if __oc_2__ == nil then return nil end; return __oc_2__.c end)())\n",
+		},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+}
+
+func TestComprehensions(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			"numeric for",
+			"local squares = [x * x for x = 1, 10]\n",
+			"local squares = (function() local __list_1__ = {}; for x = 1, 10 do __list_1__[#__list_1__ + 1] = x * x end; return __list_1__ end)()\n",
+		},
+		{
+			"filtered",
+			"local evens = [x for _, x in ipairs(xs) if x % 2 == 0]\n",
+			"local evens = (function() local __list_1__ = {}; for _, x in ipairs(xs) do if x % 2 == 0 then __list_1__[#__list_1__ + 1] = x end end; return __list_1__ end)()\n",
+		},
+		// Each for clause is nested in the one before it
+		{
+			"nested for clauses",
+			"local pairs = [a .. b for _, a in ipairs(as) for _, b in ipairs(bs) if a ~= b]\n",
+			"local pairs = (function() local __list_1__ = {}; for _, a in ipairs(as) do for _, b in ipairs(bs) do if a ~= b then __list_1__[#__list_1__ + 1] = a .. b end end end; return __list_1__ end)()\n",
+		},
+		{
+			"several filters",
+			"local z = [x for x in each(a) if x if x > 1]\n",
+			"local z = (function() local __list_1__ = {}; for x in each(a) do if x then if x > 1 then __list_1__[#__list_1__ + 1] = x end end end; return __list_1__ end)()\n",
+		},
+		{
+			"table",
+			"local doubled = {k => v * 2 for k, v in pairs(t)}\n",
+			"local doubled = (function() local __map_1__ = {}; for k, v in pairs(t) do __map_1__[(k) + 1] = v * 2 end; return __map_1__ end)()\n",
+		},
+		{
+			"filtered table",
+			"local set = {k => true for k in each(t) if k}\n",
+			"local set = (function() local __map_1__ = {}; for k in each(t) do if k then __map_1__[(k) + 1] = true end end; return __map_1__ end)()\n",
+		},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{}); got != test.want {
+			t.Errorf("%s: Compile(%q) =\n%s\nwant\n%s", test.name, test.source, got, test.want)
+		}
+	}
+
+	errors := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"no for clause", "local m = [x]\n", "1:11: expected 'for' in list comprehension"},
+		{"unclosed", "local m = [x for x in each(a) if x\n", "2:1: expected ']' to close list comprehension"},
+		{"table without for", "local m = {k => v}\n", "1:14: unexpected token =>"},
+	}
+	for _, test := range errors {
+		if got := compileError(t, test.source, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("%s: Compile(%q) error = %q, want %q", test.name, test.source, got, test.want)
+		}
+	}
+}
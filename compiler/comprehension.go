@@ -0,0 +1,181 @@
+package compiler
+
+// comprehensionFor returns the position of the 'for' that starts the
+// clauses of a comprehension whose opening bracket or brace is at open,
+// or -1 if it isn't one. arrow is whether a '=>' must come before it.
+func (c *Compiler) comprehensionFor(open int, arrow bool) int {
+	depth := 0
+	for i := open + 1; i < len(c.tokens); i++ {
+		switch c.tokens[i].Type {
+		case TOKEN_LPAREN, TOKEN_LBRACKET, TOKEN_LBRACE, TOKEN_QUESTION_BRACKET:
+			depth++
+		case TOKEN_RPAREN, TOKEN_RBRACKET, TOKEN_RBRACE:
+			if depth == 0 {
+				return -1
+			}
+			depth--
+		case TOKEN_COMMA, TOKEN_SEMICOLON, TOKEN_EOF:
+			if depth == 0 {
+				return -1
+			}
+		case TOKEN_ARROW:
+			if depth == 0 {
+				arrow = false
+			}
+		case TOKEN_FOR:
+			if depth == 0 && !arrow {
+				return i
+			}
+			if depth == 0 {
+				return -1
+			}
+		}
+	}
+	return -1
+}
+
+// isTableComprehension reports whether the '{' ahead starts {k => v for ...}
+func (c *Compiler) isTableComprehension() bool {
+	return c.comprehensionFor(c.current, true) >= 0
+}
+
+// comprehension compiles [expr for ...] or {key => value for ...} to a
+// function that builds the table in loops and returns it. Each 'for'
+// clause nests in the one before, and an 'if' skips the elements that
+// fail it:
+//
+//	[x * y for x in a for y in b if x ~= y]
+func (c *Compiler) comprehension() error {
+	open := c.advance() // consume '[' or '{'
+	table := open.Type == TOKEN_LBRACE
+	closing := TOKEN_RBRACKET
+	kind := "list"
+	if table {
+		closing = TOKEN_RBRACE
+		kind = "map"
+	}
+	defer c.node("Comprehension")()
+	c.setNode("Comprehension", kind)
+
+	clauses := c.comprehensionFor(c.current-1, table)
+	if clauses < 0 {
+		if table {
+			return c.errorf(open, "expected '=>' and 'for' in table comprehension")
+		}
+		return c.errorf(open, "expected 'for' in list comprehension")
+	}
+
+	// The element comes first but is compiled last, once the clauses
+	// have declared the loop variables it uses
+	element := c.current
+	c.current = clauses
+	result := c.newTemp(kind)
+	start, varargs := c.output.Len(), c.varargUses
+	c.output.WriteString("(function() local " + result + " = {}; ")
+
+	depth, loops := 0, 0
+	for c.peek().Type == TOKEN_FOR || c.peek().Type == TOKEN_IF {
+		if c.advance().Type == TOKEN_IF {
+			c.output.WriteString("if ")
+			if err := c.condition(); err != nil {
+				return err
+			}
+			c.output.WriteString(" then ")
+			depth++
+			continue
+		}
+		c.pushScope()
+		if err := c.comprehensionLoop(); err != nil {
+			return err
+		}
+		depth++
+		loops++
+	}
+	if c.peek().Type != closing {
+		if table {
+			return c.errorf(c.peek(), "expected '}' to close table comprehension")
+		}
+		return c.errorf(c.peek(), "expected ']' to close list comprehension")
+	}
+	end := c.current
+
+	c.current = element
+	if table {
+		c.output.WriteString(result + "[")
+		keyStart := c.output.Len()
+		keyToken := c.peek()
+		if err := c.expression(); err != nil {
+			return err
+		}
+		if c.peek().Type != TOKEN_ARROW {
+			return c.errorf(c.peek(), "expected '=>' after key in table comprehension")
+		}
+		// Keys are offset like those of {[key] = value}
+		if c.current != element+1 || keyToken.Type != TOKEN_STRING {
+			output := c.output.String()
+			c.output.Reset()
+			c.output.WriteString(output[:keyStart] + "(" + output[keyStart:] + ") + 1")
+		}
+		c.advance()
+		c.output.WriteString("] = ")
+	} else {
+		c.output.WriteString(result + "[#" + result + " + 1] = ")
+	}
+	if err := c.expression(); err != nil {
+		return err
+	}
+	if c.current != clauses {
+		return c.errorf(c.peek(), "expected 'for' after the element of the comprehension")
+	}
+	c.current = end + 1
+
+	for i := 0; i < depth; i++ {
+		c.output.WriteString(" end")
+	}
+	for i := 0; i < loops; i++ {
+		c.popScope()
+	}
+	c.output.WriteString("; return " + result + " end)()")
+	c.forwardVarargs(start, varargs)
+	return nil
+}
+
+// comprehensionLoop compiles the head of a for clause, after the 'for',
+// declaring its variables in the current scope
+func (c *Compiler) comprehensionLoop() error {
+	c.output.WriteString("for ")
+	for {
+		if c.peek().Type != TOKEN_IDENT {
+			return c.errorf(c.peek(), "expected identifier in comprehension")
+		}
+		name := c.advance()
+		c.output.WriteString(name.Value)
+		c.declareVariable(name)
+		c.lookupVariable(name.Value).loopVar = true
+		c.leaf("Name", name)
+		if c.peek().Type != TOKEN_COMMA {
+			break
+		}
+		c.advance()
+		c.output.WriteString(", ")
+	}
+
+	switch c.peek().Type {
+	case TOKEN_IN:
+		c.advance()
+		c.output.WriteString(" in ")
+		if err := c.expressionList(); err != nil {
+			return err
+		}
+	case TOKEN_ASSIGN:
+		c.advance()
+		c.output.WriteString(" = ")
+		if err := c.expressionList(); err != nil {
+			return err
+		}
+	default:
+		return c.errorf(c.peek(), "expected 'in' or '=' in comprehension")
+	}
+	c.output.WriteString(" do ")
+	return nil
+}
@@ -0,0 +1,84 @@
+package compiler
+
+// isFreeze reports whether freeze( is ahead, which is contextual like
+// static_assert so a function of that name can still be called
+func (c *Compiler) isFreeze() bool {
+	return c.peek().Value == "freeze" && c.peekNext().Type == TOKEN_LPAREN && !c.isVariableDeclared("freeze")
+}
+
+// frozenMetatable returns the fields of a frozen table's metatable, after
+// __index: the proxy refuses new fields, and length and pairs go to the
+// table. Lua 5.1 and LuaJIT don't look up __len on tables or __pairs at
+// all, so there # and pairs of a frozen table see the empty proxy.
+func (c *Compiler) frozenMetatable() string {
+	metatable := `__newindex = function(_, key) error("cannot assign to field '" .. tostring(key) .. "' of a frozen table", 2) end`
+	if c.options.Target == "5.1" || c.options.Target == "luajit" {
+		return metatable
+	}
+	return metatable + `, __len = function(self) return #getmetatable(self).__index end, ` +
+		`__pairs = function(self) return next, getmetatable(self).__index, nil end`
+}
+
+// freezeCall compiles freeze(t) into a read-only proxy for t. A table
+// literal gets the metatable inline:
+//
+//	setmetatable({}, {__index = {a = 1}, __newindex = ...})
+//
+// Anything else goes through a function declared once per file, which
+// checks it's a table first.
+func (c *Compiler) freezeCall() error {
+	defer c.node("Freeze")()
+	freezeToken := c.advance()
+	c.advance() // consume '('
+
+	if c.peek().Type == TOKEN_RPAREN {
+		return c.errorf(freezeToken, "freeze expects a table")
+	}
+	if c.isTableArgument() {
+		c.output.WriteString("setmetatable({}, {__index = ")
+		if err := c.expression(); err != nil {
+			return err
+		}
+		c.output.WriteString(", " + c.frozenMetatable() + "})")
+	} else {
+		if c.freezeHelper == "" {
+			c.freezeHelper = c.newTemp("freeze")
+			c.helpers += "local function " + c.freezeHelper + `(t) if type(t) ~= "table" then error("freeze expects a table, got " .. type(t), 2) end; ` +
+				"return setmetatable({}, {__index = t, " + c.frozenMetatable() + "}) end"
+		}
+		c.output.WriteString(c.freezeHelper + "(")
+		if err := c.expression(); err != nil {
+			return err
+		}
+		c.output.WriteString(")")
+	}
+
+	if c.peek().Type != TOKEN_RPAREN {
+		return c.errorf(c.peek(), "expected ')' after the table to freeze")
+	}
+	c.advance()
+	return nil
+}
+
+// isTableArgument reports whether the argument ahead is a table
+// constructor and nothing more, as in freeze({a = 1})
+func (c *Compiler) isTableArgument() bool {
+	if c.peek().Type != TOKEN_LBRACE {
+		return false
+	}
+	depth := 0
+	for i := c.current; i < len(c.tokens); i++ {
+		switch c.tokens[i].Type {
+		case TOKEN_LPAREN, TOKEN_LBRACKET, TOKEN_LBRACE, TOKEN_QUESTION_BRACKET:
+			depth++
+		case TOKEN_RPAREN, TOKEN_RBRACKET, TOKEN_RBRACE:
+			depth--
+			if depth == 0 {
+				return i+1 < len(c.tokens) && c.tokens[i+1].Type == TOKEN_RPAREN
+			}
+		case TOKEN_EOF:
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package compiler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFreeze(t *testing.T) {
+	source := "function make(t)\n  return freeze(t)\nend\nconfig = freeze(load())\ndefaults = freeze({a = 1})\n"
+	got := compile(t, source, Options{Target: "5.4"})
+
+	// Tables that aren't literals go through one function per file,
+	// declared before its first use
+	if n := strings.Count(got, "local function __freeze_1__(t)"); n != 1 {
+		t.Errorf("freeze function declared %d times in\n%s", n, got)
+	}
+	if !strings.HasPrefix(got, "local function __freeze_1__(t)") || !strings.Contains(got, "local config = __freeze_1__(load())\n") {
+		t.Errorf("freeze(load()) doesn't call the declared function:\n%s", got)
+	}
+	if !strings.Contains(got, "local defaults = setmetatable({}, {__index = {a = 1}, ") {
+		t.Errorf("freeze of a literal isn't inline:\n%s", got)
+	}
+
+	// Assigning to a field raises an error at the assignment
+	newindex := `__newindex = function(_, key) error("cannot assign to field '" .. tostring(key) .. "' of a frozen table", 2) end`
+	if strings.Count(got, newindex) != 2 {
+		t.Errorf("frozen tables don't refuse assignments:\n%s", got)
+	}
+	if !strings.Contains(got, "__len = ") || !strings.Contains(got, "__pairs = ") {
+		t.Errorf("5.4 frozen tables don't forward # and pairs:\n%s", got)
+	}
+
+	// Lua 5.1 has no __len for tables or __pairs
+	got = compile(t, source, Options{Target: "5.1"})
+	if strings.Contains(got, "__len") || strings.Contains(got, "__pairs") {
+		t.Errorf("5.1 frozen tables use __len or __pairs:\n%s", got)
+	}
+
+	// A function named freeze is called as usual
+	got = compile(t, "local function freeze(t) return t end\nx = freeze(y)\n", Options{})
+	if !strings.Contains(got, "local x = freeze(y)\n") {
+		t.Errorf("a local freeze function isn't called:\n%s", got)
+	}
+}
+
+func TestFreezePreserveLines(t *testing.T) {
+	// The function shares the line of the statement needing it
+	got := compile(t, "x = 1\nconfig = freeze(load())\n", Options{Target: "5.1", PreserveLines: true})
+	lines := strings.Split(got, "\n")
+	if len(lines) < 2 || !strings.HasPrefix(lines[1], "local function __freeze_1__(t)") || !strings.HasSuffix(lines[1], " local config = __freeze_1__(load())") {
+		t.Errorf("Compile with PreserveLines =\n%s", got)
+	}
+}
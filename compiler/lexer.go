@@ -0,0 +1,1002 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// TokenType identifies the kind of a Token
+type TokenType int
+
+const (
+	// Literals
+	TOKEN_NUMBER TokenType = iota
+	TOKEN_STRING
+	TOKEN_TEMPLATE_STRING
+	TOKEN_IDENT
+	TOKEN_TRUE
+	TOKEN_FALSE
+	TOKEN_NIL
+
+	// Keywords
+	TOKEN_AND
+	TOKEN_BREAK
+	TOKEN_CONTINUE
+	TOKEN_CASE
+	TOKEN_DEFAULT
+	TOKEN_DEFER
+	TOKEN_DO
+	TOKEN_ELSE
+	TOKEN_ELSEIF
+	TOKEN_END
+	TOKEN_FOR
+	TOKEN_FUNCTION
+	TOKEN_GLOBAL
+	TOKEN_GOTO
+	TOKEN_GUARD
+	TOKEN_IF
+	TOKEN_IN
+	TOKEN_LOCAL
+	TOKEN_NOT
+	TOKEN_OR
+	TOKEN_REPEAT
+	TOKEN_RETURN
+	TOKEN_SWITCH
+	TOKEN_THEN
+	TOKEN_UNLESS
+	TOKEN_UNTIL
+	TOKEN_WHILE
+
+	// Operators
+	TOKEN_PLUS            // +
+	TOKEN_MINUS           // -
+	TOKEN_STAR            // *
+	TOKEN_STAR_STAR       // **
+	TOKEN_SLASH           // /
+	TOKEN_SLASH_SLASH     // //
+	TOKEN_PERCENT         // %
+	TOKEN_CARET           // ^
+	TOKEN_HASH            // #
+	TOKEN_EQ              // ==
+	TOKEN_NEQ             // ~= or !=
+	TOKEN_LT              // <
+	TOKEN_GT              // >
+	TOKEN_LE              // <=
+	TOKEN_GE              // >=
+	TOKEN_ASSIGN          // =
+	TOKEN_LPAREN          // (
+	TOKEN_RPAREN          // )
+	TOKEN_LBRACE          // {
+	TOKEN_RBRACE          // }
+	TOKEN_LBRACKET        // [
+	TOKEN_RBRACKET        // ]
+	TOKEN_SEMICOLON       // ;
+	TOKEN_COLON           // :
+	TOKEN_DOUBLECOLON     // ::
+	TOKEN_COMMA           // ,
+	TOKEN_DOT             // .
+	TOKEN_DOTDOT          // ..
+	TOKEN_DOTDOTDOT       // ...
+	TOKEN_QUESTION_DOT    // ?.
+	TOKEN_DOUBLE_QUESTION // ??
+	TOKEN_ARROW           // =>
+	TOKEN_QUESTION        // ? after an optional type
+	TOKEN_PIPE            // | between the members of a union type
+
+	// Optional indexing
+	TOKEN_QUESTION_BRACKET // ?[
+
+	// Compound assignment
+	TOKEN_PLUS_ASSIGN        // +=
+	TOKEN_MINUS_ASSIGN       // -=
+	TOKEN_STAR_ASSIGN        // *=
+	TOKEN_STAR_STAR_ASSIGN   // **=
+	TOKEN_SLASH_ASSIGN       // /=
+	TOKEN_SLASH_SLASH_ASSIGN // //=
+	TOKEN_PERCENT_ASSIGN     // %=
+	TOKEN_DOTDOT_ASSIGN      // ..=
+
+	// Increment / decrement (statement position only)
+	TOKEN_PLUS_PLUS   // ++
+	TOKEN_MINUS_MINUS // -- touching a target; lexed as a comment, told apart by the compiler
+
+	TOKEN_DIRECTIVE   // -- tokimun:... comment
+	TOKEN_DOC_COMMENT // --- or --! comment, kept in the output
+	TOKEN_COMMENT     // Any other comment, kept with Options.KeepComments
+	TOKEN_NEWLINE
+	TOKEN_EOF
+	TOKEN_ERROR
+)
+
+var keywords = map[string]TokenType{
+	"and":      TOKEN_AND,
+	"break":    TOKEN_BREAK,
+	"continue": TOKEN_CONTINUE,
+	"case":     TOKEN_CASE,
+	"default":  TOKEN_DEFAULT,
+	"defer":    TOKEN_DEFER,
+	"do":       TOKEN_DO,
+	"else":     TOKEN_ELSE,
+	"elseif":   TOKEN_ELSEIF,
+	"end":      TOKEN_END,
+	"false":    TOKEN_FALSE,
+	"for":      TOKEN_FOR,
+	"function": TOKEN_FUNCTION,
+	"global":   TOKEN_GLOBAL,
+	"goto":     TOKEN_GOTO,
+	"guard":    TOKEN_GUARD,
+	"if":       TOKEN_IF,
+	"in":       TOKEN_IN,
+	"local":    TOKEN_LOCAL,
+	"nil":      TOKEN_NIL,
+	"not":      TOKEN_NOT,
+	"or":       TOKEN_OR,
+	"repeat":   TOKEN_REPEAT,
+	"return":   TOKEN_RETURN,
+	"switch":   TOKEN_SWITCH,
+	"then":     TOKEN_THEN,
+	"true":     TOKEN_TRUE,
+	"unless":   TOKEN_UNLESS,
+	"until":    TOKEN_UNTIL,
+	"while":    TOKEN_WHILE,
+}
+
+var tokenTypeNames = [...]string{
+	TOKEN_NUMBER:             "NUMBER",
+	TOKEN_STRING:             "STRING",
+	TOKEN_TEMPLATE_STRING:    "TEMPLATE_STRING",
+	TOKEN_IDENT:              "IDENT",
+	TOKEN_TRUE:               "TRUE",
+	TOKEN_FALSE:              "FALSE",
+	TOKEN_NIL:                "NIL",
+	TOKEN_AND:                "AND",
+	TOKEN_BREAK:              "BREAK",
+	TOKEN_CONTINUE:           "CONTINUE",
+	TOKEN_CASE:               "CASE",
+	TOKEN_DEFAULT:            "DEFAULT",
+	TOKEN_DEFER:              "DEFER",
+	TOKEN_DO:                 "DO",
+	TOKEN_ELSE:               "ELSE",
+	TOKEN_ELSEIF:             "ELSEIF",
+	TOKEN_END:                "END",
+	TOKEN_FOR:                "FOR",
+	TOKEN_FUNCTION:           "FUNCTION",
+	TOKEN_GLOBAL:             "GLOBAL",
+	TOKEN_GOTO:               "GOTO",
+	TOKEN_GUARD:              "GUARD",
+	TOKEN_IF:                 "IF",
+	TOKEN_IN:                 "IN",
+	TOKEN_LOCAL:              "LOCAL",
+	TOKEN_NOT:                "NOT",
+	TOKEN_OR:                 "OR",
+	TOKEN_REPEAT:             "REPEAT",
+	TOKEN_RETURN:             "RETURN",
+	TOKEN_SWITCH:             "SWITCH",
+	TOKEN_THEN:               "THEN",
+	TOKEN_UNLESS:             "UNLESS",
+	TOKEN_UNTIL:              "UNTIL",
+	TOKEN_WHILE:              "WHILE",
+	TOKEN_PLUS:               "PLUS",
+	TOKEN_MINUS:              "MINUS",
+	TOKEN_STAR:               "STAR",
+	TOKEN_STAR_STAR:          "STAR_STAR",
+	TOKEN_SLASH:              "SLASH",
+	TOKEN_SLASH_SLASH:        "SLASH_SLASH",
+	TOKEN_PERCENT:            "PERCENT",
+	TOKEN_CARET:              "CARET",
+	TOKEN_HASH:               "HASH",
+	TOKEN_EQ:                 "EQ",
+	TOKEN_NEQ:                "NEQ",
+	TOKEN_LT:                 "LT",
+	TOKEN_GT:                 "GT",
+	TOKEN_LE:                 "LE",
+	TOKEN_GE:                 "GE",
+	TOKEN_ASSIGN:             "ASSIGN",
+	TOKEN_LPAREN:             "LPAREN",
+	TOKEN_RPAREN:             "RPAREN",
+	TOKEN_LBRACE:             "LBRACE",
+	TOKEN_RBRACE:             "RBRACE",
+	TOKEN_LBRACKET:           "LBRACKET",
+	TOKEN_RBRACKET:           "RBRACKET",
+	TOKEN_SEMICOLON:          "SEMICOLON",
+	TOKEN_COLON:              "COLON",
+	TOKEN_DOUBLECOLON:        "DOUBLECOLON",
+	TOKEN_COMMA:              "COMMA",
+	TOKEN_DOT:                "DOT",
+	TOKEN_DOTDOT:             "DOTDOT",
+	TOKEN_DOTDOTDOT:          "DOTDOTDOT",
+	TOKEN_QUESTION_DOT:       "QUESTION_DOT",
+	TOKEN_DOUBLE_QUESTION:    "DOUBLE_QUESTION",
+	TOKEN_ARROW:              "ARROW",
+	TOKEN_QUESTION:           "QUESTION",
+	TOKEN_PIPE:               "PIPE",
+	TOKEN_PLUS_ASSIGN:        "PLUS_ASSIGN",
+	TOKEN_MINUS_ASSIGN:       "MINUS_ASSIGN",
+	TOKEN_STAR_ASSIGN:        "STAR_ASSIGN",
+	TOKEN_STAR_STAR_ASSIGN:   "STAR_STAR_ASSIGN",
+	TOKEN_SLASH_ASSIGN:       "SLASH_ASSIGN",
+	TOKEN_SLASH_SLASH_ASSIGN: "SLASH_SLASH_ASSIGN",
+	TOKEN_PERCENT_ASSIGN:     "PERCENT_ASSIGN",
+	TOKEN_DOTDOT_ASSIGN:      "DOTDOT_ASSIGN",
+	TOKEN_PLUS_PLUS:          "PLUS_PLUS",
+	TOKEN_MINUS_MINUS:        "MINUS_MINUS",
+	TOKEN_DIRECTIVE:          "DIRECTIVE",
+	TOKEN_DOC_COMMENT:        "DOC_COMMENT",
+	TOKEN_COMMENT:            "COMMENT",
+	TOKEN_NEWLINE:            "NEWLINE",
+	TOKEN_EOF:                "EOF",
+	TOKEN_ERROR:              "ERROR",
+
+	TOKEN_QUESTION_BRACKET: "QUESTION_BRACKET",
+}
+
+// String returns the constant's name without the TOKEN_ prefix, e.g.
+// IDENT or PLUS_ASSIGN. Every TokenType must have an entry in tokenTypeNames.
+func (t TokenType) String() string {
+	if int(t) >= 0 && int(t) < len(tokenTypeNames) && tokenTypeNames[t] != "" {
+		return tokenTypeNames[t]
+	}
+	return fmt.Sprintf("TokenType(%d)", int(t))
+}
+
+// Token is a single lexeme with its 1-based source position
+type Token struct {
+	Type   TokenType
+	Value  string
+	Line   int
+	Column int
+}
+
+func (t Token) String() string {
+	return fmt.Sprintf("Token{%s, %q, line %d, column %d}", t.Type.String(), t.Value, t.Line, t.Column)
+}
+
+// Lexer splits tokimun source into tokens
+type Lexer struct {
+	source      string
+	tokens      []Token
+	start       int
+	current     int
+	line        int
+	column      int
+	startColumn int
+}
+
+// estimatedTokens guesses how many tokens source holds, so the slice
+// rarely has to grow while tokenizing
+func estimatedTokens(source string) int {
+	return len(source)/4 + 1
+}
+
+// NewLexer returns a lexer for source
+func NewLexer(source string) *Lexer {
+	return &Lexer{
+		source:  source,
+		tokens:  make([]Token, 0, estimatedTokens(source)),
+		start:   0,
+		current: 0,
+		line:    1,
+		column:  1,
+	}
+}
+
+// Reset prepares the lexer to tokenize source, reusing the token slice
+// from the previous run. Tokens returned by an earlier Tokenize are
+// overwritten, so copy them first if they're still needed.
+func (l *Lexer) Reset(source string) {
+	l.source = source
+	if cap(l.tokens) < estimatedTokens(source) {
+		l.tokens = make([]Token, 0, estimatedTokens(source))
+	} else {
+		l.tokens = l.tokens[:0]
+	}
+	l.start = 0
+	l.current = 0
+	l.line = 1
+	l.column = 1
+	l.startColumn = 0
+}
+
+// Tokenize scans the whole source, ending the tokens with TOKEN_EOF
+func (l *Lexer) Tokenize() ([]Token, error) {
+	for !l.isAtEnd() {
+		// Runs of spaces are the most common thing between tokens
+		for l.current < len(l.source) && (l.source[l.current] == ' ' || l.source[l.current] == '\t') {
+			l.current++
+			l.column++
+		}
+		if l.isAtEnd() {
+			break
+		}
+		l.start = l.current
+		l.startColumn = l.column
+		if err := l.scanToken(); err != nil {
+			return nil, err
+		}
+	}
+	l.tokens = append(l.tokens, Token{Type: TOKEN_EOF, Value: "", Line: l.line, Column: l.column})
+	return l.tokens, nil
+}
+
+func (l *Lexer) scanToken() error {
+	c := l.advance()
+
+	switch c {
+	case '(':
+		l.addToken(TOKEN_LPAREN)
+	case ')':
+		l.addToken(TOKEN_RPAREN)
+	case '{':
+		l.addToken(TOKEN_LBRACE)
+	case '}':
+		l.addToken(TOKEN_RBRACE)
+	case '[':
+		// Check for multiline string [[...]]
+		if l.peek() == '[' || l.peek() == '=' {
+			return l.multilineString()
+		}
+		l.addToken(TOKEN_LBRACKET)
+	case ']':
+		l.addToken(TOKEN_RBRACKET)
+	case ';':
+		l.addToken(TOKEN_SEMICOLON)
+	case ',':
+		l.addToken(TOKEN_COMMA)
+	case '#':
+		l.addToken(TOKEN_HASH)
+	case '^':
+		l.addToken(TOKEN_CARET)
+
+	case '+':
+		if l.match('=') {
+			l.addToken(TOKEN_PLUS_ASSIGN)
+		} else if l.match('+') {
+			l.addToken(TOKEN_PLUS_PLUS)
+		} else {
+			l.addToken(TOKEN_PLUS)
+		}
+	case '-':
+		if l.match('-') {
+			l.comment()
+		} else if l.match('=') {
+			l.addToken(TOKEN_MINUS_ASSIGN)
+		} else {
+			l.addToken(TOKEN_MINUS)
+		}
+	case '*':
+		if l.match('=') {
+			l.addToken(TOKEN_STAR_ASSIGN)
+		} else if l.matchSequence("*=") {
+			l.addToken(TOKEN_STAR_STAR_ASSIGN)
+		} else if l.match('*') {
+			l.addToken(TOKEN_STAR_STAR)
+		} else {
+			l.addToken(TOKEN_STAR)
+		}
+	case '/':
+		if l.match('=') {
+			l.addToken(TOKEN_SLASH_ASSIGN)
+		} else if l.matchSequence("/=") {
+			l.addToken(TOKEN_SLASH_SLASH_ASSIGN)
+		} else if l.match('/') {
+			l.addToken(TOKEN_SLASH_SLASH)
+		} else {
+			l.addToken(TOKEN_SLASH)
+		}
+	case '%':
+		if l.match('=') {
+			l.addToken(TOKEN_PERCENT_ASSIGN)
+		} else {
+			l.addToken(TOKEN_PERCENT)
+		}
+
+	case '=':
+		if l.match('=') {
+			l.addToken(TOKEN_EQ)
+		} else if l.match('>') {
+			l.addToken(TOKEN_ARROW)
+		} else {
+			l.addToken(TOKEN_ASSIGN)
+		}
+	case '!':
+		if l.match('=') {
+			l.addToken(TOKEN_NEQ)
+		} else {
+			return l.errorf("unexpected character '!'")
+		}
+	case '~':
+		if l.match('=') {
+			l.addToken(TOKEN_NEQ)
+		} else {
+			return l.errorf("unexpected character '~' (did you mean '~='?)")
+		}
+	case '<':
+		if l.match('=') {
+			l.addToken(TOKEN_LE)
+		} else {
+			l.addToken(TOKEN_LT)
+		}
+	case '>':
+		if l.match('=') {
+			l.addToken(TOKEN_GE)
+		} else {
+			l.addToken(TOKEN_GT)
+		}
+
+	case ':':
+		if l.match(':') {
+			l.addToken(TOKEN_DOUBLECOLON)
+		} else {
+			l.addToken(TOKEN_COLON)
+		}
+	case '.':
+		if l.matchSequence("..") {
+			l.addToken(TOKEN_DOTDOTDOT)
+		} else if l.matchSequence(".=") {
+			l.addToken(TOKEN_DOTDOT_ASSIGN)
+		} else if l.match('.') {
+			l.addToken(TOKEN_DOTDOT)
+		} else if isDigit(l.peek()) {
+			return l.number()
+		} else {
+			l.addToken(TOKEN_DOT)
+		}
+	case '?':
+		if l.match('.') {
+			l.addToken(TOKEN_QUESTION_DOT)
+		} else if l.match('[') {
+			l.addToken(TOKEN_QUESTION_BRACKET)
+		} else if l.match('?') {
+			l.addToken(TOKEN_DOUBLE_QUESTION)
+		} else {
+			l.addToken(TOKEN_QUESTION)
+		}
+	case '|':
+		l.addToken(TOKEN_PIPE)
+
+	case '"', '\'':
+		return l.string(c)
+	case '`':
+		return l.templateString()
+
+	case '\n':
+		l.line++
+		l.column = 1
+	case ' ', '\r', '\t':
+		// Ignore whitespace
+	default:
+		if isDigit(c) {
+			return l.number()
+		} else if isAlpha(c) {
+			l.identifier()
+		} else {
+			return l.errorf("unexpected character '%c'", c)
+		}
+	}
+	return nil
+}
+
+func (l *Lexer) comment() {
+	// Check for multiline comment --[[...]]
+	if l.peek() == '[' && (l.peekNext() == '[' || l.peekNext() == '=') {
+		startLine := l.line
+		l.advance() // consume '['
+		// Count equals signs
+		eqCount := 0
+		for l.peek() == '=' {
+			l.advance()
+			eqCount++
+		}
+		if l.peek() != '[' {
+			// Not a valid multiline comment start, treat as single line
+			for l.peek() != '\n' && !l.isAtEnd() {
+				l.advance()
+			}
+			l.addTokenValue(TOKEN_COMMENT, strings.TrimRight(l.source[l.start:l.current], " \t\r"))
+			return
+		}
+		l.advance() // consume second '['
+
+		// Find matching ]=*]
+		for !l.isAtEnd() {
+			if l.peek() == '\n' {
+				l.line++
+				l.column = 0
+			}
+			if l.peek() == ']' {
+				l.advance()
+				matchEq := 0
+				for l.peek() == '=' && matchEq < eqCount {
+					l.advance()
+					matchEq++
+				}
+				if matchEq == eqCount && l.peek() == ']' {
+					l.advance()
+					l.addTokenValue(TOKEN_COMMENT, l.source[l.start:l.current])
+					l.tokens[len(l.tokens)-1].Line = startLine
+					return
+				}
+			} else {
+				l.advance()
+			}
+		}
+	} else {
+		// Single line comment
+		textStart := l.current
+		for l.peek() != '\n' && !l.isAtEnd() {
+			l.advance()
+		}
+
+		// Comments are passed on to the compiler, which reads directives
+		// (-- tokimun:disable=unused), keeps doc comments (--- or --!)
+		// and only keeps the rest if asked to
+		raw := l.source[textStart:l.current]
+		text := strings.TrimSpace(raw)
+		if strings.HasPrefix(text, "tokimun:") {
+			l.addTokenValue(TOKEN_DIRECTIVE, strings.TrimPrefix(text, "tokimun:"))
+		} else if strings.HasPrefix(raw, "-") || strings.HasPrefix(raw, "!") {
+			l.addTokenValue(TOKEN_DOC_COMMENT, "--"+strings.TrimRight(raw, " \t\r"))
+		} else {
+			l.addTokenValue(TOKEN_COMMENT, "--"+strings.TrimRight(raw, " \t\r"))
+		}
+	}
+}
+
+func (l *Lexer) string(quote byte) error {
+	startLine := l.line
+	for l.peek() != quote && !l.isAtEnd() {
+		if l.peek() == '\n' {
+			return l.unterminated("string", startLine)
+		}
+		if l.peek() == '\\' {
+			l.advance() // Skip escape character
+			switch l.peek() {
+			case '\r', '\n':
+				// A backslash before a newline continues the string on the
+				// next line, like Lua
+				l.newline()
+				continue
+			case 'u':
+				if err := l.unicodeEscape(); err != nil {
+					return err
+				}
+				continue
+			case 'z':
+				// \z skips the whitespace after it, newlines included
+				l.advance()
+				for l.peek() == ' ' || l.peek() == '\t' || l.peek() == '\r' || l.peek() == '\n' {
+					if l.peek() == '\r' || l.peek() == '\n' {
+						l.newline()
+					} else {
+						l.advance()
+					}
+				}
+				continue
+			}
+		}
+		l.advance()
+	}
+	if l.isAtEnd() {
+		return l.unterminated("string", startLine)
+	}
+	l.advance() // Closing quote
+	l.addTokenValue(TOKEN_STRING, l.source[l.start:l.current])
+	return nil
+}
+
+// unicodeEscape checks a \u{XXX} escape, with the lexer on the u
+func (l *Lexer) unicodeEscape() error {
+	l.advance() // u
+	if l.peek() != '{' {
+		return l.errorf("missing '{' in \\u{...} escape")
+	}
+	l.advance()
+	digits := l.current
+	for isHexDigit(l.peek()) {
+		l.advance()
+	}
+	if l.current == digits {
+		return l.errorf("missing hexadecimal digits in \\u{...} escape")
+	}
+	if l.peek() != '}' {
+		return l.errorf("missing '}' in \\u{...} escape")
+	}
+	value, err := strconv.ParseUint(l.source[digits:l.current], 16, 32)
+	if err != nil || value > unicode.MaxRune {
+		return l.errorf("\\u{%s} is not a Unicode code point", l.source[digits:l.current])
+	}
+	l.advance() // }
+	return nil
+}
+
+func (l *Lexer) multilineString() error {
+	// Already consumed first '['
+	// Count equals signs
+	eqCount := 0
+	for l.peek() == '=' {
+		l.advance()
+		eqCount++
+	}
+	if l.peek() != '[' {
+		// Not a valid multiline string, just a bracket
+		l.current = l.start + 1
+		l.addToken(TOKEN_LBRACKET)
+		return nil
+	}
+	l.advance() // consume second '['
+	contentStart := l.current
+
+	startLine := l.line
+	// Find matching ]=*]
+	for !l.isAtEnd() {
+		if l.peek() == '\n' {
+			l.line++
+			l.column = 0
+		}
+		if l.peek() == ']' {
+			markPos := l.current
+			l.advance()
+			matchEq := 0
+			for l.peek() == '=' && matchEq < eqCount {
+				l.advance()
+				matchEq++
+			}
+			if matchEq == eqCount && l.peek() == ']' {
+				l.advance()
+				// Like Lua, drop a newline directly after the opening bracket.
+				// If another newline follows, keep the first one so the
+				// emitted literal still starts with the second
+				content := l.source[contentStart:markPos]
+				for _, newline := range []string{"\r\n", "\n\r", "\n", "\r"} {
+					if strings.HasPrefix(content, newline) {
+						if rest := content[len(newline):]; rest == "" || (rest[0] != '\n' && rest[0] != '\r') {
+							content = rest
+						}
+						break
+					}
+				}
+				value := l.source[l.start:contentStart] + content + l.source[markPos:l.current]
+				l.addTokenValue(TOKEN_STRING, value)
+				return nil
+			}
+			// Reset and continue from after the first ]
+			l.current = markPos + 1
+		} else {
+			l.advance()
+		}
+	}
+	return l.unterminated("multiline string", startLine)
+}
+
+func (l *Lexer) templateString() error {
+	startLine := l.line
+
+	// Consume everything in the template string, including ${...} interpolations
+	// We'll store the raw content and parse interpolations later
+	for l.peek() != '`' && !l.isAtEnd() {
+		if l.peek() == '\n' {
+			l.line++
+			l.column = 0
+		}
+		if l.peek() == '\\' {
+			l.advance()
+			if l.peek() == 'u' {
+				if err := l.unicodeEscape(); err != nil {
+					return err
+				}
+			} else if !l.isAtEnd() {
+				l.advance()
+			}
+		} else if l.matchSequence("${") {
+			braceDepth := 1
+			for braceDepth > 0 && !l.isAtEnd() {
+				c := l.advance()
+				if c == '{' {
+					braceDepth++
+				} else if c == '}' {
+					braceDepth--
+				} else if c == '\n' {
+					l.line++
+					l.column = 0
+				}
+			}
+		} else {
+			l.advance()
+		}
+	}
+	if l.isAtEnd() {
+		return l.unterminated("template string", startLine)
+	}
+	l.advance() // Closing backtick
+	l.addToken(TOKEN_TEMPLATE_STRING)
+	return nil
+}
+
+func (l *Lexer) number() error {
+	// Check for hex, binary, octal
+	if l.source[l.start] == '0' && l.current < len(l.source) {
+		switch l.peek() {
+		case 'x', 'X':
+			l.advance()
+			for isHexDigit(l.peek()) {
+				l.advance()
+			}
+			// Look for hex fraction (hex float, e.g. 0x1.8p1)
+			if l.peek() == '.' && isHexDigit(l.peekNext()) {
+				l.advance() // consume '.'
+				for isHexDigit(l.peek()) {
+					l.advance()
+				}
+			}
+			// Look for binary exponent (hex float, e.g. 0x1p4)
+			if l.peek() == 'p' || l.peek() == 'P' {
+				l.advance()
+				if l.peek() == '+' || l.peek() == '-' {
+					l.advance()
+				}
+				if !isDigit(l.peek()) {
+					return l.errorf("malformed hex float '%s' (missing exponent digits)", l.source[l.start:l.current])
+				}
+				for isDigit(l.peek()) {
+					l.advance()
+				}
+			}
+			l.addToken(TOKEN_NUMBER)
+			return nil
+		case 'b', 'B':
+			l.advance()
+			for l.peek() == '0' || l.peek() == '1' {
+				l.advance()
+			}
+			return l.radixLiteral("binary")
+		case 'o', 'O':
+			l.advance()
+			for l.peek() >= '0' && l.peek() <= '7' {
+				l.advance()
+			}
+			return l.radixLiteral("octal")
+		}
+	}
+
+	// Regular decimal number
+	for isDigit(l.peek()) {
+		l.advance()
+	}
+	// Look for decimal part
+	if l.peek() == '.' && isDigit(l.peekNext()) {
+		l.advance() // consume '.'
+		for isDigit(l.peek()) {
+			l.advance()
+		}
+	}
+	// Look for exponent
+	if l.peek() == 'e' || l.peek() == 'E' {
+		l.advance()
+		if l.peek() == '+' || l.peek() == '-' {
+			l.advance()
+		}
+		for isDigit(l.peek()) {
+			l.advance()
+		}
+	}
+	l.addToken(TOKEN_NUMBER)
+	return nil
+}
+
+func (l *Lexer) identifier() {
+	for l.current < len(l.source) && isAlphaNumeric(l.source[l.current]) {
+		l.current++
+		l.column++
+	}
+	text := l.source[l.start:l.current]
+	tokenType, ok := keywords[text]
+	if !ok {
+		tokenType = TOKEN_IDENT
+	}
+	l.addToken(tokenType)
+}
+
+// errorf returns a CompileError at the start of the current token
+func (l *Lexer) errorf(format string, args ...interface{}) error {
+	return &CompileError{Line: l.line, Column: l.startColumn, Message: fmt.Sprintf(format, args...)}
+}
+
+// unterminated reports a string that opened at startLine and the current
+// token's column, saying where the lexer gave up looking for its end
+func (l *Lexer) unterminated(kind string, startLine int) error {
+	where := fmt.Sprintf("the end of line %d", l.line)
+	if l.isAtEnd() {
+		// A final newline doesn't start another line
+		line := l.line
+		if strings.HasSuffix(l.source, "\n") {
+			line--
+		}
+		where = fmt.Sprintf("the end of the file (line %d)", line)
+	}
+	return &CompileError{Line: startLine, Column: l.startColumn, Message: fmt.Sprintf("unterminated %s, still open at %s", kind, where)}
+}
+
+// newline consumes a line break inside a token, \r\n counting as one
+func (l *Lexer) newline() {
+	if l.advance() == '\r' {
+		l.match('\n')
+	}
+	l.line++
+	l.column = 1
+}
+
+func (l *Lexer) advance() byte {
+	c := l.source[l.current]
+	l.current++
+	l.column++
+	return c
+}
+
+func (l *Lexer) match(expected byte) bool {
+	if l.isAtEnd() || l.source[l.current] != expected {
+		return false
+	}
+	l.current++
+	l.column++
+	return true
+}
+
+// matchSequence consumes seq if the upcoming characters match it exactly
+func (l *Lexer) matchSequence(seq string) bool {
+	for i := 0; i < len(seq); i++ {
+		if l.peekAt(i) != seq[i] {
+			return false
+		}
+	}
+	l.current += len(seq)
+	l.column += len(seq)
+	return true
+}
+
+func (l *Lexer) peek() byte {
+	return l.peekAt(0)
+}
+
+func (l *Lexer) peekNext() byte {
+	return l.peekAt(1)
+}
+
+// peekAt looks offset characters past the current one without consuming
+func (l *Lexer) peekAt(offset int) byte {
+	if l.current+offset >= len(l.source) {
+		return 0
+	}
+	return l.source[l.current+offset]
+}
+
+func (l *Lexer) isAtEnd() bool {
+	return l.current >= len(l.source)
+}
+
+func (l *Lexer) addToken(tokenType TokenType) {
+	l.addTokenValue(tokenType, l.source[l.start:l.current])
+}
+
+func (l *Lexer) addTokenValue(tokenType TokenType, value string) {
+	l.tokens = append(l.tokens, Token{
+		Type:   tokenType,
+		Value:  value,
+		Line:   l.line,
+		Column: l.startColumn,
+	})
+}
+
+// Helper functions
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
+
+func isAlphaNumeric(c byte) bool {
+	return isAlpha(c) || isDigit(c)
+}
+
+// Convert tokimun number literals to Lua-compatible values. The warning,
+// if not empty, says the literal won't keep its value on the target.
+func convertNumber(value string, target string) (string, string, error) {
+	if len(value) < 2 {
+		return value, "", nil
+	}
+
+	converted := value
+	if value[0] == '0' {
+		switch value[1] {
+		case 'b', 'B':
+			// Binary literal
+			n, err := strconv.ParseUint(value[2:], 2, 64)
+			if err != nil {
+				return "", "", radixError("binary", value, err)
+			}
+			converted = radixDecimal(n, target)
+		case 'o', 'O':
+			// Octal literal
+			n, err := strconv.ParseUint(value[2:], 8, 64)
+			if err != nil {
+				return "", "", radixError("octal", value, err)
+			}
+			converted = radixDecimal(n, target)
+		}
+	}
+	// Decimal and hex literals (including hex floats like 0x1p4) pass
+	// through untouched so that Lua 5.3+ keeps the integer/float
+	// distinction (1 vs 1.0 vs 1e3)
+	return converted, precisionWarning(value, converted, target), nil
+}
+
+// precisionWarning reports an integer literal that Lua versions without
+// integers, where every number is a double, can't hold exactly
+func precisionWarning(literal string, converted string, target string) string {
+	lua := "Lua " + target
+	switch target {
+	case "5.1", "5.2":
+	case "luajit":
+		lua = "LuaJIT"
+	default:
+		return ""
+	}
+	n, ok := new(big.Int).SetString(converted, 0)
+	if !ok {
+		return "" // A float, which is a double anyway
+	}
+	f, accuracy := new(big.Float).SetInt(n).Float64()
+	if accuracy == big.Exact {
+		return ""
+	}
+	return fmt.Sprintf("%s can't be represented exactly on %s and becomes %s", literal, lua, big.NewFloat(f).Text('f', 0))
+}
+
+// radixLiteral ends a binary or octal literal whose digits have been
+// read. A digit or letter right after them would otherwise start a token
+// of its own, as in 0b12.
+func (l *Lexer) radixLiteral(kind string) error {
+	literal := l.source[l.start:l.current]
+	if isAlphaNumeric(l.peek()) {
+		return l.errorf("invalid digit '%c' in %s literal '%s'", l.peek(), kind, literal+string(l.peek()))
+	}
+	if len(literal) == 2 {
+		return l.errorf("%s literal '%s' has no digits", kind, literal)
+	}
+	l.addToken(TOKEN_NUMBER)
+	return nil
+}
+
+// radixDecimal writes the value of a binary or octal literal in decimal.
+// Like a hex literal, one with the 64th bit set wraps around to a negative
+// integer on Lua 5.3 and later, and is a large double before that.
+func radixDecimal(n uint64, target string) string {
+	switch target {
+	case "5.1", "5.2", "luajit":
+		return strconv.FormatUint(n, 10)
+	}
+	return strconv.FormatInt(int64(n), 10)
+}
+
+// radixError turns the error strconv gives for a binary or octal literal
+// into one of ours
+func radixError(kind string, literal string, err error) error {
+	if errors.Is(err, strconv.ErrRange) {
+		return fmt.Errorf("%s literal too large: %s doesn't fit in 64 bits", kind, literal)
+	}
+	return fmt.Errorf("invalid %s literal: %s", kind, literal)
+}
+
+// Check if a rune is a valid identifier start
+func isIdentifierStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_'
+}
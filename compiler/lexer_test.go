@@ -0,0 +1,370 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTokenTypeNames(t *testing.T) {
+	// Every type from the first to TOKEN_ERROR has a name of its own
+	if len(tokenTypeNames) != int(TOKEN_ERROR)+1 {
+		t.Errorf("tokenTypeNames has %d entries, want %d", len(tokenTypeNames), TOKEN_ERROR+1)
+	}
+	seen := map[string]TokenType{}
+	for tt := TOKEN_NUMBER; tt <= TOKEN_ERROR; tt++ {
+		name := tt.String()
+		if strings.HasPrefix(name, "TokenType(") {
+			t.Errorf("TokenType %d has no name", int(tt))
+		}
+		if other, ok := seen[name]; ok {
+			t.Errorf("TokenTypes %d and %d are both %s", int(other), int(tt), name)
+		}
+		seen[name] = tt
+	}
+
+	if got, want := (TOKEN_ERROR + 1).String(), fmt.Sprintf("TokenType(%d)", TOKEN_ERROR+1); got != want {
+		t.Errorf("TokenType past the last is %s, want %s", got, want)
+	}
+	token := Token{Type: TOKEN_PLUS_ASSIGN, Value: "+=", Line: 3, Column: 5}
+	if got, want := token.String(), `Token{PLUS_ASSIGN, "+=", line 3, column 5}`; got != want {
+		t.Errorf("Token.String() = %s, want %s", got, want)
+	}
+}
+
+// benchmarkSource is a few hundred lines of typical code
+var benchmarkSource = strings.Repeat(`-- Pattern matching on tagged tables
+function area(shape)
+  return match shape {
+    Circle(r) => 3.14 * r * r,
+    Rect(w, h) => w * h,
+    _ => 0,
+  }
+end
+greeting = `+"`hello ${name} v${VERSION}!`"+`
+for i = 0, 10 do
+  counter += i // 2
+end
+`, 50)
+
+// BenchmarkLexerReset tokenizes with one lexer, as watch mode does
+func BenchmarkLexerReset(b *testing.B) {
+	b.ReportAllocs()
+	lexer := NewLexer("")
+	for i := 0; i < b.N; i++ {
+		lexer.Reset(benchmarkSource)
+		if _, err := lexer.Tokenize(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkTokenize tokenizes with a new lexer each time, whose token
+// slice is sized from the source up front
+func BenchmarkTokenize(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewLexer(benchmarkSource).Tokenize(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMultiCharacterOperators(t *testing.T) {
+	source := "a **= b ** c *= d * e //= f // g /= h / i ..= j .. k ... `x${y}`"
+	tokens, err := NewLexer(source).Tokenize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := []string{}
+	for _, token := range tokens {
+		if token.Type != TOKEN_IDENT {
+			types = append(types, token.Type.String())
+		}
+	}
+	want := "STAR_STAR_ASSIGN STAR_STAR STAR_ASSIGN STAR SLASH_SLASH_ASSIGN SLASH_SLASH SLASH_ASSIGN SLASH " +
+		"DOTDOT_ASSIGN DOTDOT DOTDOTDOT TEMPLATE_STRING EOF"
+	if got := strings.Join(types, " "); got != want {
+		t.Errorf("tokens are\n%s\nwant\n%s", got, want)
+	}
+	if last := tokens[len(tokens)-2]; last.Value != "`x${y}`" || last.Column != 58 {
+		t.Errorf("template string token is %v", last)
+	}
+}
+
+func TestQuestionOperators(t *testing.T) {
+	tokens, err := NewLexer("a?[b] ?? c?.d ?\n[e]").Tokenize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := []string{}
+	for _, token := range tokens {
+		if token.Type != TOKEN_IDENT {
+			types = append(types, token.Type.String())
+		}
+	}
+	// '?[' is one token only when the bracket follows straight away
+	want := "QUESTION_BRACKET RBRACKET DOUBLE_QUESTION QUESTION_DOT QUESTION LBRACKET RBRACKET EOF"
+	if got := strings.Join(types, " "); got != want {
+		t.Errorf("tokens are\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRadixLiterals(t *testing.T) {
+	ones := strings.Repeat("1", 64)
+	tests := []struct {
+		literal string
+		target  string
+		want    string
+	}{
+		{"0b1010", "5.4", "10"},
+		{"0B1010", "5.4", "10"},
+		{"0o17", "5.4", "15"},
+		{"0O17", "5.4", "15"},
+		{"0b" + ones, "5.4", "-1"},
+		{"0b" + ones, "5.1", "18446744073709551615"},
+		{"0o1777777777777777777777", "5.3", "-1"},
+	}
+	for _, test := range tests {
+		got, _, err := convertNumber(test.literal, test.target)
+		if err != nil || got != test.want {
+			t.Errorf("convertNumber(%q, %q) = %q, %v, want %q", test.literal, test.target, got, err, test.want)
+		}
+	}
+
+	errors := []struct {
+		source string
+		want   string
+	}{
+		{"x = 0b1" + ones + "\n", "line 1:5: binary literal too large: 0b1" + ones + " doesn't fit in 64 bits"},
+		{"x = 0o2777777777777777777777\n", "line 1:5: octal literal too large"},
+		{"x = 0b12\n", "invalid digit '2' in binary literal '0b12'"},
+		{"x = 0o\n", "octal literal '0o' has no digits"},
+	}
+	for _, test := range errors {
+		if _, err := Compile(test.source, Options{Target: "5.4"}); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Compile(%q) error = %v, want %q", test.source, err, test.want)
+		}
+	}
+}
+
+func TestNumberLiteralsPassThrough(t *testing.T) {
+	// Lua 5.3+ tells integers from floats by how they're written, so
+	// decimal and hex literals are kept as is
+	for _, literal := range []string{"1", "1.0", "1e3", "1E+2", ".5", "0xff", "0x1p4", "0x1.8P-2", "0x.8p1"} {
+		source := "print(" + literal + ")\n"
+		if got := compile(t, source, Options{Target: "5.4"}); got != source {
+			t.Errorf("Compile(%q) = %q, want it unchanged", source, got)
+		}
+	}
+
+	tokens, err := NewLexer("x = 0x1P-4+1").Tokenize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens[2].Type != TOKEN_NUMBER || tokens[2].Value != "0x1P-4" || tokens[3].Type != TOKEN_PLUS {
+		t.Errorf("0x1P-4+1 lexes as %v, want the hex float 0x1P-4 then +", tokens[2:])
+	}
+
+	errors := []struct {
+		source string
+		want   string
+	}{
+		{"x = 0x1p\n", "line 1:5: malformed hex float '0x1p' (missing exponent digits)"},
+		{"x = 0x1p+\n", "malformed hex float '0x1p+' (missing exponent digits)"},
+	}
+	for _, test := range errors {
+		if _, err := Compile(test.source, Options{}); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Compile(%q) error = %v, want %q", test.source, err, test.want)
+		}
+	}
+}
+
+func TestHexFloatLiterals(t *testing.T) {
+	tests := []struct {
+		source string
+		want   []string
+	}{
+		{"0x1p4", []string{"0x1p4"}},
+		{"0x1.8p1", []string{"0x1.8p1"}},
+		{"0xA.Bp-2", []string{"0xA.Bp-2"}},
+		{"0x.1 0xA.B", []string{"0x.1", "0xA.B"}},
+		// A dot without hex digits after it is concatenation
+		{"0x1..x", []string{"0x1", "..", "x"}},
+	}
+	for _, test := range tests {
+		tokens, err := NewLexer(test.source).Tokenize()
+		if err != nil {
+			t.Errorf("Tokenize(%q): %v", test.source, err)
+			continue
+		}
+		got := []string{}
+		for _, token := range tokens[:len(tokens)-1] {
+			got = append(got, token.Value)
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("Tokenize(%q) = %q, want %q", test.source, got, test.want)
+		}
+	}
+
+	for _, source := range []string{"x = 0x1.8p\n", "x = 0x1.8pz\n"} {
+		want := "line 1:5: malformed hex float '0x1.8p' (missing exponent digits)"
+		if _, err := Compile(source, Options{}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Compile(%q) error = %v, want %q", source, err, want)
+		}
+	}
+}
+
+func TestMultilineStringLeadingNewline(t *testing.T) {
+	// Lua drops a newline right after the opening bracket, so each
+	// output has the value Lua gives the source literal
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"[[\nhello]]", "[[hello]]"},
+		{"[==[\nhello]==]", "[==[hello]==]"},
+		{"[[\r\nhello]]", "[[hello]]"},
+		{"[[\n]]", "[[]]"},
+		{"[[hello\n]]", "[[hello\n]]"},
+		// "\nhello": the first newline is kept so Lua drops it again
+		{"[[\n\nhello]]", "[[\n\nhello]]"},
+	}
+	for _, test := range tests {
+		tokens, err := NewLexer(test.source).Tokenize()
+		if err != nil {
+			t.Errorf("Tokenize(%q): %v", test.source, err)
+			continue
+		}
+		if tokens[0].Type != TOKEN_STRING || tokens[0].Value != test.want {
+			t.Errorf("Tokenize(%q) = %v, want the string %q", test.source, tokens[0], test.want)
+		}
+	}
+}
+
+func TestUnterminatedString(t *testing.T) {
+	// Each error points at the opening quote on line 3 and says where
+	// the lexer gave up
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"a = 1\nb = 2\nc = \"abc\nd = 4\n", "line 3:5: unterminated string, still open at the end of line 3"},
+		{"a = 1\nb = 2\nc = 'abc", "line 3:5: unterminated string, still open at the end of the file (line 3)"},
+		{"a = 1\nb = 2\nc = \"abc\\\nmore\\\nx", "line 3:5: unterminated string, still open at the end of the file (line 5)"},
+		{"a = 1\nb = 2\nc = `abc\nmore\n\nend", "line 3:5: unterminated template string, still open at the end of the file (line 6)"},
+		{"a = 1\nb = 2\nc = [[abc\nmore\n", "line 3:5: unterminated multiline string, still open at the end of the file (line 4)"},
+	}
+	for _, test := range tests {
+		if _, err := NewLexer(test.source).Tokenize(); err == nil || err.Error() != test.want {
+			t.Errorf("Tokenize(%q) error = %v, want %q", test.source, err, test.want)
+		}
+	}
+}
+
+func TestStringContinuation(t *testing.T) {
+	// A backslash before a newline continues the string, and the lines
+	// after it are counted
+	tokens, err := NewLexer("y = \"abc\\\ndef\\z\n   ghi\" z").Tokenize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tokens[2].Value, "\"abc\\\ndef\\z\n   ghi\""; tokens[2].Type != TOKEN_STRING || got != want {
+		t.Errorf("string token is %q, want %q", got, want)
+	}
+	if tokens[3].Value != "z" || tokens[3].Line != 3 {
+		t.Errorf("token after the string is %v, want z on line 3", tokens[3])
+	}
+
+	// Lua 5.2+ understands both escapes, 5.1 only the backslash newline
+	tests := []struct {
+		source string
+		target string
+		want   string
+	}{
+		{"y = \"abc\\\ndef\"\n", "5.4", "local y = \"abc\\\ndef\"\n"},
+		{"y = \"abc\\\ndef\"\n", "5.1", "local y = \"abc\\\ndef\"\n"},
+		{"y = \"abc\\z\n     def\"\n", "5.4", "local y = \"abc\\z\n     def\"\n"},
+		{"y = \"abc\\z\n     def\"\n", "5.1", "local y = \"abcdef\"\n"},
+		{"y = 'a\\z \\z\n b'\n", "5.1", "local y = 'ab'\n"},
+		{"y = \"a\\\\zb\"\n", "5.1", "local y = \"a\\\\zb\"\n"},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{Target: test.target}); got != test.want {
+			t.Errorf("Compile(%q) for %s = %q, want %q", test.source, test.target, got, test.want)
+		}
+	}
+}
+
+func TestUnicodeEscapes(t *testing.T) {
+	tests := []struct {
+		source string
+		target string
+		want   string
+	}{
+		{`print("\u{e9}\u{1F600}")`, "5.4", `print("\u{e9}\u{1F600}")`},
+		{`print("\u{e9}\u{1F600}")`, "5.3", `print("\u{e9}\u{1F600}")`},
+		// Older versions get the UTF-8 bytes, as decimal escapes
+		{`print("\u{e9}\u{1F600}")`, "5.1", `print("\195\169\240\159\152\128")`},
+		{`print("\u{e9}")`, "5.2", `print("\195\169")`},
+		{`print('\u{48}i')`, "5.1", `print('\072i')`},
+		{`print("\\u{41}")`, "5.1", `print("\\u{41}")`},
+		// Template strings are spelled out by the compiler for every target
+		{"print(`\\u{41}${x}`)", "5.1", `print(("A" .. tostring(x)))`},
+	}
+	for _, test := range tests {
+		if got := compile(t, test.source, Options{Target: test.target}); got != test.want+"\n" {
+			t.Errorf("Compile(%q) for %s = %q, want %q", test.source, test.target, got, test.want)
+		}
+	}
+
+	errors := []struct {
+		source string
+		want   string
+	}{
+		{`x = "\u{110000}"`, `\u{110000} is not a Unicode code point`},
+		{`x = "\u{zz}"`, `missing hexadecimal digits in \u{...} escape`},
+		{`x = "\u41"`, `missing '{' in \u{...} escape`},
+		{`x = "\u{41"`, `missing '}' in \u{...} escape`},
+		{"x = `\\u{zz}`", `missing hexadecimal digits in \u{...} escape`},
+	}
+	for _, test := range errors {
+		if _, err := Compile(test.source, Options{}); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Compile(%q) error = %v, want %q", test.source, err, test.want)
+		}
+	}
+}
+
+func TestPrecisionWarning(t *testing.T) {
+	tests := []struct {
+		literal string
+		target  string
+		want    string
+	}{
+		{"9007199254740993", "5.1", "9007199254740993 can't be represented exactly on Lua 5.1 and becomes 9007199254740992"},
+		{"9007199254740993", "5.2", "9007199254740993 can't be represented exactly on Lua 5.2 and becomes 9007199254740992"},
+		{"9007199254740993", "luajit", "9007199254740993 can't be represented exactly on LuaJIT and becomes 9007199254740992"},
+		{"0x20000000000001", "5.1", "0x20000000000001 can't be represented exactly on Lua 5.1 and becomes 9007199254740992"},
+		{"0b" + strings.Repeat("1", 64), "5.1", "0b" + strings.Repeat("1", 64) + " can't be represented exactly on Lua 5.1 and becomes 18446744073709551616"},
+		// Lua 5.3+ has 64-bit integers
+		{"9007199254740993", "5.3", ""},
+		{"9007199254740993", "5.4", ""},
+		{"9007199254740992", "5.1", ""},
+		{"1.5e300", "5.1", ""},
+	}
+	for _, test := range tests {
+		if _, got, err := convertNumber(test.literal, test.target); err != nil || got != test.want {
+			t.Errorf("convertNumber(%q, %q) warning = %q, %v, want %q", test.literal, test.target, got, err, test.want)
+		}
+	}
+
+	// The compiler reports it where the literal is
+	warnings := []string{}
+	options := Options{Target: "5.1", Warn: func(w Warning) {
+		warnings = append(warnings, fmt.Sprintf("%d:%d:%s", w.Line, w.Column, w.Code))
+	}}
+	compile(t, "x = 1\ny = -9007199254740993\n", options)
+	if got, want := strings.Join(warnings, " "), "2:6:precision-loss"; got != want {
+		t.Errorf("warnings %q, want %q", got, want)
+	}
+}
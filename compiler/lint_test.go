@@ -0,0 +1,131 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// lintCodes compiles source with Lint set and returns its warnings as
+// "line:code"
+func lintCodes(t *testing.T, source string) string {
+	t.Helper()
+	codes := []string{}
+	options := Options{Lint: true, Warn: func(w Warning) {
+		codes = append(codes, fmt.Sprintf("%d:%s", w.Line, w.Code))
+	}}
+	if _, err := Compile(source, options); err != nil {
+		t.Fatalf("Compile(%q): %v", source, err)
+	}
+	return strings.Join(codes, " ")
+}
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"unused", "local x = 1\n", "1:unused"},
+		{"used", "local x = 1\nprint(x)\n", ""},
+		{"nil check", "if a ~= nil and a.b then print(1) end\n", "1:nil-check"},
+		{"nil check of another name", "if a ~= nil and b.c then print(1) end\n", ""},
+		{"shadow builtin", "local string = 'x'\nprint(string)\n", "1:shadow-builtin"},
+		{"global shadows local", "local x = 1\nprint(x)\nglobal x = 2\n", "3:global-shadows-local"},
+		{"global", "global x = 2\n", ""},
+		{"float step", "for i = 0, 1, 0.1 do print(i) end\n", "1:float-step"},
+		{"integer step", "for i = 0, 10, 2 do print(i) end\n", ""},
+		{"shadow self", "function M:f()\n  local g = function(self) return self end\n  return g\nend\n", "2:shadow-self"},
+		{"disabled", "local x = 1 -- tokimun:disable=unused\n", ""},
+		{"disabled other code", "local x = 1 -- tokimun:disable=nil-check\n", "1:unused"},
+		{"truncated call", "function pair() return 1, 2 end\nprint(pair(), 3)\n", "2:truncated-call"},
+		{"last argument call", "function pair() return 1, 2 end\nprint(3, pair())\n", ""},
+		{"truncated builtin", "print(pcall(f), 1)\n", "1:truncated-call"},
+		{"hidden builtin", "local pcall = g\nprint(pcall(f), 1)\n", "1:shadow-builtin"},
+		{"single value call", "function one() return 1 end\nprint(one(), 2)\n", ""},
+		// Only functions declared before the call are known
+		{"call before declaration", "print(pair(), 3)\nfunction pair() return 1, 2 end\n", "2:unused"},
+	}
+	for _, test := range tests {
+		if got := lintCodes(t, test.source); got != test.want {
+			t.Errorf("%s: warnings %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLintAssignInCondition(t *testing.T) {
+	// The lint explains the syntax error, which is still reported
+	for _, source := range []string{"if a = b then end\n", "while a = b do end\n"} {
+		codes := []string{}
+		options := Options{Lint: true, Warn: func(w Warning) { codes = append(codes, w.Code) }}
+		if _, err := Compile(source, options); err == nil {
+			t.Errorf("Compile(%q) succeeded, want a syntax error", source)
+		}
+		if strings.Join(codes, " ") != lintAssignInCondition {
+			t.Errorf("Compile(%q) warned %v, want %s", source, codes, lintAssignInCondition)
+		}
+	}
+
+	// Without lint it's the same error
+	if _, err := Compile("if a = b then end\n", Options{}); err == nil {
+		t.Error("if a = b compiled without lint")
+	}
+}
+
+func TestAmbiguousCall(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+		output string
+	}{
+		// Lua reads this as a = b(f or g)(), which is kept
+		{"paren on the next line", "a = b\n(f or g)()\n", "2:ambiguous-call", "local a = b(f or g)()\n"},
+		{"semicolon", "a = b;\n(f or g)()\n", "", "local a = b\n;(f or g)()\n"},
+		{"semicolon on the same line", "a = b; (f or g)()\n", "", "local a = b\n;(f or g)()\n"},
+		{"call on the same line", "local a = b (c)\n", "", "local a = b(c)\n"},
+		{"string on the next line", "a = f\n\"str\":len()\n", "", "local a = f\n;(\"str\"):len()\n"},
+		{"statements on one line", "x = 1 y = 2\n", "", "local x = 1\nlocal y = 2\n"},
+	}
+	for _, test := range tests {
+		// It's a warning, not a lint, so it's reported without Lint
+		codes := []string{}
+		options := Options{Warn: func(w Warning) {
+			codes = append(codes, fmt.Sprintf("%d:%s", w.Line, w.Code))
+		}}
+		if got := compile(t, test.source, options); got != test.output {
+			t.Errorf("%s: Compile(%q) = %q, want %q", test.name, test.source, got, test.output)
+		}
+		if got := strings.Join(codes, " "); got != test.want {
+			t.Errorf("%s: warnings %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMethodClosuresKeepSelf(t *testing.T) {
+	// A function in a method without a self parameter closes over the
+	// method's self
+	source := "function Obj:init()\n  self.handler = function() return self.value end\n  local each = function(x) print(self, x) end\n  return each\nend\n"
+	want := "function Obj:init()\n  self.handler = function()\n    return self.value\n  end\n  local each = function(x)\n    print(self, x)\n  end\n  return each\nend\n"
+	if got := compile(t, source, Options{}); got != want {
+		t.Errorf("Compile(%q) =\n%s\nwant\n%s", source, got, want)
+	}
+	if got := lintCodes(t, source); got != "" {
+		t.Errorf("closures using the method's self warned %q", got)
+	}
+
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"nested in a method", "function M:f()\n  local g = function()\n    local h = function(self) return self end\n    return h\n  end\n  return g\nend\n", "3:shadow-self"},
+		{"in a plain function", "function M.f()\n  local h = function(self) return self end\n  return h\nend\n", ""},
+		{"at the top level", "local k = function(self) return self end\nprint(k)\n", ""},
+	}
+	for _, test := range tests {
+		if got := lintCodes(t, test.source); got != test.want {
+			t.Errorf("%s: warnings %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package compiler
+
+// Metadata lists what a compiled file defines and depends on, for
+// editors and other tools that want to find definitions without a
+// language server
+type Metadata struct {
+	Functions map[string]Symbol `json:"functions"` // Top-level functions, by full name like M.foo
+	Globals   map[string]Symbol `json:"globals"`   // Names declared with `global`
+	Requires  []string          `json:"requires"`  // Modules loaded with require "name", as Lua sees them
+}
+
+// Symbol is where a name is defined
+type Symbol struct {
+	Line   int  `json:"line"`
+	Column int  `json:"column"`
+	Local  bool `json:"local,omitempty"`
+}
+
+// Metadata returns what the compiled code defines, once CompileTo has run
+func (c *Compiler) Metadata() Metadata {
+	return c.metadata
+}
+
+func (c *Compiler) recordFunction(name string, token Token, local bool) {
+	if len(c.functions) == 0 {
+		c.metadata.Functions[name] = Symbol{Line: token.Line, Column: token.Column, Local: local}
+	}
+}
+
+func (c *Compiler) recordGlobal(token Token) {
+	if _, ok := c.metadata.Globals[token.Value]; !ok {
+		c.metadata.Globals[token.Value] = Symbol{Line: token.Line, Column: token.Column}
+	}
+}
+
+func (c *Compiler) recordRequire(module string) {
+	for _, m := range c.metadata.Requires {
+		if m == module {
+			return
+		}
+	}
+	c.metadata.Requires = append(c.metadata.Requires, module)
+}
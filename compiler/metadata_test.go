@@ -0,0 +1,49 @@
+package compiler
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestMetadataGolden compares the metadata of testdata/metadata.tkm, as
+// --emit-metadata writes it, with testdata/metadata.json. Run with
+// -update after an intended change.
+func TestMetadataGolden(t *testing.T) {
+	source, err := os.ReadFile("testdata/metadata.tkm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := NewLexer(string(source)).Tokenize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Requires are only tracked with a resolver, which the CLI always sets
+	options := Options{ResolveRequire: func(path string) (string, error) {
+		return "app." + strings.TrimPrefix(path, "./"), nil
+	}}
+	c := NewCompiler(tokens, options)
+	if err := c.CompileTo(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.MarshalIndent(c.Metadata(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	if *update {
+		if err := os.WriteFile("testdata/metadata.json", got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile("testdata/metadata.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("metadata of testdata/metadata.tkm is\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,71 @@
+package compiler
+
+// Lua keeps every value of a call only when it ends an argument list;
+// anywhere else just the first value is passed on, so in print(f(), g())
+// the extra values of f are dropped. The compiler knows which functions
+// return several values when they're builtins like pcall, or functions of
+// the file declared before the call that return lists like `return a, b`.
+
+// multiReturnBuiltins are the standard functions that return several values
+var multiReturnBuiltins = map[string]bool{
+	"pcall": true, "xpcall": true, "select": true, "next": true,
+	"unpack": true, "table.unpack": true, "coroutine.resume": true,
+	"string.find": true, "string.gsub": true, "math.modf": true, "math.frexp": true,
+}
+
+// multiReturnCall returns the name of the function called by the
+// expression starting at token i, and the index just past the call, when
+// the expression is only that call and the function returns several
+// values. Otherwise the name is empty.
+func (c *Compiler) multiReturnCall(i int) (string, int) {
+	if c.tokens[i].Type != TOKEN_IDENT {
+		return "", i
+	}
+	root := c.tokens[i].Value
+	name := root
+	j := i + 1
+	for (c.tokens[j].Type == TOKEN_DOT || c.tokens[j].Type == TOKEN_COLON) && c.tokens[j+1].Type == TOKEN_IDENT {
+		name += c.tokens[j].Value + c.tokens[j+1].Value
+		j += 2
+	}
+	if c.tokens[j].Type != TOKEN_LPAREN {
+		return "", i
+	}
+	if !c.multiReturns[name] && (!multiReturnBuiltins[name] || c.isVariableDeclared(root)) {
+		return "", i
+	}
+
+	depth := 0
+	for ; j < len(c.tokens) && c.tokens[j].Type != TOKEN_EOF; j++ {
+		switch c.tokens[j].Type {
+		case TOKEN_LPAREN, TOKEN_LBRACE, TOKEN_LBRACKET:
+			depth++
+		case TOKEN_RPAREN, TOKEN_RBRACE, TOKEN_RBRACKET:
+			depth--
+			if depth == 0 {
+				return name, j + 1
+			}
+		}
+	}
+	return "", i
+}
+
+// returnsMany reports whether the values between tokens from and to of a
+// return are several: a list, or a call that returns several itself
+func (c *Compiler) returnsMany(from, to int) bool {
+	depth := 0
+	for i := from; i < to; i++ {
+		switch c.tokens[i].Type {
+		case TOKEN_LPAREN, TOKEN_LBRACE, TOKEN_LBRACKET:
+			depth++
+		case TOKEN_RPAREN, TOKEN_RBRACE, TOKEN_RBRACKET:
+			depth--
+		case TOKEN_COMMA:
+			if depth == 0 {
+				return true
+			}
+		}
+	}
+	name, end := c.multiReturnCall(from)
+	return name != "" && end == to
+}
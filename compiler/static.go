@@ -0,0 +1,347 @@
+package compiler
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// isStaticAssert reports whether the statement is static_assert(...),
+// which is contextual so a function of that name can still be called
+func (c *Compiler) isStaticAssert() bool {
+	return c.peek().Type == TOKEN_IDENT && c.peek().Value == "static_assert" &&
+		c.peekNext().Type == TOKEN_LPAREN && !c.isVariableDeclared("static_assert")
+}
+
+// staticAssert checks static_assert(condition, "message") while
+// compiling. The condition has to be made of literals, const enum
+// members and operators; nothing is written to the output.
+func (c *Compiler) staticAssert() error {
+	assertToken := c.advance()
+	c.advance() // consume '('
+
+	condition, err := c.constExpression(0)
+	if err != nil {
+		return err
+	}
+
+	message := ""
+	if c.peek().Type == TOKEN_COMMA {
+		c.advance()
+		if c.peek().Type != TOKEN_STRING {
+			return c.errorf(c.peek(), "static_assert message must be a string literal")
+		}
+		message = luaStringValue(c.advance().Value)
+	}
+	if c.peek().Type != TOKEN_RPAREN {
+		return c.errorf(c.peek(), "expected ')' after static_assert")
+	}
+	c.advance()
+
+	if !constTruthy(condition) {
+		if message == "" {
+			return c.errorf(assertToken, "static assertion failed")
+		}
+		return c.errorf(assertToken, "static assertion failed: %s", message)
+	}
+	return nil
+}
+
+// constPrecedence gives the binding power of each binary operator in
+// constant expressions, matching Lua's
+var constPrecedence = map[TokenType]int{
+	TOKEN_OR:  1,
+	TOKEN_AND: 2,
+	TOKEN_EQ:  3, TOKEN_NEQ: 3, TOKEN_LT: 3, TOKEN_GT: 3, TOKEN_LE: 3, TOKEN_GE: 3,
+	TOKEN_DOTDOT: 4,
+	TOKEN_PLUS:   5, TOKEN_MINUS: 5,
+	TOKEN_STAR: 6, TOKEN_SLASH: 6, TOKEN_SLASH_SLASH: 6, TOKEN_PERCENT: 6,
+	TOKEN_CARET: 8, TOKEN_STAR_STAR: 8,
+}
+
+// unaryPrecedence is between the arithmetic operators and ^
+const unaryPrecedence = 7
+
+// constExpression evaluates an expression of operators that bind tighter
+// than minPrecedence. Numbers are float64, strings string, booleans bool
+// and nil is nil.
+func (c *Compiler) constExpression(minPrecedence int) (interface{}, error) {
+	left, err := c.constOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := c.peek()
+		precedence, ok := constPrecedence[op.Type]
+		if !ok || precedence <= minPrecedence {
+			return left, nil
+		}
+		c.advance()
+
+		// .. and ^ group to the right
+		next := precedence
+		if op.Type == TOKEN_DOTDOT || op.Type == TOKEN_CARET || op.Type == TOKEN_STAR_STAR {
+			next--
+		}
+		right, err := c.constExpression(next)
+		if err != nil {
+			return nil, err
+		}
+		if left, err = constBinary(op, left, right); err != nil {
+			return nil, c.errorf(op, "%v", err)
+		}
+	}
+}
+
+func (c *Compiler) constOperand() (interface{}, error) {
+	token := c.peek()
+	switch token.Type {
+	case TOKEN_NUMBER:
+		c.advance()
+		converted, _, err := convertNumber(token.Value, "")
+		if err != nil {
+			return nil, c.errorf(token, "%v", err)
+		}
+		if n, err := strconv.ParseInt(converted, 0, 64); err == nil {
+			return float64(n), nil
+		}
+		f, err := strconv.ParseFloat(converted, 64)
+		if err != nil {
+			return nil, c.errorf(token, "invalid number %s", token.Value)
+		}
+		return f, nil
+	case TOKEN_STRING:
+		c.advance()
+		return luaStringValue(token.Value), nil
+	case TOKEN_TRUE, TOKEN_FALSE:
+		c.advance()
+		return token.Type == TOKEN_TRUE, nil
+	case TOKEN_NIL:
+		c.advance()
+		return nil, nil
+	case TOKEN_LPAREN:
+		c.advance()
+		value, err := c.constExpression(0)
+		if err != nil {
+			return nil, err
+		}
+		if c.peek().Type != TOKEN_RPAREN {
+			return nil, c.errorf(c.peek(), "expected ')'")
+		}
+		c.advance()
+		return value, nil
+	case TOKEN_NOT, TOKEN_MINUS, TOKEN_HASH:
+		c.advance()
+		value, err := c.constExpression(unaryPrecedence)
+		if err != nil {
+			return nil, err
+		}
+		switch v := value.(type) {
+		case float64:
+			if token.Type == TOKEN_MINUS {
+				return -v, nil
+			}
+		case string:
+			if token.Type == TOKEN_HASH {
+				return float64(len(v)), nil
+			}
+		}
+		if token.Type == TOKEN_NOT {
+			return !constTruthy(value), nil
+		}
+		return nil, c.errorf(token, "cannot apply '%s' to %s", token.Value, constTypeName(value))
+	case TOKEN_IDENT:
+		if _, ok := specialFloats[token.Value]; ok && !c.isVariableDeclared(token.Value) {
+			c.advance()
+			if token.Value == "inf" {
+				return math.Inf(1), nil
+			}
+			return math.NaN(), nil
+		}
+		// A const enum member, whose value is a literal
+		v := c.lookupVariable(token.Value)
+		if v != nil && v.enum != nil && c.peekNext().Type == TOKEN_DOT && c.peekAt(2).Type == TOKEN_IDENT {
+			c.advance()
+			c.advance()
+			member := c.advance()
+			value, ok := v.enum[member.Value]
+			if !ok {
+				return nil, c.errorf(member, "enum '%s' has no member '%s'", token.Value, member.Value)
+			}
+			tokens, _ := NewLexer(value).Tokenize()
+			return NewCompiler(tokens, Options{}).constExpression(0)
+		}
+	}
+	return nil, c.errorf(token, "static_assert requires a constant condition, but '%s' isn't known at compile time", token.Value)
+}
+
+// constBinary applies a binary operator to two constants
+func constBinary(op Token, left, right interface{}) (interface{}, error) {
+	switch op.Type {
+	case TOKEN_AND:
+		if !constTruthy(left) {
+			return left, nil
+		}
+		return right, nil
+	case TOKEN_OR:
+		if constTruthy(left) {
+			return left, nil
+		}
+		return right, nil
+	case TOKEN_EQ:
+		return left == right, nil
+	case TOKEN_NEQ:
+		return left != right, nil
+	case TOKEN_DOTDOT:
+		l, lok := constConcatString(left)
+		r, rok := constConcatString(right)
+		if lok && rok {
+			return l + r, nil
+		}
+	}
+
+	if l, ok := left.(string); ok {
+		if r, ok := right.(string); ok {
+			switch op.Type {
+			case TOKEN_LT:
+				return l < r, nil
+			case TOKEN_GT:
+				return l > r, nil
+			case TOKEN_LE:
+				return l <= r, nil
+			case TOKEN_GE:
+				return l >= r, nil
+			}
+		}
+	}
+
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("cannot apply '%s' to %s and %s", op.Value, constTypeName(left), constTypeName(right))
+	}
+	switch op.Type {
+	case TOKEN_LT:
+		return l < r, nil
+	case TOKEN_GT:
+		return l > r, nil
+	case TOKEN_LE:
+		return l <= r, nil
+	case TOKEN_GE:
+		return l >= r, nil
+	case TOKEN_PLUS:
+		return l + r, nil
+	case TOKEN_MINUS:
+		return l - r, nil
+	case TOKEN_STAR:
+		return l * r, nil
+	case TOKEN_SLASH:
+		return l / r, nil
+	case TOKEN_SLASH_SLASH:
+		return math.Floor(l / r), nil
+	case TOKEN_PERCENT:
+		// Lua's modulo takes the sign of the divisor
+		return l - math.Floor(l/r)*r, nil
+	default: // ^ and **
+		return math.Pow(l, r), nil
+	}
+}
+
+// constConcatString is a constant as .. sees it: numbers become strings
+func constConcatString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+			return strconv.FormatFloat(v, 'f', -1, 64), true
+		}
+		return strconv.FormatFloat(v, 'g', 14, 64), true
+	}
+	return "", false
+}
+
+func constTruthy(value interface{}) bool {
+	return value != nil && value != false
+}
+
+func constTypeName(value interface{}) string {
+	switch value.(type) {
+	case float64:
+		return "a number"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	}
+	return "nil"
+}
+
+// luaStringValue returns the text of a string literal, with the escapes
+// of quoted strings applied
+func luaStringValue(literal string) string {
+	if strings.HasPrefix(literal, "[") {
+		open := strings.IndexByte(literal[1:], '[') + 2
+		content := literal[open : len(literal)-open]
+		// A newline right after the opening bracket is skipped
+		return strings.TrimPrefix(strings.TrimPrefix(content, "\r"), "\n")
+	}
+
+	content := literal[1 : len(literal)-1]
+	var result strings.Builder
+	for i := 0; i < len(content); i++ {
+		if content[i] != '\\' || i+1 == len(content) {
+			result.WriteByte(content[i])
+			continue
+		}
+		i++
+		switch ch := content[i]; ch {
+		case 'n':
+			result.WriteByte('\n')
+		case 't':
+			result.WriteByte('\t')
+		case 'r':
+			result.WriteByte('\r')
+		case 'a':
+			result.WriteByte('\a')
+		case 'b':
+			result.WriteByte('\b')
+		case 'f':
+			result.WriteByte('\f')
+		case 'v':
+			result.WriteByte('\v')
+		case 'x':
+			if i+3 > len(content) {
+				break
+			}
+			if n, err := strconv.ParseUint(content[i+1:i+3], 16, 8); err == nil {
+				result.WriteByte(byte(n))
+				i += 2
+			}
+		case 'u':
+			end := i + strings.IndexByte(content[i:], '}')
+			n, _ := strconv.ParseUint(content[i+2:end], 16, 32)
+			result.WriteRune(rune(n))
+			i = end
+		case 'z':
+			for i+1 < len(content) && strings.IndexByte(" \t\r\n", content[i+1]) >= 0 {
+				i++
+			}
+		default:
+			if ch >= '0' && ch <= '9' {
+				end := i
+				for end < len(content) && end < i+3 && content[end] >= '0' && content[end] <= '9' {
+					end++
+				}
+				n, _ := strconv.Atoi(content[i:end])
+				result.WriteByte(byte(n))
+				i = end - 1
+			} else {
+				result.WriteByte(ch) // \\, \", \' and a newline
+			}
+		}
+	}
+	return result.String()
+}
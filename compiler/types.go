@@ -0,0 +1,265 @@
+package compiler
+
+import "strings"
+
+// Type annotations follow a parameter or the parameter list of a function:
+//
+//	function add(a: number, b: number?): number
+//	function each(t: {[string]: Item}, f: function(Item): boolean): (number, string)
+//
+// They aren't checked, only parsed and left out of the output. Each is
+// returned spelled as EmmyLua writes it, for Options.Annotations.
+
+// typeAnnotation parses the type after a ':' as a node of the syntax tree
+func (c *Compiler) typeAnnotation() (string, error) {
+	defer c.node("Type")()
+	spelling, err := c.typeExpression()
+	c.setNode("Type", spelling)
+	return spelling, err
+}
+
+// returnTypes parses the types after the ':' that follows the parameter
+// list. Several are written in parentheses: (number, string).
+func (c *Compiler) returnTypes() ([]string, error) {
+	defer c.node("ReturnTypes")()
+	types, err := c.typeResults()
+	c.setNode("ReturnTypes", strings.Join(types, ", "))
+	return types, err
+}
+
+func (c *Compiler) typeResults() ([]string, error) {
+	start := c.current
+	if c.peek().Type != TOKEN_LPAREN {
+		spelling, err := c.typeExpression()
+		return []string{spelling}, err
+	}
+	c.advance()
+	types, err := c.typeList(TOKEN_RPAREN)
+	if err != nil {
+		return nil, err
+	}
+	c.advance()
+
+	// A single type in parentheses may go on, as in (A | B)?
+	if len(types) == 1 && (c.peek().Type == TOKEN_QUESTION || c.peek().Type == TOKEN_PIPE) {
+		c.current = start
+		spelling, err := c.typeExpression()
+		return []string{spelling}, err
+	}
+	return types, nil
+}
+
+// typeList parses types separated by commas up to closing, which it
+// leaves for the caller
+func (c *Compiler) typeList(closing TokenType) ([]string, error) {
+	types := []string{}
+	for c.peek().Type != closing {
+		spelling, err := c.typeExpression()
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, spelling)
+		if c.peek().Type != TOKEN_COMMA {
+			break
+		}
+		c.advance()
+	}
+	if c.peek().Type != closing {
+		return nil, c.errorf(c.peek(), "expected ',' or '%s' in type", tokenText[closing])
+	}
+	return types, nil
+}
+
+// typeExpression parses a union of types, A | B
+func (c *Compiler) typeExpression() (string, error) {
+	members := []string{}
+	for {
+		spelling, err := c.typePrimary()
+		if err != nil {
+			return "", err
+		}
+		for c.peek().Type == TOKEN_QUESTION {
+			c.advance()
+			spelling += "?"
+		}
+		members = append(members, spelling)
+		if c.peek().Type != TOKEN_PIPE {
+			return strings.Join(members, "|"), nil
+		}
+		c.advance()
+	}
+}
+
+// tokenText is how the tokens that close a type list are written
+var tokenText = map[TokenType]string{
+	TOKEN_RPAREN:   ")",
+	TOKEN_RBRACE:   "}",
+	TOKEN_RBRACKET: "]",
+	TOKEN_GT:       ">",
+}
+
+func (c *Compiler) typePrimary() (string, error) {
+	token := c.peek()
+	switch token.Type {
+	case TOKEN_IDENT:
+		// A name, maybe qualified like mod.Type and with parameters
+		// like Map<string, number>
+		name := c.advance().Value
+		for c.peek().Type == TOKEN_DOT && c.peekNext().Type == TOKEN_IDENT {
+			c.advance()
+			name += "." + c.advance().Value
+		}
+		if c.peek().Type != TOKEN_LT {
+			return name, nil
+		}
+		c.advance()
+		params, err := c.typeList(TOKEN_GT)
+		if err != nil {
+			return "", err
+		}
+		c.advance()
+		return name + "<" + strings.Join(params, ", ") + ">", nil
+
+	case TOKEN_NIL, TOKEN_TRUE, TOKEN_FALSE, TOKEN_STRING:
+		return c.advance().Value, nil
+
+	case TOKEN_DOTDOTDOT:
+		// Only in the parameters of function types
+		return c.advance().Value, nil
+
+	case TOKEN_LPAREN:
+		c.advance()
+		spelling, err := c.typeExpression()
+		if err != nil {
+			return "", err
+		}
+		if c.peek().Type != TOKEN_RPAREN {
+			return "", c.errorf(c.peek(), "expected ')' in type")
+		}
+		c.advance()
+		return "(" + spelling + ")", nil
+
+	case TOKEN_FUNCTION:
+		return c.functionType()
+
+	case TOKEN_LBRACE:
+		return c.tableType()
+	}
+	return "", c.errorf(token, "expected a type, got '%s'", token.Value)
+}
+
+// functionType parses function(a: number, string): boolean, whose
+// parameters may be named
+func (c *Compiler) functionType() (string, error) {
+	c.advance() // consume 'function'
+	if c.peek().Type != TOKEN_LPAREN {
+		return "", c.errorf(c.peek(), "expected '(' after 'function' in type")
+	}
+	c.advance()
+
+	params := []string{}
+	for c.peek().Type != TOKEN_RPAREN {
+		name := ""
+		if (c.peek().Type == TOKEN_IDENT || c.peek().Type == TOKEN_DOTDOTDOT) && c.peekNext().Type == TOKEN_COLON {
+			name = c.advance().Value + ": "
+			c.advance()
+		}
+		spelling, err := c.typeExpression()
+		if err != nil {
+			return "", err
+		}
+		if name == "" && spelling != "..." {
+			name = "_: "
+		}
+		params = append(params, name+spelling)
+		if c.peek().Type != TOKEN_COMMA {
+			break
+		}
+		c.advance()
+	}
+	if c.peek().Type != TOKEN_RPAREN {
+		return "", c.errorf(c.peek(), "expected ',' or ')' in function type")
+	}
+	c.advance()
+
+	spelling := "fun(" + strings.Join(params, ", ") + ")"
+	if c.peek().Type == TOKEN_COLON {
+		c.advance()
+		results, err := c.typeResults()
+		if err != nil {
+			return "", err
+		}
+		spelling += ": " + strings.Join(results, ", ")
+	}
+	return spelling, nil
+}
+
+// tableType parses the table types
+//
+//	{number}                 an array, number[]
+//	{[string]: number}       a map, table<string, number>
+//	{x: number, y: number}   a record
+//	{}                       any table
+func (c *Compiler) tableType() (string, error) {
+	c.advance() // consume '{'
+	switch {
+	case c.peek().Type == TOKEN_RBRACE:
+		c.advance()
+		return "table", nil
+
+	case c.peek().Type == TOKEN_LBRACKET:
+		c.advance()
+		key, err := c.typeExpression()
+		if err != nil {
+			return "", err
+		}
+		if c.peek().Type != TOKEN_RBRACKET || c.peekNext().Type != TOKEN_COLON {
+			return "", c.errorf(c.peek(), "expected ']:' after the key type")
+		}
+		c.advance()
+		c.advance()
+		value, err := c.typeExpression()
+		if err != nil {
+			return "", err
+		}
+		if c.peek().Type != TOKEN_RBRACE {
+			return "", c.errorf(c.peek(), "expected '}' after the value type")
+		}
+		c.advance()
+		return "table<" + key + ", " + value + ">", nil
+
+	case c.peek().Type == TOKEN_IDENT && c.peekNext().Type == TOKEN_COLON:
+		fields := []string{}
+		for c.peek().Type == TOKEN_IDENT && c.peekNext().Type == TOKEN_COLON {
+			name := c.advance().Value
+			c.advance()
+			spelling, err := c.typeExpression()
+			if err != nil {
+				return "", err
+			}
+			fields = append(fields, name+": "+spelling)
+			if c.peek().Type != TOKEN_COMMA {
+				break
+			}
+			c.advance()
+		}
+		if c.peek().Type != TOKEN_RBRACE {
+			return "", c.errorf(c.peek(), "expected '}' after the fields of the table type")
+		}
+		c.advance()
+		return "{" + strings.Join(fields, ", ") + "}", nil
+	}
+
+	element, err := c.typeExpression()
+	if err != nil {
+		return "", err
+	}
+	if c.peek().Type != TOKEN_RBRACE {
+		return "", c.errorf(c.peek(), "expected '}' after the element type")
+	}
+	c.advance()
+	if strings.ContainsAny(element, "|?") {
+		element = "(" + element + ")"
+	}
+	return element + "[]", nil
+}
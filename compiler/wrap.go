@@ -0,0 +1,146 @@
+package compiler
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// wrapOperators are the binary operators a long line may be broken
+// after. The output puts a space on both sides of each of them.
+var wrapOperators = map[string]bool{
+	"..": true, "+": true, "-": true, "*": true, "/": true, "//": true, "%": true, "^": true,
+	"==": true, "~=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"and": true, "or": true, "&": true, "|": true, "~": true, "<<": true, ">>": true,
+}
+
+// wrapLines breaks the lines of output longer than width after a comma
+// or binary operator, indenting the continuation lines one level deeper
+// than the line they came from. Strings and comments are never broken,
+// and a line with nowhere to break is left long.
+func wrapLines(output string, width int, indent string) string {
+	var result strings.Builder
+	closing := "" // The ]==] that ends the long string or comment we're in
+	for i, line := range strings.Split(output, "\n") {
+		if i > 0 {
+			result.WriteByte('\n')
+		}
+
+		// Line markers go before the indentation, see alignLines
+		for strings.IndexByte(line, lineMarker) == 0 {
+			end := strings.IndexByte(line[1:], lineMarker) + 2
+			result.WriteString(line[:end])
+			line = line[end:]
+		}
+
+		var breaks []int
+		breaks, closing = wrapPoints(line, closing)
+		if utf8.RuneCountInString(line) <= width || len(breaks) == 0 {
+			result.WriteString(line)
+			continue
+		}
+
+		continuation := line[:len(line)-len(strings.TrimLeft(line, " \t"))] + indent
+		from := 0
+		for len(breaks) > 0 && utf8.RuneCountInString(line[from:]) > width {
+			// The last break that fits, or the first one if none does
+			at := breaks[0]
+			for _, b := range breaks[1:] {
+				if utf8.RuneCountInString(line[from:b]) > width {
+					break
+				}
+				at = b
+			}
+			result.WriteString(strings.TrimRight(line[from:at], " ") + "\n" + continuation)
+			for len(breaks) > 0 && breaks[0] <= at {
+				breaks = breaks[1:]
+			}
+			// Later lines are measured with the continuation indent
+			line = continuation + line[at:]
+			for j := range breaks {
+				breaks[j] += len(continuation) - at
+			}
+			from = len(continuation)
+		}
+		result.WriteString(line[from:])
+	}
+	return result.String()
+}
+
+// wrapPoints returns the offsets in line just after a ", " or a spaced
+// binary operator that are outside of strings and comments, along with
+// the closing bracket of a long string or comment left open at its end.
+// closing is that of the previous line.
+func wrapPoints(line string, closing string) ([]int, string) {
+	breaks := []int{}
+	i := 0
+	if closing != "" {
+		end := strings.Index(line, closing)
+		if end < 0 {
+			return breaks, closing
+		}
+		i = end + len(closing)
+	}
+
+	for i < len(line) {
+		switch ch := line[i]; {
+		case ch == '"' || ch == '\'':
+			for i++; i < len(line) && line[i] != ch; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+			i++
+		case ch == '-' && strings.HasPrefix(line[i:], "--"):
+			if level, ok := longBracket(line[i+2:]); ok {
+				closing = "]" + strings.Repeat("=", level) + "]"
+				end := strings.Index(line[i+level+4:], closing)
+				if end < 0 {
+					return breaks, closing
+				}
+				i += level + 4 + end + len(closing)
+				closing = ""
+				continue
+			}
+			return breaks, ""
+		case ch == '[':
+			if level, ok := longBracket(line[i:]); ok {
+				closing = "]" + strings.Repeat("=", level) + "]"
+				end := strings.Index(line[i+level+2:], closing)
+				if end < 0 {
+					return breaks, closing
+				}
+				i += level + 2 + end + len(closing)
+				closing = ""
+				continue
+			}
+			i++
+		case ch == ',' && i+1 < len(line) && line[i+1] == ' ':
+			breaks = append(breaks, i+2)
+			i += 2
+		case ch == ' ':
+			// An operator with a space on both sides
+			end := strings.IndexByte(line[i+1:], ' ')
+			if end > 0 && wrapOperators[line[i+1:i+1+end]] {
+				breaks = append(breaks, i+end+2)
+				i += end + 1
+				continue
+			}
+			i++
+		default:
+			i++
+		}
+	}
+	return breaks, ""
+}
+
+// longBracket reports whether s starts with [[ or [=...=[, and its level
+func longBracket(s string) (int, bool) {
+	if !strings.HasPrefix(s, "[") {
+		return 0, false
+	}
+	level := 0
+	for 1+level < len(s) && s[1+level] == '=' {
+		level++
+	}
+	return level, 1+level < len(s) && s[1+level] == '['
+}
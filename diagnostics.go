@@ -0,0 +1,80 @@
+//go:build !wasm
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/micr0/tokimun/compiler"
+)
+
+// errorFormats are the accepted --error-format values
+var errorFormats = []string{"gnu", "json"}
+
+// fileError is a compile error in a file
+type fileError struct {
+	path string
+	*compiler.CompileError
+}
+
+func (e *fileError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.path, e.Line, e.Column, e.Message)
+}
+
+// sourceError adds the file name to a compile error
+func sourceError(inputPath string, err error) error {
+	var compileErr *compiler.CompileError
+	if errors.As(err, &compileErr) {
+		return &fileError{path: inputPath, CompileError: compileErr}
+	}
+	return fmt.Errorf("%s: %v", inputPath, err)
+}
+
+// diagnostic is an error or warning as printed by --error-format=json
+type diagnostic struct {
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Code     string `json:"code,omitempty"`
+	Message  string `json:"message"`
+}
+
+// reportError prints err to stderr. Compile errors are printed as
+// file:line:col: error: message, which editors can jump to.
+func reportError(err error, opts CompileOptions) {
+	d := diagnostic{Severity: "error", Message: err.Error()}
+	var fileErr *fileError
+	if errors.As(err, &fileErr) {
+		d = diagnostic{File: fileErr.path, Line: fileErr.Line, Column: fileErr.Column, Severity: "error", Message: fileErr.Message}
+	}
+	printDiagnostic(d, opts)
+}
+
+func reportWarning(inputPath string, w compiler.Warning, opts CompileOptions) {
+	if opts.Quiet >= 2 {
+		return
+	}
+	printDiagnostic(diagnostic{File: inputPath, Line: w.Line, Column: w.Column, Severity: "warning", Code: w.Code, Message: w.Message}, opts)
+}
+
+func printDiagnostic(d diagnostic, opts CompileOptions) {
+	if opts.ErrorFormat == "json" {
+		data, _ := json.Marshal(d)
+		fmt.Fprintln(os.Stderr, string(data))
+		return
+	}
+
+	message := d.Message
+	if d.Code != "" {
+		message += " [" + d.Code + "]"
+	}
+	if d.File == "" {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", d.Severity, message)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s:%d:%d: %s: %s\n", d.File, d.Line, d.Column, d.Severity, message)
+}
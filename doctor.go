@@ -0,0 +1,167 @@
+//go:build !wasm
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// doctorReport is what `tokimun doctor` finds out about the environment
+type doctorReport struct {
+	Version       string              `json:"version"`
+	Interpreters  []doctorInterpreter `json:"interpreters"`
+	Manifest      string              `json:"manifest,omitempty"`
+	ManifestError string              `json:"manifestError,omitempty"`
+	SourceFiles   int                 `json:"sourceFiles"`
+	OK            bool                `json:"ok"`
+}
+
+type doctorInterpreter struct {
+	Name    string `json:"name"`
+	Path    string `json:"path,omitempty"`
+	Version string `json:"version,omitempty"`
+	Chosen  bool   `json:"chosen,omitempty"` // The one run would use
+}
+
+// handleDoctor reports what tokimun can find in the environment, and
+// exits with status 1 if there's no Lua interpreter to run programs with
+func handleDoctor(args []string) {
+	asJSON := false
+	for _, arg := range args {
+		if arg != "--json" {
+			fatal("error: unknown option '%s'\n\nUsage: tokimun doctor [--json]", arg)
+		}
+		asJSON = true
+	}
+
+	report := doctorReport{Version: version, Manifest: findManifest()}
+	opts, err := loadManifest()
+	if err != nil {
+		report.ManifestError = err.Error()
+	}
+
+	chosen, _ := findLuaInterpreter("", opts.Target)
+	for _, name := range interpreterCandidates(opts.Target) {
+		interpreter := doctorInterpreter{Name: name}
+		if path, err := execLookPath(name); err == nil {
+			interpreter.Path = path
+			interpreter.Version = interpreterVersion(path)
+			interpreter.Chosen = path == chosen
+		}
+		report.Interpreters = append(report.Interpreters, interpreter)
+	}
+	report.OK = chosen != ""
+
+	// Hidden directories are things like .git, never sources
+	fsys.WalkDir(".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.IsDir() && path != "." && strings.HasPrefix(entry.Name(), ".") {
+			return fs.SkipDir
+		}
+		if !entry.IsDir() && strings.HasSuffix(path, ".tkm") {
+			report.SourceFiles++
+		}
+		return nil
+	})
+
+	if asJSON {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		printDoctorReport(report)
+	}
+
+	if !report.OK {
+		exit(1)
+	}
+}
+
+func printDoctorReport(report doctorReport) {
+	fmt.Printf("tokimun v%s\n\n", report.Version)
+
+	fmt.Println("Lua interpreters:")
+	for _, interpreter := range report.Interpreters {
+		switch {
+		case interpreter.Path == "":
+			fmt.Printf("  %-8s not found\n", interpreter.Name)
+		case interpreter.Chosen:
+			fmt.Printf("✓ %-8s %s%s (used by run)\n", interpreter.Name, interpreter.Path, versionSuffix(interpreter.Version))
+		default:
+			fmt.Printf("  %-8s %s%s\n", interpreter.Name, interpreter.Path, versionSuffix(interpreter.Version))
+		}
+	}
+
+	fmt.Println("\nProject:")
+	switch {
+	case report.Manifest == "":
+		fmt.Println("  no tokimun.toml here or in a parent directory")
+	case report.ManifestError != "":
+		fmt.Printf("✗ %s\n", report.ManifestError)
+	default:
+		fmt.Printf("  %s\n", report.Manifest)
+	}
+	fmt.Printf("  %d .tkm files under the current directory\n", report.SourceFiles)
+
+	fmt.Println()
+	if report.OK {
+		fmt.Println("✓ ready to run")
+	} else {
+		fmt.Printf("✗ no Lua interpreter found (looked for %s). Install lua or luajit\n", strings.Join(luaInterpreters, ", "))
+	}
+}
+
+func versionSuffix(version string) string {
+	if version == "" {
+		return ""
+	}
+	return " (" + version + ")"
+}
+
+// interpreterVersion returns the first line `path -v` prints, or "" if
+// it doesn't answer within a couple of seconds
+func interpreterVersion(path string) string {
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		return ""
+	}
+	defer devNull.Close()
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return ""
+	}
+	defer reader.Close()
+
+	proc, err := os.StartProcess(path, []string{path, "-v"}, &os.ProcAttr{
+		Files: []*os.File{devNull, writer, writer},
+	})
+	writer.Close()
+	if err != nil {
+		return ""
+	}
+
+	output := make(chan string, 1)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- string(data)
+	}()
+
+	select {
+	case data := <-output:
+		proc.Wait()
+		line, _, _ := strings.Cut(strings.TrimSpace(data), "\n")
+		return line
+	case <-time.After(2 * time.Second):
+		proc.Kill()
+		proc.Wait()
+		return ""
+	}
+}
@@ -0,0 +1,155 @@
+//go:build !wasm
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/micr0/tokimun/compiler"
+)
+
+// compileEntry compiles opts.Entry and the project modules it requires,
+// directly or through other modules, into a single Lua file. Each module
+// is registered in package.preload under the name it's required by, so
+// require finds it there, and the entry's own code runs after them:
+//
+//	package.preload["utils"] = function(...)
+//	...
+//	end
+//
+// Module names are relative to --root, or else the entry's directory.
+// files are the other inputs given; the ones nothing requires are
+// skipped with a note, and a require that names one of them but doesn't
+// lead to it under the root gets a warning.
+func compileEntry(files []string, opts CompileOptions) error {
+	entry := filepath.Clean(opts.Entry)
+	if !strings.HasSuffix(entry, ".tkm") {
+		return fmt.Errorf("'%s' is not a .tkm file", entry)
+	}
+	if opts.Root == "" {
+		opts.Root = filepath.Dir(entry)
+	}
+
+	main, names, err := compileModule(entry, opts, true)
+	if err != nil {
+		return err
+	}
+
+	// Follow the requires breadth first, so modules come out in the
+	// order they're first needed
+	type require struct{ name, from string }
+	requires := []require{}
+	for _, name := range names {
+		requires = append(requires, require{name, entry})
+	}
+	var modules strings.Builder
+	bundled := map[string]bool{entry: true}
+	for len(requires) > 0 {
+		name, from := requires[0].name, requires[0].from
+		requires = requires[1:]
+		path := filepath.Join(opts.root(), filepath.FromSlash(strings.ReplaceAll(name, ".", "/"))) + ".tkm"
+		if bundled[path] {
+			continue
+		}
+		if _, err := fsys.Stat(path); err != nil {
+			// Not one of ours, so left for Lua's require, unless it
+			// looks like one of the files given
+			if file := requiredFile(name, files); file != "" && opts.Quiet < 2 {
+				fmt.Fprintf(os.Stderr, "warning: %s requires %q, which would be %s under the module root %s, so %s isn't bundled; check --root\n",
+					from, name, path, opts.root(), file)
+			}
+			continue
+		}
+		bundled[path] = true
+
+		output, more, err := compileModule(path, opts, false)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&modules, "package.preload[%q] = function(...)\n%s\nend\n\n", name, strings.TrimSuffix(output, "\n"))
+		for _, next := range more {
+			requires = append(requires, require{next, path})
+		}
+	}
+
+	if opts.Quiet == 0 {
+		for _, file := range files {
+			if !bundled[filepath.Clean(file)] {
+				fmt.Fprintf(os.Stderr, "note: %s isn't required by %s, skipped\n", file, entry)
+			}
+		}
+	}
+
+	header := ""
+	if !opts.NoHeader {
+		header = generatedHeader(entry, opts)
+	}
+	if opts.EmitLuaVersion {
+		header += compiler.TargetPragma + opts.target() + "\n"
+	}
+	output := header + modules.String() + main
+
+	if opts.PrintOnly || opts.ToStdout {
+		_, err := io.WriteString(os.Stdout, output)
+		return err
+	}
+	outputPath := outputPathFor(entry, opts)
+	if opts.DryRun {
+		fmt.Printf("would write: %s → %s\n", entry, outputPath)
+		return nil
+	}
+	if opts.OutputDir != "" {
+		if err := fsys.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+			return fmt.Errorf("cannot create '%s': %v", filepath.Dir(outputPath), err)
+		}
+	}
+	if err := fsys.WriteFile(outputPath, []byte(output), 0644); err != nil {
+		return fmt.Errorf("cannot write '%s': %v", outputPath, err)
+	}
+	if opts.Quiet == 0 {
+		fmt.Printf("✓ %s + %d module(s) → %s\n", entry, len(bundled)-1, outputPath)
+	}
+	return nil
+}
+
+// compileModule compiles one file of an entry's bundle without a header,
+// returning its Lua and the modules it requires. Only the entry is
+// wrapped by --wrap-main; modules already run in a function of their own.
+func compileModule(path string, opts CompileOptions, isEntry bool) (string, []string, error) {
+	source, err := fsys.ReadFile(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot read '%s': %v", path, err)
+	}
+	tokens, err := compiler.NewLexer(string(source)).Tokenize()
+	if err != nil {
+		return "", nil, sourceError(path, err)
+	}
+
+	options := compilerOptions(path, opts)
+	options.Header = ""
+	options.EmitTarget = false
+	options.WrapMain = options.WrapMain && isEntry
+
+	c := compiler.NewCompiler(tokens, options)
+	output, err := c.Compile()
+	if err != nil {
+		return "", nil, sourceError(path, err)
+	}
+	return output, c.Metadata().Requires, nil
+}
+
+// requiredFile returns the one of files the module name could mean, a
+// file whose path ends in the name's, or "" if there's none
+func requiredFile(name string, files []string) string {
+	suffix := "/" + strings.ReplaceAll(name, ".", "/") + ".tkm"
+	for _, file := range files {
+		if strings.HasSuffix("/"+filepath.ToSlash(filepath.Clean(file)), suffix) {
+			return file
+		}
+	}
+	return ""
+}
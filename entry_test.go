@@ -0,0 +1,59 @@
+//go:build !wasm
+
+package main
+
+import "testing"
+
+func TestCompileEntryBundlesModules(t *testing.T) {
+	// Like tokimun compile src/ --entry src/main.tkm --output out.lua,
+	// with module names relative to the entry's directory
+	files := useFiles(t, map[string]string{
+		"src/main.tkm":       "util = require(\"util\")\nm = require(\"lib.mathx\")\nprint(util.name, m.double(2))\n",
+		"src/util.tkm":       "return {name = \"util\"}\n",
+		"src/lib/mathx.tkm":  "M = {}\nfunction M.double(x) return x * 2 end\nreturn M\n",
+		"src/lib/unused.tkm": "print(1)\n",
+	})
+
+	inputs := []string{"src/lib/mathx.tkm", "src/lib/unused.tkm", "src/main.tkm", "src/util.tkm"}
+	opts := CompileOptions{Quiet: 1, NoHeader: true, Entry: "src/main.tkm", OutputFile: "out.lua"}
+	if err := compileEntry(inputs, opts); err != nil {
+		t.Fatal(err)
+	}
+	want := `package.preload["util"] = function(...)
+return {name = "util"}
+end
+
+package.preload["lib.mathx"] = function(...)
+local M = {}
+function M.double(x)
+  return x * 2
+end
+return M
+end
+
+local util = require("util")
+local m = require("lib.mathx")
+print(util.name, m.double(2))
+`
+	if got := files.read("out.lua"); got != want {
+		t.Errorf("out.lua is\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRequiredFile(t *testing.T) {
+	files := []string{"src/main.tkm", "src/lib/mathx.tkm", "src/xutil.tkm"}
+	tests := map[string]string{
+		"lib.mathx": "src/lib/mathx.tkm",
+		"mathx":     "src/lib/mathx.tkm",
+		"util":      "",
+		"socket":    "",
+	}
+	for name, want := range tests {
+		if got := requiredFile(name, files); got != want {
+			t.Errorf("requiredFile(%q) = %q, want %q", name, got, want)
+		}
+	}
+	if got := requiredFile("lib.mathx", []string{"./src/lib/mathx.tkm"}); got != "./src/lib/mathx.tkm" {
+		t.Errorf("requiredFile(%q) in ./src = %q", "lib.mathx", got)
+	}
+}
@@ -0,0 +1,112 @@
+//go:build !wasm
+
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// fileSystem is the file access the compile commands need. Everything
+// goes through fsys, so tests can swap in an in-memory implementation
+// and run the CLI without touching the disk.
+type fileSystem interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	Create(name string, perm fs.FileMode) (outputFile, error)
+	Open(name string) (fs.File, error)
+	Stat(name string) (fs.FileInfo, error)
+	Glob(pattern string) ([]string, error)
+	MkdirAll(path string, perm fs.FileMode) error
+	WalkDir(root string, fn fs.WalkDirFunc) error
+}
+
+// outputFile is a file being written by Create. Close puts it in place
+// of the old file, and Abort drops it, leaving the old file alone.
+type outputFile interface {
+	io.Writer
+	Close() error
+	Abort()
+}
+
+// fsys is the file system the commands use
+var fsys fileSystem = osFileSystem{}
+
+// osFileSystem is the real file system
+type osFileSystem struct{}
+
+func (osFileSystem) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (f osFileSystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	file, err := f.Create(name, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Close()
+}
+
+// Create writes to a temporary file next to name, which Close moves into
+// place, so readers never see a half written file
+func (osFileSystem) Create(name string, perm fs.FileMode) (outputFile, error) {
+	tmpFile, err := os.CreateTemp(filepath.Dir(name), ".tokimun-*"+filepath.Ext(name))
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpFile.Chmod(perm); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return nil, err
+	}
+	return &pendingFile{File: tmpFile, name: name}, nil
+}
+
+func (osFileSystem) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osFileSystem) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFileSystem) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func (osFileSystem) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFileSystem) WalkDir(root string, fn fs.WalkDirFunc) error {
+	return filepath.WalkDir(root, fn)
+}
+
+// pendingFile is a temporary file that replaces name once it's closed
+type pendingFile struct {
+	*os.File
+	name string
+}
+
+func (f *pendingFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	if err := os.Rename(f.File.Name(), f.name); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	return nil
+}
+
+func (f *pendingFile) Abort() {
+	f.File.Close()
+	os.Remove(f.File.Name())
+}
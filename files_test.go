@@ -0,0 +1,345 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// memFileSystem keeps files in memory, so tests of the commands don't
+// touch the disk. Each write is a second later than the one before, so
+// modification times order like they would on disk.
+type memFileSystem struct {
+	files fstest.MapFS
+	clock time.Time
+}
+
+func newMemFileSystem() *memFileSystem {
+	return &memFileSystem{files: fstest.MapFS{}, clock: time.Unix(1700000000, 0)}
+}
+
+// useFiles makes fsys an in-memory file system holding files for the
+// rest of the test
+func useFiles(t *testing.T, files map[string]string) *memFileSystem {
+	t.Helper()
+	m := newMemFileSystem()
+	for name, data := range files {
+		m.WriteFile(name, []byte(data), 0644)
+	}
+	saved := fsys
+	fsys = m
+	t.Cleanup(func() { fsys = saved })
+	return m
+}
+
+// memPath turns a file name into the slash separated, unrooted form
+// fstest.MapFS uses
+func memPath(name string) string {
+	return strings.TrimPrefix(path.Clean(filepath.ToSlash(name)), "/")
+}
+
+// read returns the contents of name, or "" when there is no such file
+func (m *memFileSystem) read(name string) string {
+	file, ok := m.files[memPath(name)]
+	if !ok {
+		return ""
+	}
+	return string(file.Data)
+}
+
+func (m *memFileSystem) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(m.files, memPath(name))
+}
+
+func (m *memFileSystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	m.clock = m.clock.Add(time.Second)
+	m.files[memPath(name)] = &fstest.MapFile{Data: data, Mode: perm, ModTime: m.clock}
+	return nil
+}
+
+func (m *memFileSystem) Create(name string, perm fs.FileMode) (outputFile, error) {
+	return &memFile{fs: m, name: name, perm: perm}, nil
+}
+
+func (m *memFileSystem) Open(name string) (fs.File, error) {
+	return m.files.Open(memPath(name))
+}
+
+func (m *memFileSystem) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(m.files, memPath(name))
+}
+
+func (m *memFileSystem) Glob(pattern string) ([]string, error) {
+	return fs.Glob(m.files, memPath(pattern))
+}
+
+func (m *memFileSystem) MkdirAll(dir string, perm fs.FileMode) error {
+	if _, ok := m.files[memPath(dir)]; !ok {
+		m.files[memPath(dir)] = &fstest.MapFile{Mode: fs.ModeDir | perm}
+	}
+	return nil
+}
+
+func (m *memFileSystem) WalkDir(root string, fn fs.WalkDirFunc) error {
+	return fs.WalkDir(m.files, memPath(root), fn)
+}
+
+// memFile is an outputFile that lands in its memFileSystem when closed
+type memFile struct {
+	bytes.Buffer
+	fs   *memFileSystem
+	name string
+	perm fs.FileMode
+}
+
+func (f *memFile) Close() error {
+	return f.fs.WriteFile(f.name, f.Bytes(), f.perm)
+}
+
+func (f *memFile) Abort() {}
+
+func TestCompileFileWritesOutput(t *testing.T) {
+	files := useFiles(t, map[string]string{"src/main.tkm": "x = 1\nprint(x)\n"})
+
+	if err := compileFile("src/main.tkm", CompileOptions{Quiet: 1}); err != nil {
+		t.Fatal(err)
+	}
+	want := generatedHeader("src/main.tkm", CompileOptions{}) + "local x = 1\nprint(x)\n"
+	if got := files.read("src/main.lua"); got != want {
+		t.Errorf("src/main.lua is\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCompileFileOutputDir(t *testing.T) {
+	files := useFiles(t, map[string]string{"src/lib/util.tkm": "print(1)\n"})
+
+	opts := CompileOptions{Quiet: 1, NoHeader: true, Root: "src", OutputDir: "build"}
+	if err := compileFile("src/lib/util.tkm", opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := files.read("build/lib/util.lua"); got != "print(1)\n" {
+		t.Errorf("build/lib/util.lua is %q, want %q", got, "print(1)\n")
+	}
+}
+
+func TestCompileFileErrorKeepsOutput(t *testing.T) {
+	files := useFiles(t, map[string]string{
+		"main.tkm": "print(1)\nlocal x = = 2\n",
+		"main.lua": "print(\"previous build\")\n",
+	})
+
+	if err := compileFile("main.tkm", CompileOptions{Quiet: 1}); err == nil {
+		t.Fatal("expected a compile error")
+	}
+	if got := files.read("main.lua"); got != "print(\"previous build\")\n" {
+		t.Errorf("main.lua was overwritten with %q", got)
+	}
+}
+
+func TestExpandFilesWalksDirectories(t *testing.T) {
+	useFiles(t, map[string]string{
+		"src/a.tkm":       "",
+		"src/lib/b.tkm":   "",
+		"src/notes.txt":   "",
+		"other/c.tkm":     "",
+		"src/lib/b.lua":   "",
+		"src/lib/d.tkm.x": "",
+	})
+
+	got := expandFiles([]string{"src"}, CompileOptions{})
+	want := []string{"src/a.tkm", "src/lib/b.tkm"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("expandFiles(src) = %v, want %v", got, want)
+	}
+}
+
+func TestCreateReplacesOnlyOnClose(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.lua")
+	disk := osFileSystem{}
+	if err := disk.WriteFile(name, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	aborted, err := disk.Create(name, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aborted.Write([]byte("half"))
+	aborted.Abort()
+	if data, _ := disk.ReadFile(name); string(data) != "old\n" {
+		t.Fatalf("after Abort the file is %q, want %q", data, "old\n")
+	}
+
+	file, err := disk.Create(name, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("new\n"))
+	if data, _ := disk.ReadFile(name); string(data) != "old\n" {
+		t.Fatalf("before Close the file is %q, want %q", data, "old\n")
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := disk.ReadFile(name); string(data) != "new\n" {
+		t.Errorf("after Close the file is %q, want %q", data, "new\n")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(name), ".tokimun-*")); len(matches) > 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestPreserveLinesOutputUpToDate(t *testing.T) {
+	files := useFiles(t, map[string]string{"main.tkm": "print(1)\n"})
+
+	opts := CompileOptions{Quiet: 1, PreserveLines: true}
+	if err := compileFile("main.tkm", opts); err != nil {
+		t.Fatal(err)
+	}
+	if !isUpToDate("main.tkm", "main.lua", opts) {
+		t.Errorf("output with the header on its first line isn't up to date:\n%s", files.read("main.lua"))
+	}
+}
+
+func TestChangedOptionsRecompile(t *testing.T) {
+	files := useFiles(t, map[string]string{"main.tkm": "if x then\n  print(x)\nend\n"})
+
+	tabs := CompileOptions{Quiet: 1, Indent: "tab"}
+	if err := compileFile("main.tkm", tabs); err != nil {
+		t.Fatal(err)
+	}
+	if !isUpToDate("main.tkm", "main.lua", tabs) {
+		t.Fatal("output isn't up to date with the options it was compiled with")
+	}
+
+	spaces := CompileOptions{Quiet: 1, Indent: "4"}
+	if isUpToDate("main.tkm", "main.lua", spaces) {
+		t.Error("output compiled with --indent tab is up to date for --indent 4")
+	}
+	if err := compileFile("main.tkm", spaces); err != nil {
+		t.Fatal(err)
+	}
+	if output := files.read("main.lua"); !strings.Contains(output, "\n    print(x)\n") {
+		t.Errorf("main.lua wasn't recompiled with --indent 4:\n%s", output)
+	}
+}
+
+// captureStderr returns what fn writes to stderr
+func captureStderr(t *testing.T, fn func()) string {
+	t.Helper()
+	return capture(t, &os.Stderr, fn)
+}
+
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	return capture(t, &os.Stdout, fn)
+}
+
+// capture returns what fn writes to *stream
+func capture(t *testing.T, stream **os.File, fn func()) string {
+	t.Helper()
+	file, err := os.CreateTemp(t.TempDir(), "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := *stream
+	*stream = file
+	defer func() { *stream = saved }()
+	fn()
+	data, _ := os.ReadFile(file.Name())
+	return string(data)
+}
+
+func TestCompileFilesKeepsGoing(t *testing.T) {
+	files := useFiles(t, map[string]string{
+		"a.tkm":     "print(1)\n",
+		"bad.tkm":   "local x = = 2\n",
+		"c.tkm":     "print(3)\n",
+		"worse.tkm": "print(\n",
+	})
+
+	failed := 0
+	stderr := captureStderr(t, func() {
+		failed = compileFiles([]string{"a.tkm", "bad.tkm", "c.tkm", "worse.tkm"}, CompileOptions{Quiet: 1, NoHeader: true})
+	})
+	if failed != 2 {
+		t.Errorf("compileFiles reported %d failures, want 2", failed)
+	}
+	if files.read("a.lua") != "print(1)\n" || files.read("c.lua") != "print(3)\n" {
+		t.Errorf("the good files weren't compiled: a.lua %q, c.lua %q", files.read("a.lua"), files.read("c.lua"))
+	}
+	if files.read("bad.lua") != "" || files.read("worse.lua") != "" {
+		t.Error("a failed file has output")
+	}
+	for _, file := range []string{"bad.tkm:1:", "worse.tkm:"} {
+		if !strings.Contains(stderr, file) {
+			t.Errorf("no error for %s in\n%s", file, stderr)
+		}
+	}
+}
+
+func TestLintFilesKeepsGoing(t *testing.T) {
+	useFiles(t, map[string]string{
+		"a.tkm":   "local unused = 1\n",
+		"bad.tkm": "local x = = 2\n",
+		"c.tkm":   "local other = 1\n",
+	})
+
+	failed := false
+	stderr := captureStderr(t, func() {
+		failed = lintFiles([]string{"a.tkm", "bad.tkm", "c.tkm", "missing.tkm"}, CompileOptions{Lint: true})
+	})
+	if !failed {
+		t.Error("lintFiles reported nothing")
+	}
+	for _, want := range []string{"a.tkm:1:", "bad.tkm:1:", "c.tkm:1:", "cannot read 'missing.tkm'"} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("no diagnostic for %s in\n%s", want, stderr)
+		}
+	}
+}
+
+func TestQuietLevels(t *testing.T) {
+	tests := []struct {
+		flags  []string
+		stdout bool // The ✓ progress line
+		warn   bool
+	}{
+		{nil, true, true},
+		{[]string{"-q"}, false, true},
+		{[]string{"--quiet"}, false, true},
+		{[]string{"-qq"}, false, false},
+		{[]string{"--silent"}, false, false},
+		{[]string{"-qq", "-q"}, false, false},
+	}
+	for _, test := range tests {
+		useFiles(t, map[string]string{
+			"a.tkm":   "local unused = 1\n",
+			"bad.tkm": "local x = = 2\n",
+		})
+		files, opts := parseCompileOptions(append(test.flags, "--lint", "a.tkm", "bad.tkm"))
+
+		var stderr string
+		stdout := captureStdout(t, func() {
+			stderr = captureStderr(t, func() { compileFiles(files, opts) })
+		})
+		if got := strings.Contains(stdout, "✓ a.tkm → a.lua"); got != test.stdout {
+			t.Errorf("%v: stdout is %q, want the progress line %v", test.flags, stdout, test.stdout)
+		}
+		if got := strings.Contains(stderr, "a.tkm:1:7: warning: local 'unused' is never used"); got != test.warn {
+			t.Errorf("%v: stderr is %q, want the warning %v", test.flags, stderr, test.warn)
+		}
+		// Errors are always shown
+		if !strings.Contains(stderr, "bad.tkm:1:11: error:") {
+			t.Errorf("%v: stderr is %q, want the error", test.flags, stderr)
+		}
+	}
+}
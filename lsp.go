@@ -0,0 +1,373 @@
+//go:build !wasm
+
+package main
+
+// `tokimun lsp` is a small language server speaking JSON-RPC over stdio.
+// It publishes diagnostics whenever a document is opened, changed or
+// saved, and answers documentSymbol with the top level functions and
+// globals.
+//
+// Neovim (0.8+):
+//
+//	vim.api.nvim_create_autocmd("FileType", {
+//	  pattern = "tokimun",
+//	  callback = function()
+//	    vim.lsp.start({ name = "tokimun", cmd = { "tokimun", "lsp" } })
+//	  end,
+//	})
+//
+// with vim.filetype.add({ extension = { tkm = "tokimun" } }).
+//
+// VS Code needs a small extension that starts `tokimun lsp` through
+// vscode-languageclient's LanguageClient with a documentSelector of
+// { language: "tokimun" } and the .tkm extension registered for it.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/micr0/tokimun/compiler"
+)
+
+// LSP constants used below
+const (
+	lspSyncFull        = 1
+	lspSeverityError   = 1
+	lspSeverityWarning = 2
+	lspSymbolMethod    = 6
+	lspSymbolFunction  = 12
+	lspSymbolVariable  = 13
+	lspMethodNotFound  = -32601
+)
+
+type lspMessage struct {
+	ID     *json.RawMessage `json:"id,omitempty"`
+	Method string           `json:"method,omitempty"`
+	Params json.RawMessage  `json:"params,omitempty"`
+}
+
+type lspResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result"`
+}
+
+type lspErrorResponse struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Error   lspError         `json:"error"`
+}
+
+type lspNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Code     string   `json:"code,omitempty"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspSymbol struct {
+	Name           string   `json:"name"`
+	Kind           int      `json:"kind"`
+	Range          lspRange `json:"range"`
+	SelectionRange lspRange `json:"selectionRange"`
+}
+
+// lspDocumentParams covers the params of every textDocument message we
+// handle. Changes are always whole documents, as we ask for full sync.
+type lspDocumentParams struct {
+	TextDocument struct {
+		URI  string `json:"uri"`
+		Text string `json:"text"`
+	} `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+	Text *string `json:"text"`
+}
+
+// lspServer holds the open documents by URI
+type lspServer struct {
+	out       io.Writer
+	opts      CompileOptions
+	documents map[string]string
+	shutdown  bool
+}
+
+func handleLSP(args []string) {
+	if len(args) > 0 && args[0] != "--stdio" {
+		fatal("error: unknown option '%s'\n\nUsage: tokimun lsp", args[0])
+	}
+
+	// A broken manifest shouldn't stop the server; it just means defaults
+	opts, _ := loadManifest()
+	code, err := serveLSP(os.Stdin, os.Stdout, opts)
+	if err != nil {
+		fatal("error: %v", err)
+	}
+	exit(code)
+}
+
+// serveLSP answers the messages read from in until the client sends exit
+// or closes it, and returns the exit code: 0 after a shutdown request.
+func serveLSP(in io.Reader, out io.Writer, opts CompileOptions) (int, error) {
+	server := &lspServer{out: out, opts: opts, documents: map[string]string{}}
+
+	reader := bufio.NewReader(in)
+	for {
+		data, err := readLSPMessage(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return 1, nil
+			}
+			return 1, err
+		}
+
+		var msg lspMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		if msg.Method == "exit" {
+			if server.shutdown {
+				return 0, nil
+			}
+			return 1, nil
+		}
+		server.handle(msg)
+	}
+}
+
+// readLSPMessage reads one Content-Length framed message
+func readLSPMessage(reader *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		if strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("bad Content-Length '%s'", strings.TrimSpace(value))
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("message without a Content-Length header")
+	}
+
+	data := make([]byte, length)
+	_, err := io.ReadFull(reader, data)
+	return data, err
+}
+
+func (s *lspServer) send(message interface{}) {
+	data, _ := json.Marshal(message)
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(data), data)
+}
+
+func (s *lspServer) reply(id *json.RawMessage, result interface{}) {
+	s.send(lspResponse{JSONRPC: "2.0", ID: id, Result: result})
+}
+
+func (s *lspServer) handle(msg lspMessage) {
+	var params lspDocumentParams
+	json.Unmarshal(msg.Params, &params)
+	uri := params.TextDocument.URI
+
+	switch msg.Method {
+	case "initialize":
+		s.reply(msg.ID, map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync": map[string]interface{}{
+					"openClose": true,
+					"change":    lspSyncFull,
+					"save":      map[string]interface{}{"includeText": true},
+				},
+				"documentSymbolProvider": true,
+			},
+			"serverInfo": map[string]interface{}{"name": "tokimun", "version": version},
+		})
+	case "shutdown":
+		s.shutdown = true
+		s.reply(msg.ID, nil)
+	case "textDocument/didOpen":
+		s.documents[uri] = params.TextDocument.Text
+		s.publishDiagnostics(uri)
+	case "textDocument/didChange":
+		if len(params.ContentChanges) > 0 {
+			s.documents[uri] = params.ContentChanges[len(params.ContentChanges)-1].Text
+		}
+		s.publishDiagnostics(uri)
+	case "textDocument/didSave":
+		if params.Text != nil {
+			s.documents[uri] = *params.Text
+		}
+		s.publishDiagnostics(uri)
+	case "textDocument/didClose":
+		delete(s.documents, uri)
+		s.send(lspNotification{JSONRPC: "2.0", Method: "textDocument/publishDiagnostics", Params: map[string]interface{}{
+			"uri":         uri,
+			"diagnostics": []lspDiagnostic{},
+		}})
+	case "textDocument/documentSymbol":
+		_, symbols := s.analyze(uri)
+		s.reply(msg.ID, symbols)
+	default:
+		// Notifications we don't know are ignored, requests get an error
+		if msg.ID != nil {
+			s.send(lspErrorResponse{JSONRPC: "2.0", ID: msg.ID, Error: lspError{Code: lspMethodNotFound, Message: "method not found: " + msg.Method}})
+		}
+	}
+}
+
+func (s *lspServer) publishDiagnostics(uri string) {
+	diagnostics, _ := s.analyze(uri)
+	s.send(lspNotification{JSONRPC: "2.0", Method: "textDocument/publishDiagnostics", Params: map[string]interface{}{
+		"uri":         uri,
+		"diagnostics": diagnostics,
+	}})
+}
+
+// analyze compiles the document, returning its errors and warnings and
+// the symbols it defines
+func (s *lspServer) analyze(uri string) ([]lspDiagnostic, []lspSymbol) {
+	source, ok := s.documents[uri]
+	if !ok {
+		data, err := fsys.ReadFile(uriPath(uri))
+		if err != nil {
+			return []lspDiagnostic{}, []lspSymbol{}
+		}
+		source = string(data)
+	}
+
+	diagnostics := []lspDiagnostic{}
+	symbols := []lspSymbol{}
+	lines := strings.Split(source, "\n")
+
+	options := compilerOptions(uriPath(uri), s.opts)
+	options.Header = ""
+	options.Warn = func(w compiler.Warning) {
+		diagnostics = append(diagnostics, lspDiagnosticFrom(diagnostic{Line: w.Line, Column: w.Column, Severity: "warning", Code: w.Code, Message: w.Message}, lines))
+	}
+
+	tokens, err := compiler.NewLexer(source).Tokenize()
+	if err == nil {
+		c := compiler.NewCompiler(tokens, options)
+		err = c.CompileTo(io.Discard)
+		symbols = lspSymbols(c.Metadata(), lines)
+	}
+
+	var compileErr *compiler.CompileError
+	if errors.As(err, &compileErr) {
+		diagnostics = append(diagnostics, lspDiagnosticFrom(diagnostic{Line: compileErr.Line, Column: compileErr.Column, Severity: "error", Message: compileErr.Message}, lines))
+	} else if err != nil {
+		diagnostics = append(diagnostics, lspDiagnosticFrom(diagnostic{Line: 1, Column: 1, Severity: "error", Message: err.Error()}, lines))
+	}
+	return diagnostics, symbols
+}
+
+// lspPositionAt converts a line and byte column counting from 1, as the
+// compiler reports them, to an LSP position in lines of the source, which
+// counts from 0 and in UTF-16 code units
+func lspPositionAt(lines []string, line, column int) lspPosition {
+	position := lspPosition{Line: max(line-1, 0)}
+	if position.Line >= len(lines) {
+		return lspPosition{Line: position.Line, Character: max(column-1, 0)}
+	}
+	text := lines[position.Line]
+	prefix := text[:min(max(column-1, 0), len(text))]
+	position.Character = len(utf16.Encode([]rune(prefix)))
+	return position
+}
+
+// lspDiagnosticFrom converts a diagnostic to the LSP's range covering the
+// character it points at, in lines of the source
+func lspDiagnosticFrom(d diagnostic, lines []string) lspDiagnostic {
+	start := lspPositionAt(lines, d.Line, d.Column)
+	end := lspPosition{Line: start.Line, Character: start.Character + 1}
+	if start.Line < len(lines) && d.Column >= 1 && d.Column <= len(lines[start.Line]) {
+		r, _ := utf8.DecodeRuneInString(lines[start.Line][d.Column-1:])
+		end.Character = start.Character + max(utf16.RuneLen(r), 1)
+	}
+	severity := lspSeverityError
+	if d.Severity == "warning" {
+		severity = lspSeverityWarning
+	}
+	return lspDiagnostic{Range: lspRange{start, end}, Severity: severity, Code: d.Code, Source: "tokimun", Message: d.Message}
+}
+
+// lspSymbols lists the metadata's functions and globals in source order
+func lspSymbols(metadata compiler.Metadata, lines []string) []lspSymbol {
+	symbols := []lspSymbol{}
+	add := func(name string, kind int, symbol compiler.Symbol) {
+		start := lspPositionAt(lines, symbol.Line, symbol.Column)
+		end := lspPosition{Line: start.Line, Character: start.Character + len(utf16.Encode([]rune(name)))}
+		symbols = append(symbols, lspSymbol{Name: name, Kind: kind, Range: lspRange{start, end}, SelectionRange: lspRange{start, end}})
+	}
+
+	for name, symbol := range metadata.Functions {
+		kind := lspSymbolFunction
+		if strings.Contains(name, ":") {
+			kind = lspSymbolMethod
+		}
+		add(name, kind, symbol)
+	}
+	for name, symbol := range metadata.Globals {
+		add(name, lspSymbolVariable, symbol)
+	}
+
+	sort.Slice(symbols, func(i, j int) bool {
+		a, b := symbols[i].Range.Start, symbols[j].Range.Start
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Character < b.Character
+	})
+	return symbols
+}
+
+// uriPath turns a file:// URI into a path
+func uriPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return u.Path
+}
@@ -0,0 +1,116 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// lspRequest frames a JSON-RPC message the way a client sends it
+func lspRequest(t *testing.T, message map[string]interface{}) string {
+	t.Helper()
+	message["jsonrpc"] = "2.0"
+	data, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(data), data)
+}
+
+func TestLSPHandshake(t *testing.T) {
+	useFiles(t, nil)
+
+	// The error is after 'é', two bytes and one UTF-16 unit, and '😀',
+	// four bytes and two units, so byte column 26 is character 22
+	source := "let s = \"é😀\" let t = )\n"
+	in := lspRequest(t, map[string]interface{}{"id": 1, "method": "initialize", "params": map[string]interface{}{}}) +
+		lspRequest(t, map[string]interface{}{"method": "initialized", "params": map[string]interface{}{}}) +
+		lspRequest(t, map[string]interface{}{"method": "textDocument/didOpen", "params": map[string]interface{}{
+			"textDocument": map[string]interface{}{"uri": "file:///main.tkm", "languageId": "tokimun", "version": 1, "text": source},
+		}}) +
+		lspRequest(t, map[string]interface{}{"id": 2, "method": "shutdown"}) +
+		lspRequest(t, map[string]interface{}{"method": "exit"})
+
+	var out bytes.Buffer
+	code, err := serveLSP(strings.NewReader(in), &out, CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 0 {
+		t.Errorf("exit code = %d, want 0 after shutdown", code)
+	}
+
+	reader := bufio.NewReader(&out)
+	var replies []map[string]json.RawMessage
+	for {
+		data, err := readLSPMessage(reader)
+		if err != nil {
+			break
+		}
+		var reply map[string]json.RawMessage
+		if err := json.Unmarshal(data, &reply); err != nil {
+			t.Fatalf("reply isn't JSON: %s", data)
+		}
+		replies = append(replies, reply)
+	}
+	if len(replies) != 3 {
+		t.Fatalf("got %d replies, want initialize, publishDiagnostics and shutdown", len(replies))
+	}
+
+	var initialize struct {
+		Capabilities struct {
+			DocumentSymbolProvider bool `json:"documentSymbolProvider"`
+		} `json:"capabilities"`
+	}
+	if string(replies[0]["id"]) != "1" || json.Unmarshal(replies[0]["result"], &initialize) != nil || !initialize.Capabilities.DocumentSymbolProvider {
+		t.Errorf("initialize reply = %s", replies[0]["result"])
+	}
+
+	if string(replies[1]["method"]) != `"textDocument/publishDiagnostics"` {
+		t.Fatalf("second message = %s, want publishDiagnostics", replies[1]["method"])
+	}
+	var published struct {
+		URI         string          `json:"uri"`
+		Diagnostics []lspDiagnostic `json:"diagnostics"`
+	}
+	if err := json.Unmarshal(replies[1]["params"], &published); err != nil {
+		t.Fatal(err)
+	}
+	if published.URI != "file:///main.tkm" || len(published.Diagnostics) != 1 {
+		t.Fatalf("published %+v, want one diagnostic for file:///main.tkm", published)
+	}
+	got := published.Diagnostics[0]
+	want := lspRange{Start: lspPosition{Line: 0, Character: 22}, End: lspPosition{Line: 0, Character: 23}}
+	if got.Range != want || got.Severity != lspSeverityError {
+		t.Errorf("diagnostic = %+v, want an error at %+v", got, want)
+	}
+
+	if string(replies[2]["id"]) != "2" || string(replies[2]["result"]) != "null" {
+		t.Errorf("shutdown reply = %v", replies[2])
+	}
+}
+
+func TestLSPPositionAt(t *testing.T) {
+	lines := []string{"local x = 1", "-- é😀 ok", ""}
+	tests := []struct {
+		name         string
+		line, column int
+		want         lspPosition
+	}{
+		{"ascii", 1, 7, lspPosition{Line: 0, Character: 6}},
+		{"after two byte rune", 2, 6, lspPosition{Line: 1, Character: 4}},
+		{"after surrogate pair", 2, 10, lspPosition{Line: 1, Character: 6}},
+		{"past the end", 1, 40, lspPosition{Line: 0, Character: 11}},
+		{"line past the end", 5, 3, lspPosition{Line: 4, Character: 2}},
+	}
+	for _, test := range tests {
+		if got := lspPositionAt(lines, test.line, test.column); got != test.want {
+			t.Errorf("%s: lspPositionAt(%d, %d) = %+v, want %+v", test.name, test.line, test.column, got, test.want)
+		}
+	}
+}
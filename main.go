@@ -1,15 +1,36 @@
+//go:build !wasm
+
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/micr0/tokimun/compiler"
 )
 
 const version = "0.1"
 
+// defaultTarget is the Lua version output is written for when neither
+// --target nor tokimun.toml picks one
+const defaultTarget = compiler.DefaultTarget
+
+// commit is the git commit tokimun was built from, when set with
+// -ldflags "-X main.commit=..."
+var commit = ""
+
 const logo = `
   ╭────────────────────────────────╮
   │  ▀█▀ █▀█ █▄▀ █ █▀▄▀█ █ █ █▄ █  │
@@ -26,21 +47,89 @@ COMMANDS:
     compile, c    Compile .tkm file(s) to Lua
     run, r        Compile and run with Lua interpreter  
     watch, w      Watch files and recompile on change
-    version, v    Print version information
+    lint, l       Report likely mistakes without writing any output
+    version, v    Print version information (--json for tools)
+    doctor        Check for Lua interpreters and project files (--json for tools)
+    lsp           Language server over stdio, for editor diagnostics and symbols
     help, h       Show this help message
 
 OPTIONS:
     -o, --output <file>    Output file (default: input with .lua extension)
+    --output-dir <dir>     Write outputs to dir instead of next to the inputs
+    --entry <file>         Compile file and the modules it requires into one
+                           output; other inputs nothing requires are skipped
+    --target <version>     Lua version to compile for: 5.1, 5.2, 5.3, 5.4 or luajit
+    --root <dir>           Project root that require "./x" paths resolve against
+    -I, --include <dir>    Also look for required modules in dir (repeatable)
+    --indent <style>       Indentation of the output: tab or a number of spaces
+    --max-line-length <n>  Break output lines longer than n columns after
+                           commas and operators
+    --globals <mode>       local (default): new names are locals; lua: they're
+                           globals and locals need 'local', as in plain Lua
     -p, --print            Print compiled output to stdout
-    -q, --quiet            Suppress non-error output
+    -q, --quiet            Suppress progress output, keeping warnings and errors
+    -qq, --silent          Suppress warnings too, showing only errors
     --stdout               Write to stdout instead of file
+    --keep-temp            Keep the temporary .lua file created by run
+    --no-header            Omit the "Generated by tokimun" header comment
+    --preserve-lines       Keep Lua line numbers aligned with the source
+    --keep-comments        Copy comments to the output; --strip-comments
+                           (the default) keeps only --- doc comments
+    --wrap-main            Compile each file into a function called with the
+                           file's varargs, so its locals stay out of _G and
+                           a top-level return is the module's value
+    --annotations          Put ---@param comments above each function, for
+                           tools that read EmmyLua annotations
+    --check-balanced       Check that brackets pair up before compiling, to
+                           report a missing or stray one where it is
+    --dump-tokens          Print the lexer's tokens instead of compiling
+    --emit-ast             Print the syntax tree instead of compiling
+    --format <format>      Syntax tree format for --emit-ast: json or text
+    --error-format <fmt>   How errors are printed: gnu (file:line:col) or json
+    --no-glob              Treat file arguments as literal names, not patterns
+    --only <regex>         Only compile the files whose path matches
+    --exclude <regex>      Skip the files whose path matches
+    --watch                With run, restart the script when the source changes
+    --run                  With watch, run the first file after every compile
+    --list-interpreters    With run, show which Lua interpreters are installed
+    --interpreter <lua>    With run, use this Lua interpreter
+    --lua-path <path>      With run, set LUA_PATH for the interpreter, e.g.
+                           './?.lua;./lib/?.lua;;'
+    --lua-cpath <path>     With run, set LUA_CPATH for the interpreter
+    --no-negative-index    Index t[-1] as Lua does instead of as the last element
+    --safe-float-loops     Count the iterations of for loops with a float step,
+                           so rounding errors can't skip the last one
+    --lint                 Also report lint warnings while compiling
+    --luacheck-ignore      Mark generated temporaries so luacheck skips them
+    --emit-lua-version     Start the output with a '-- tokimun-target: <version>'
+                           comment; run prefers an interpreter for that version
+    --stats                Print token, line and timing counts to stderr
+    --force                Recompile files even if their output is up to date
+    --dry-run              Compile and list the files that would be written
+    --emit-metadata <file> Write the functions, globals and requires of the
+                           compiled files to a JSON file, for editors
+
+PROJECT FILE:
+    A tokimun.toml in the current directory or a parent sets defaults
+    for target, sources, entry, output_dir, root, include, globals, indent,
+    max_line_length, keep_comments, wrap_main, annotations,
+    check_balanced, lint, luacheck_ignore, preserve_lines and header.
+    The root defaults to the manifest's directory.
+    Command line options take precedence; --name=false or --no-name turns
+    off a boolean set there, and --header brings the header back. With no
+    files, 'tokimun compile' compiles the configured sources.
 
 EXAMPLES:
     tokimun compile main.tkm              # Creates main.lua
     tokimun compile main.tkm -o out.lua   # Creates out.lua
     tokimun compile src/*.tkm             # Compile multiple files
+    tokimun compile src/ --output-dir out # Compile every .tkm file under src
     tokimun run main.tkm                  # Compile and execute
-    tokimun c main.tkm -p                 # Print compiled Lua`
+    tokimun run --watch main.tkm          # Rerun on every save
+    tokimun watch src/*.tkm               # Recompile on every save
+    tokimun watch --run main.tkm lib/*.tkm # Recompile and rerun main on every save
+    tokimun c main.tkm -p                 # Print compiled Lua
+    tokimun lint src/*.tkm                # Check for common mistakes`
 
 func main() {
 	args := os.Args[1:]
@@ -61,8 +150,14 @@ func main() {
 		handleRun(args)
 	case "watch", "w":
 		handleWatch(args)
+	case "lint", "l":
+		handleLint(args)
 	case "version", "v", "--version", "-v":
-		fmt.Printf("tokimun v%s\n", version)
+		handleVersion(args)
+	case "doctor":
+		handleDoctor(args)
+	case "lsp":
+		handleLSP(args)
 	case "help", "h", "--help", "-h":
 		fmt.Print(logo)
 		fmt.Println(help)
@@ -70,22 +165,128 @@ func main() {
 		// Assume it's a file to compile
 		handleCompile(append([]string{command}, args...))
 	}
+	stopProfile()
 }
 
 type CompileOptions struct {
-	OutputFile string
-	PrintOnly  bool
-	Quiet      bool
-	ToStdout   bool
+	OutputFile       string
+	PrintOnly        bool
+	Quiet            int // 1 (-q) hides progress lines, 2 (-qq) warnings too
+	ToStdout         bool
+	KeepTemp         bool
+	NoHeader         bool
+	PreserveLines    bool
+	DumpTokens       bool
+	NoGlob           bool
+	Watch            bool
+	Lint             bool
+	Stats            bool
+	Force            bool
+	DryRun           bool
+	ListInterpreters bool
+	Run              bool   // With watch, run the first file after each compile
+	Interpreter      string // Lua interpreter for run, instead of the first found
+	LuaPath          string // LUA_PATH for the interpreter run starts
+	LuaCPath         string // LUA_CPATH for the interpreter run starts
+	Profile          string // Write a CPU profile of the run here
+	EmitAST          bool
+	Format           string // Syntax tree format for --emit-ast
+	ErrorFormat      string
+	LuacheckIgnore   bool   // Wrap generated temporaries in luacheck ignore comments
+	EmitLuaVersion   bool   // Record the target in the output, see compiler.TargetPragma
+	Indent           string // "tab" or a number of spaces
+	NoNegativeIndex  bool   // Compile t[-1] as plain Lua, not as the last element
+	SafeFloatLoops   bool   // Count the iterations of for loops with a float step
+	EmitMetadata     string // Write the symbols of the compiled files to this JSON file
+	MaxLineLength    int    // Wrap longer lines of output, 0 for no limit
+	KeepComments     bool   // Copy comments to the output
+	WrapMain         bool   // Compile each file into a function it calls
+	Annotations      bool   // Emit ---@param comments above functions
+	CheckBalanced    bool   // Check bracket pairs before compiling
+	Only             string // Only compile files whose path matches this regex
+	Exclude          string // Skip files whose path matches this regex
+	Target           string
+	Globals          string // "lua" or "local", how bare assignments are compiled
+	OutputDir        string
+	Entry            string   // Bundle this file and the modules it requires into one output
+	Root             string   // Directory module names are relative to
+	Include          []string // More directories relative requires are looked up in
+	Sources          []string // Inputs used when none are given, from tokimun.toml
+}
+
+// root returns the project root, the current directory by default
+func (opts CompileOptions) root() string {
+	if opts.Root == "" {
+		return "."
+	}
+	return opts.Root
+}
+
+// target returns the Lua version to compile for, defaultTarget unless
+// --target or tokimun.toml picks one
+func (opts CompileOptions) target() string {
+	if opts.Target == "" {
+		return defaultTarget
+	}
+	return opts.Target
+}
+
+// luaTargets are the accepted --target values
+var luaTargets = []string{"5.1", "5.2", "5.3", "5.4", "luajit"}
+
+// boolFlags returns the boolean options that tokimun.toml can set, by
+// flag name, so the command line can turn them either way. header stands
+// in for opts.NoHeader, which is the other way around.
+func (opts *CompileOptions) boolFlags(header *bool) map[string]*bool {
+	return map[string]*bool{
+		"header":          header,
+		"preserve-lines":  &opts.PreserveLines,
+		"keep-comments":   &opts.KeepComments,
+		"wrap-main":       &opts.WrapMain,
+		"annotations":     &opts.Annotations,
+		"check-balanced":  &opts.CheckBalanced,
+		"lint":            &opts.Lint,
+		"luacheck-ignore": &opts.LuacheckIgnore,
+	}
 }
 
 func parseCompileOptions(args []string) ([]string, CompileOptions) {
-	opts := CompileOptions{}
+	// Options from tokimun.toml are the defaults the flags override
+	opts, err := loadManifest()
+	if err != nil {
+		fatal("error: %v", err)
+	}
 	files := []string{}
+	header := !opts.NoHeader
+	boolFlags := opts.boolFlags(&header)
 
 	i := 0
 	for i < len(args) {
 		arg := args[i]
+
+		// --name, --name=true, --name=false and --no-name
+		flag, value, hasValue := strings.Cut(arg, "=")
+		name := strings.TrimPrefix(flag, "--")
+		field, on := boolFlags[name], true
+		if off, ok := strings.CutPrefix(name, "no-"); ok && field == nil && !hasValue {
+			field, on = boolFlags[off], false
+		}
+		if field != nil && strings.HasPrefix(flag, "--") {
+			if hasValue {
+				if on, err = strconv.ParseBool(value); err != nil {
+					fatal("error: invalid value '%s' for %s (expected true or false)", value, flag)
+				}
+			}
+			*field = on
+			i++
+			continue
+		}
+
+		// --flag=value is the same as --flag value
+		if name, value, ok := strings.Cut(arg, "="); ok && strings.HasPrefix(arg, "--") {
+			args = append(args[:i:i], append([]string{name, value}, args[i+1:]...)...)
+			arg = name
+		}
 		switch arg {
 		case "-o", "--output":
 			if i+1 < len(args) {
@@ -94,16 +295,190 @@ func parseCompileOptions(args []string) ([]string, CompileOptions) {
 			} else {
 				fatal("error: -o requires an output file argument")
 			}
+		case "--entry":
+			if i+1 < len(args) {
+				opts.Entry = args[i+1]
+				i += 2
+			} else {
+				fatal("error: --entry requires a file argument")
+			}
+		case "--output-dir":
+			if i+1 < len(args) {
+				opts.OutputDir = args[i+1]
+				i += 2
+			} else {
+				fatal("error: --output-dir requires a directory argument")
+			}
+		case "--target":
+			if i+1 < len(args) {
+				opts.Target = args[i+1]
+				i += 2
+			} else {
+				fatal("error: --target requires a Lua version argument")
+			}
+		case "--format":
+			if i+1 < len(args) {
+				opts.Format = args[i+1]
+				i += 2
+			} else {
+				fatal("error: --format requires a format argument")
+			}
+		case "--error-format":
+			if i+1 < len(args) {
+				opts.ErrorFormat = args[i+1]
+				i += 2
+			} else {
+				fatal("error: --error-format requires a format argument")
+			}
+		case "--indent":
+			if i+1 < len(args) {
+				opts.Indent = args[i+1]
+				i += 2
+			} else {
+				fatal("error: --indent requires 'tab' or a number of spaces")
+			}
+		case "--max-line-length":
+			if i+1 >= len(args) {
+				fatal("error: --max-line-length requires a number of columns")
+			}
+			width, err := strconv.Atoi(args[i+1])
+			if err != nil || width <= 0 {
+				fatal("error: invalid line length '%s' (expected a positive number of columns)", args[i+1])
+			}
+			opts.MaxLineLength = width
+			i += 2
+		case "--globals":
+			if i+1 < len(args) {
+				opts.Globals = args[i+1]
+				i += 2
+			} else {
+				fatal("error: --globals requires 'lua' or 'local'")
+			}
+		case "--only":
+			if i+1 < len(args) {
+				opts.Only = args[i+1]
+				i += 2
+			} else {
+				fatal("error: --only requires a regular expression")
+			}
+		case "--exclude":
+			if i+1 < len(args) {
+				opts.Exclude = args[i+1]
+				i += 2
+			} else {
+				fatal("error: --exclude requires a regular expression")
+			}
+		case "--emit-metadata":
+			if i+1 < len(args) {
+				opts.EmitMetadata = args[i+1]
+				i += 2
+			} else {
+				fatal("error: --emit-metadata requires an output file")
+			}
+		case "--profile":
+			// Hidden, for profiling the compiler itself
+			if i+1 < len(args) {
+				opts.Profile = args[i+1]
+				i += 2
+			} else {
+				fatal("error: --profile requires an output file")
+			}
+		case "--interpreter":
+			if i+1 < len(args) {
+				opts.Interpreter = args[i+1]
+				i += 2
+			} else {
+				fatal("error: --interpreter requires a program name or path")
+			}
+		case "--lua-path":
+			if i+1 < len(args) {
+				opts.LuaPath = args[i+1]
+				i += 2
+			} else {
+				fatal("error: --lua-path requires a search path")
+			}
+		case "--lua-cpath":
+			if i+1 < len(args) {
+				opts.LuaCPath = args[i+1]
+				i += 2
+			} else {
+				fatal("error: --lua-cpath requires a search path")
+			}
+		case "--root":
+			if i+1 < len(args) {
+				opts.Root = args[i+1]
+				i += 2
+			} else {
+				fatal("error: --root requires a directory argument")
+			}
+		case "-I", "--include":
+			if i+1 < len(args) {
+				opts.Include = append(opts.Include, args[i+1])
+				i += 2
+			} else {
+				fatal("error: %s requires a directory argument", arg)
+			}
 		case "-p", "--print":
 			opts.PrintOnly = true
 			i++
 		case "-q", "--quiet":
-			opts.Quiet = true
+			opts.Quiet = max(opts.Quiet, 1)
+			i++
+		case "-qq", "--silent":
+			opts.Quiet = 2
 			i++
 		case "--stdout":
 			opts.ToStdout = true
 			i++
+		case "--keep-temp":
+			opts.KeepTemp = true
+			i++
+		case "--strip-comments":
+			opts.KeepComments = false
+			i++
+		case "--dump-tokens":
+			opts.DumpTokens = true
+			i++
+		case "--emit-ast":
+			opts.EmitAST = true
+			i++
+		case "--no-glob":
+			opts.NoGlob = true
+			i++
+		case "--watch":
+			opts.Watch = true
+			i++
+		case "--run":
+			opts.Run = true
+			i++
+		case "--safe-float-loops":
+			opts.SafeFloatLoops = true
+			i++
+		case "--no-negative-index":
+			opts.NoNegativeIndex = true
+			i++
+		case "--emit-lua-version":
+			opts.EmitLuaVersion = true
+			i++
+		case "--stats":
+			opts.Stats = true
+			i++
+		case "--force":
+			opts.Force = true
+			i++
+		case "--dry-run":
+			opts.DryRun = true
+			i++
+		case "--list-interpreters":
+			opts.ListInterpreters = true
+			i++
 		default:
+			// -Idir is the same as -I dir
+			if dir, ok := strings.CutPrefix(arg, "-I"); ok {
+				opts.Include = append(opts.Include, dir)
+				i++
+				break
+			}
 			if strings.HasPrefix(arg, "-") {
 				fatal("error: unknown option '%s'", arg)
 			}
@@ -112,37 +487,352 @@ func parseCompileOptions(args []string) ([]string, CompileOptions) {
 		}
 	}
 
+	opts.NoHeader = !header
+
+	if opts.Target != "" {
+		valid := false
+		for _, target := range luaTargets {
+			valid = valid || target == opts.Target
+		}
+		if !valid {
+			fatal("error: unknown target '%s' (expected one of %s)", opts.Target, strings.Join(luaTargets, ", "))
+		}
+	}
+
+	if opts.ErrorFormat != "" {
+		valid := false
+		for _, format := range errorFormats {
+			valid = valid || format == opts.ErrorFormat
+		}
+		if !valid {
+			fatal("error: unknown error format '%s' (expected one of %s)", opts.ErrorFormat, strings.Join(errorFormats, ", "))
+		}
+	}
+
+	if _, err := indentUnit(opts.Indent); err != nil {
+		fatal("error: %v", err)
+	}
+
+	if _, err := regexp.Compile(opts.Only); err != nil {
+		fatal("error: invalid --only pattern '%s': %v", opts.Only, err)
+	}
+	if _, err := regexp.Compile(opts.Exclude); err != nil {
+		fatal("error: invalid --exclude pattern '%s': %v", opts.Exclude, err)
+	}
+
+	switch opts.Globals {
+	case "", "lua", "local":
+	default:
+		fatal("error: unknown globals mode '%s' (expected lua or local)", opts.Globals)
+	}
+
+	switch opts.Format {
+	case "", "json", "text":
+	default:
+		fatal("error: unknown format '%s' (expected json or text)", opts.Format)
+	}
+
+	if opts.Profile != "" {
+		startProfile(opts.Profile)
+	}
+
 	return files, opts
 }
 
+// handleVersion prints the version, or with --json the version and
+// build information for tools to check
+func handleVersion(args []string) {
+	if len(args) == 0 {
+		fmt.Printf("tokimun v%s\n", version)
+		return
+	}
+	if len(args) > 1 || args[0] != "--json" {
+		fatal("error: unknown option '%s'\n\nUsage: tokimun version [--json]", args[0])
+	}
+
+	target := defaultTarget
+	if opts, err := loadManifest(); err == nil {
+		target = opts.target()
+	}
+
+	info := struct {
+		Version   string `json:"version"`
+		LuaTarget string `json:"luaTarget"`
+		Commit    string `json:"commit,omitempty"`
+		GoVersion string `json:"goVersion"`
+	}{version, target, buildCommit(), runtime.Version()}
+
+	data, _ := json.Marshal(info)
+	fmt.Println(string(data))
+}
+
+// buildCommit returns the commit tokimun was built from, falling back
+// to the one go build records when building from a git checkout
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return ""
+}
+
 func handleCompile(args []string) {
 	files, opts := parseCompileOptions(args)
-
 	if len(files) == 0 {
+		files = opts.Sources
+	}
+
+	if len(files) == 0 && opts.Entry == "" {
 		fatal("error: no input files specified\n\nUsage: tokimun compile <file.tkm> [options]")
 	}
 
-	// Expand globs
+	files = filterFiles(expandFiles(files, opts), opts)
+	if opts.Entry != "" {
+		if err := compileEntry(files, opts); err != nil {
+			reportError(err, opts)
+			exit(1)
+		}
+		return
+	}
+
+	failed := compileFiles(files, opts)
+
+	if opts.EmitMetadata != "" {
+		if err := writeMetadata(opts.EmitMetadata); err != nil {
+			fatal("error: cannot write '%s': %v", opts.EmitMetadata, err)
+		}
+	}
+
+	if failed > 0 {
+		if len(files) > 1 {
+			printDiagnostic(diagnostic{Severity: "error", Message: fmt.Sprintf("%d of %d files failed", failed, len(files))}, opts)
+		}
+		exit(1)
+	}
+}
+
+// fileMetadata collects the symbols of each compiled file for
+// --emit-metadata
+var fileMetadata = map[string]compiler.Metadata{}
+
+// writeMetadata writes the collected symbols as JSON, keyed by file
+func writeMetadata(path string) error {
+	data, err := json.MarshalIndent(fileMetadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fsys.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// handleLint compiles files in lint mode without writing output, and
+// exits with status 1 if anything was reported
+func handleLint(args []string) {
+	files, opts := parseCompileOptions(args)
+	if len(files) == 0 {
+		files = opts.Sources
+	}
+
+	if len(files) == 0 {
+		fatal("error: no input files specified\n\nUsage: tokimun lint <file.tkm>")
+	}
+
+	opts.Lint = true
+	if lintFiles(expandFiles(files, opts), opts) {
+		exit(1)
+	}
+}
+
+// lintFiles reports the lint warnings of each file, and the error of any
+// that doesn't compile without stopping at it. It returns whether there
+// was anything to report.
+func lintFiles(files []string, opts CompileOptions) bool {
+	failed := false
+	for _, file := range files {
+		source, err := fsys.ReadFile(file)
+		if err != nil {
+			reportError(fmt.Errorf("cannot read '%s': %v", file, err), opts)
+			failed = true
+			continue
+		}
+
+		options := compilerOptions(file, opts)
+		options.Warn = func(w compiler.Warning) {
+			failed = true
+			reportWarning(file, w, opts)
+		}
+		if _, err := compiler.Compile(string(source), options); err != nil {
+			reportError(sourceError(file, err), opts)
+			failed = true
+		}
+	}
+	return failed
+}
+
+// expandFiles expands glob patterns in the file arguments, and replaces
+// directories with the .tkm files anywhere under them
+func expandFiles(files []string, opts CompileOptions) []string {
 	expandedFiles := []string{}
 	for _, pattern := range files {
-		matches, err := filepath.Glob(pattern)
-		if err != nil {
-			fatal("error: invalid file pattern '%s': %v", pattern, err)
+		matches := []string{pattern}
+		if !opts.NoGlob {
+			var err error
+			matches, err = fsys.Glob(pattern)
+			if err != nil {
+				fatal("error: invalid file pattern '%s': %v", pattern, err)
+			}
+			if len(matches) == 0 {
+				if strings.ContainsAny(pattern, "*?[") {
+					fatal("error: no files matched pattern '%s'", pattern)
+				}
+				// Not a glob, treat as literal filename so a missing
+				// file gets the normal read error
+				matches = []string{pattern}
+			}
 		}
-		if len(matches) == 0 {
-			// Not a glob, treat as literal filename
-			expandedFiles = append(expandedFiles, pattern)
-		} else {
-			expandedFiles = append(expandedFiles, matches...)
+
+		for _, match := range matches {
+			if info, err := fsys.Stat(match); err != nil || !info.IsDir() {
+				expandedFiles = append(expandedFiles, match)
+				continue
+			}
+			err := fsys.WalkDir(match, func(path string, entry fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if !entry.IsDir() && strings.HasSuffix(path, ".tkm") {
+					expandedFiles = append(expandedFiles, path)
+				}
+				return nil
+			})
+			if err != nil {
+				fatal("error: cannot read directory '%s': %v", match, err)
+			}
 		}
 	}
+	return expandedFiles
+}
 
-	for _, file := range expandedFiles {
-		if err := compileFile(file, opts); err != nil {
-			fmt.Fprintf(os.Stderr, "error: %v\n", err)
-			os.Exit(1)
+// filterFiles keeps the files --only matches and --exclude doesn't,
+// saying how many were left out
+func filterFiles(files []string, opts CompileOptions) []string {
+	if opts.Only == "" && opts.Exclude == "" {
+		return files
+	}
+	only := regexp.MustCompile(opts.Only)
+	exclude := regexp.MustCompile(opts.Exclude)
+
+	kept := []string{}
+	for _, file := range files {
+		if only.MatchString(file) && (opts.Exclude == "" || !exclude.MatchString(file)) {
+			kept = append(kept, file)
+		}
+	}
+	if skipped := len(files) - len(kept); skipped > 0 && opts.Quiet == 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d of %d files (--only/--exclude)\n", skipped, len(files))
+	}
+	return kept
+}
+
+// dumpTokens prints one token per line, for debugging the lexer
+func dumpTokens(inputPath string) error {
+	source, err := fsys.ReadFile(inputPath)
+	if err != nil {
+		return fmt.Errorf("cannot read '%s': %v", inputPath, err)
+	}
+
+	sourceLexer.Reset(string(source))
+	tokens, err := sourceLexer.Tokenize()
+	if err != nil {
+		return sourceError(inputPath, err)
+	}
+
+	for _, token := range tokens {
+		fmt.Printf("%d:%d\t%-16s %q\n", token.Line, token.Column, token.Type, token.Value)
+	}
+
+	return nil
+}
+
+// emitAST prints the syntax tree of a file, as JSON for tools or as an
+// indented outline for reading
+func emitAST(inputPath string, format string) error {
+	source, err := fsys.ReadFile(inputPath)
+	if err != nil {
+		return fmt.Errorf("cannot read '%s': %v", inputPath, err)
+	}
+
+	tree, err := compiler.Parse(string(source))
+	if err != nil {
+		return sourceError(inputPath, err)
+	}
+
+	if format == "text" {
+		printNode(tree, 0)
+		return nil
+	}
+
+	data, err := json.MarshalIndent(tree, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+func printNode(node *compiler.Node, depth int) {
+	fmt.Printf("%d:%d\t%s%s", node.Line, node.Column, strings.Repeat("  ", depth), node.Type)
+	if node.Value != "" {
+		fmt.Printf(" %q", node.Value)
+	}
+	fmt.Println()
+	for _, child := range node.Children {
+		printNode(child, depth+1)
+	}
+}
+
+// compileFiles compiles each of files, or dumps its tokens or tree, and
+// returns how many failed. A failed file doesn't stop the others, so
+// every error shows at once.
+func compileFiles(files []string, opts CompileOptions) int {
+	failed := 0
+	for _, file := range files {
+		var err error
+		switch {
+		case opts.DumpTokens:
+			err = dumpTokens(file)
+		case opts.EmitAST:
+			err = emitAST(file, opts.Format)
+		default:
+			err = compileFile(file, opts)
+		}
+		if err != nil {
+			reportError(err, opts)
+			failed++
+		}
+	}
+	return failed
+}
+
+// outputPathFor returns where compileFile writes the Lua for inputPath
+func outputPathFor(inputPath string, opts CompileOptions) string {
+	if opts.OutputFile != "" {
+		return opts.OutputFile
+	}
+	if opts.OutputDir != "" {
+		// Keep the layout under the root so module names still work
+		rel, err := relativeTo(opts.root(), inputPath)
+		if err != nil {
+			rel = filepath.Base(inputPath)
 		}
+		return filepath.Join(opts.OutputDir, strings.TrimSuffix(rel, ".tkm")+".lua")
 	}
+	return strings.TrimSuffix(inputPath, ".tkm") + ".lua"
 }
 
 func compileFile(inputPath string, opts CompileOptions) error {
@@ -151,44 +841,279 @@ func compileFile(inputPath string, opts CompileOptions) error {
 		return fmt.Errorf("'%s' is not a .tkm file", inputPath)
 	}
 
-	// Read input
-	source, err := os.ReadFile(inputPath)
-	if err != nil {
-		return fmt.Errorf("cannot read '%s': %v", inputPath, err)
+	// Print only once the whole file compiled, so an error doesn't
+	// leave half a program on stdout
+	if opts.PrintOnly || opts.ToStdout {
+		output, err := compileSource(inputPath, opts)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(os.Stdout, output)
+		return err
 	}
 
-	// Compile
-	output, err := Compile(string(source))
-	if err != nil {
-		return fmt.Errorf("%s: %v", inputPath, err)
+	outputPath := outputPathFor(inputPath, opts)
+
+	// Lint and stats output only comes from actually compiling
+	if !opts.Force && !opts.Lint && !opts.Stats && opts.EmitMetadata == "" && isUpToDate(inputPath, outputPath, opts) {
+		if opts.Quiet == 0 {
+			fmt.Printf("✓ %s is up to date\n", outputPath)
+		}
+		return nil
 	}
 
-	// Handle output
-	if opts.PrintOnly || opts.ToStdout {
-		fmt.Print(output)
+	// Compile to catch errors, but leave the filesystem alone
+	if opts.DryRun {
+		if err := compileSourceTo(io.Discard, inputPath, opts); err != nil {
+			return err
+		}
+		fmt.Printf("would write: %s → %s\n", inputPath, outputPath)
 		return nil
 	}
 
-	// Determine output path
-	outputPath := opts.OutputFile
-	if outputPath == "" {
-		outputPath = strings.TrimSuffix(inputPath, ".tkm") + ".lua"
+	if opts.OutputDir != "" {
+		if err := fsys.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+			return fmt.Errorf("cannot create '%s': %v", filepath.Dir(outputPath), err)
+		}
 	}
 
-	// Write output
-	if err := os.WriteFile(outputPath, []byte(output), 0644); err != nil {
+	// The output only replaces the previous one once the whole file
+	// compiled, so a failed compile leaves it alone
+	file, err := fsys.Create(outputPath, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot write '%s': %v", outputPath, err)
+	}
+	output := bufio.NewWriter(file)
+	if err := compileSourceTo(output, inputPath, opts); err != nil {
+		file.Abort()
+		return err
+	}
+	if err := output.Flush(); err != nil {
+		file.Abort()
+		return fmt.Errorf("cannot write '%s': %v", outputPath, err)
+	}
+	if err := file.Close(); err != nil {
 		return fmt.Errorf("cannot write '%s': %v", outputPath, err)
 	}
 
-	if !opts.Quiet {
+	if opts.Quiet == 0 {
 		fmt.Printf("✓ %s → %s\n", inputPath, outputPath)
 	}
 
 	return nil
 }
 
+// isUpToDate reports whether outputPath was compiled from inputPath by
+// this version of tokimun with the same options, after the input last
+// changed. Output without
+// the generated header can't be checked, so it's never up to date.
+func isUpToDate(inputPath, outputPath string, opts CompileOptions) bool {
+	input, err := fsys.Stat(inputPath)
+	if err != nil {
+		return false
+	}
+	output, err := fsys.Stat(outputPath)
+	if err != nil || !output.ModTime().After(input.ModTime()) {
+		return false
+	}
+
+	// Only the first line is needed, however big the output
+	file, err := fsys.Open(outputPath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	firstLine, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	comments := leadingComments(firstLine)
+	stamp, _, _ := strings.Cut(generatedHeader(inputPath, opts), "\n")
+	return len(comments) > 0 && comments[0] == strings.TrimPrefix(stamp, "-- ")
+}
+
+// sourceLexer is reused for every file so batch and watch compiles
+// don't reallocate the token slice each time
+var sourceLexer = compiler.NewLexer("")
+
+// compileSource reads and compiles a single input file
+func compileSource(inputPath string, opts CompileOptions) (string, error) {
+	var output strings.Builder
+	if err := compileSourceTo(&output, inputPath, opts); err != nil {
+		return "", err
+	}
+	return output.String(), nil
+}
+
+// compileSourceTo reads and compiles a single input file, writing the
+// Lua to w
+func compileSourceTo(w io.Writer, inputPath string, opts CompileOptions) error {
+	source, err := fsys.ReadFile(inputPath)
+	if err != nil {
+		return fmt.Errorf("cannot read '%s': %v", inputPath, err)
+	}
+
+	// Same as CompileTo, but timing each phase for --stats
+	lexStart := time.Now()
+	sourceLexer.Reset(string(source))
+	tokens, err := sourceLexer.Tokenize()
+	if err != nil {
+		return sourceError(inputPath, err)
+	}
+	lexTime := time.Since(lexStart)
+
+	compileStart := time.Now()
+	output := &countingWriter{w: w}
+	c := compiler.NewCompiler(tokens, compilerOptions(inputPath, opts))
+	if err := c.CompileTo(output); err != nil {
+		return sourceError(inputPath, err)
+	}
+	compileTime := time.Since(compileStart)
+	if opts.EmitMetadata != "" {
+		fileMetadata[inputPath] = c.Metadata()
+	}
+
+	if opts.Stats {
+		lines := strings.Count(strings.TrimSuffix(string(source), "\n"), "\n") + 1
+		fmt.Fprintf(os.Stderr, "%s: %d tokens, %d lines, %d bytes out, lex %v, compile %v\n",
+			inputPath, len(tokens), lines, output.n, lexTime, compileTime)
+	}
+
+	return nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
+
+// luaInterpreters are the interpreters run looks for, in order of preference
+var luaInterpreters = []string{"lua", "luajit", "lua5.4", "lua5.3", "lua5.2", "lua5.1"}
+
+// targetInterpreters are the interpreters that run each Lua target, to
+// try before the generic ones
+var targetInterpreters = map[string][]string{
+	"5.1":    {"lua5.1", "luajit"},
+	"5.2":    {"lua5.2"},
+	"5.3":    {"lua5.3"},
+	"5.4":    {"lua5.4"},
+	"luajit": {"luajit"},
+}
+
+// interpreterCandidates returns luaInterpreters with the ones for target
+// moved to the front
+func interpreterCandidates(target string) []string {
+	candidates := append([]string{}, targetInterpreters[target]...)
+	for _, interpreter := range luaInterpreters {
+		if !contains(candidates, interpreter) {
+			candidates = append(candidates, interpreter)
+		}
+	}
+	return candidates
+}
+
+// outputTarget returns the target recorded by compiler.TargetPragma at
+// the top of compiled output, or ""
+func outputTarget(output string) string {
+	pragma := strings.TrimPrefix(compiler.TargetPragma, "-- ")
+	for _, line := range strings.SplitN(output, "\n", 5) {
+		for _, comment := range leadingComments(line) {
+			if target, ok := strings.CutPrefix(comment, pragma); ok {
+				return strings.TrimSpace(target)
+			}
+		}
+	}
+	return ""
+}
+
+// leadingComments returns the text of the comments line starts with.
+// With --preserve-lines the header comments share the first line with
+// the code, written as --[[ text ]].
+func leadingComments(line string) []string {
+	comments := []string{}
+	for {
+		line = strings.TrimSpace(line)
+		rest, ok := strings.CutPrefix(line, "--")
+		if !ok {
+			return comments
+		}
+		// A block comment is --[[ text ]], or with a level --[=[ text ]=]
+		n := 1
+		for n < len(rest) && rest[n] == '=' {
+			n++
+		}
+		if n >= len(rest) || rest[0] != '[' || rest[n] != '[' {
+			return append(comments, strings.TrimSpace(rest))
+		}
+		equals := rest[1:n]
+		rest = rest[n+1:]
+		end := strings.Index(rest, "]"+equals+"]")
+		if end == -1 {
+			return comments
+		}
+		comments = append(comments, strings.TrimSpace(rest[:end]))
+		line = rest[end+len(equals)+2:]
+	}
+}
+
+// findLuaInterpreter returns the path of the preferred interpreter, or
+// when that's empty, of the first interpreter for target on the PATH
+func findLuaInterpreter(preferred string, target string) (string, error) {
+	if preferred != "" {
+		path, err := execLookPath(preferred)
+		if err != nil {
+			return "", fmt.Errorf("interpreter '%s' not found", preferred)
+		}
+		return path, nil
+	}
+
+	for _, interpreter := range interpreterCandidates(target) {
+		if path, err := execLookPath(interpreter); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no Lua interpreter found (looked for %s). Install lua or luajit", strings.Join(luaInterpreters, ", "))
+}
+
+// listInterpreters prints where each interpreter run knows about was
+// found, to help with PATH problems
+func listInterpreters(opts CompileOptions) {
+	chosen, _ := findLuaInterpreter(opts.Interpreter, opts.Target)
+	candidates := interpreterCandidates(opts.Target)
+	if opts.Interpreter != "" {
+		candidates = []string{opts.Interpreter}
+		for _, interpreter := range interpreterCandidates(opts.Target) {
+			if interpreter != opts.Interpreter {
+				candidates = append(candidates, interpreter)
+			}
+		}
+	}
+	for _, interpreter := range candidates {
+		path, err := execLookPath(interpreter)
+		switch {
+		case err != nil:
+			fmt.Printf("  %-8s not found\n", interpreter)
+		case path == chosen:
+			fmt.Printf("✓ %-8s %s (used by run)\n", interpreter, path)
+		default:
+			fmt.Printf("  %-8s %s\n", interpreter, path)
+		}
+	}
+}
+
 func handleRun(args []string) {
 	files, opts := parseCompileOptions(args)
+	if opts.ListInterpreters {
+		listInterpreters(opts)
+		return
+	}
 
 	if len(files) == 0 {
 		fatal("error: no input file specified\n\nUsage: tokimun run <file.tkm>")
@@ -200,15 +1125,26 @@ func handleRun(args []string) {
 
 	inputPath := files[0]
 
-	// Compile to temp file
-	source, err := os.ReadFile(inputPath)
+	if opts.Watch {
+		interpreter, err := findLuaInterpreter(opts.Interpreter, opts.Target)
+		if err != nil {
+			fatal("error: %v\n\nRun 'tokimun run --list-interpreters' to see what was found.", err)
+		}
+		runWatch(inputPath, interpreter, opts)
+		return
+	}
+
+	// Compile to temp file, recording the target to pick an interpreter by
+	opts.EmitLuaVersion = true
+	output, err := compileSource(inputPath, opts)
 	if err != nil {
-		fatal("error: cannot read '%s': %v", inputPath, err)
+		reportError(err, opts)
+		exit(1)
 	}
 
-	output, err := Compile(string(source))
+	interpreter, err := findLuaInterpreter(opts.Interpreter, outputTarget(output))
 	if err != nil {
-		fatal("error: %s: %v", inputPath, err)
+		fatal("error: %v\n\nRun 'tokimun run --list-interpreters' to see what was found.", err)
 	}
 
 	// Create temp file
@@ -216,77 +1152,157 @@ func handleRun(args []string) {
 	if err != nil {
 		fatal("error: cannot create temp file: %v", err)
 	}
-	defer os.Remove(tmpFile.Name())
+	if !opts.KeepTemp {
+		defer os.Remove(tmpFile.Name())
+	}
 
 	if _, err := tmpFile.WriteString(output); err != nil {
 		fatal("error: cannot write temp file: %v", err)
 	}
 	tmpFile.Close()
 
-	if !opts.Quiet {
-		fmt.Printf("✓ compiled %s\n", inputPath)
-		fmt.Println("─────────────────────────")
+	// Explicitly requested, so shown even with -q
+	if opts.KeepTemp {
+		fmt.Fprintf(os.Stderr, "temp file: %s\n", tmpFile.Name())
 	}
 
-	// Try different Lua interpreters
-	interpreters := []string{"lua", "luajit", "lua5.4", "lua5.3", "lua5.2", "lua5.1"}
-
-	var interpreter string
-	for _, interp := range interpreters {
-		if _, err := execLookPath(interp); err == nil {
-			interpreter = interp
-			break
-		}
-	}
-
-	if interpreter == "" {
-		fatal("error: no Lua interpreter found. Install lua or luajit.")
+	if opts.Quiet == 0 {
+		fmt.Printf("✓ compiled %s\n", inputPath)
+		fmt.Println("─────────────────────────")
 	}
 
 	// Execute
 	cmd := execCommand(interpreter, tmpFile.Name())
+	cmd.Env = luaEnv(opts)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
 	if err := cmd.Run(); err != nil {
-		os.Exit(1)
+		exit(1)
 	}
 }
 
 func handleWatch(args []string) {
-	files, _ := parseCompileOptions(args)
+	files, opts := parseCompileOptions(args)
+	if len(files) == 0 {
+		files = opts.Sources
+	}
 
 	if len(files) == 0 {
 		fatal("error: no files to watch\n\nUsage: tokimun watch <file.tkm>")
 	}
 
-	fmt.Println("Watch mode not yet implemented in v0.1")
-	fmt.Println("For now, use a file watcher like entr or watchexec:")
-	fmt.Println()
-	fmt.Println("  ls *.tkm | entr -c tokimun compile /_")
-	fmt.Println("  watchexec -e tkm -- tokimun compile *.tkm")
+	files = expandFiles(files, opts)
+	if opts.Run {
+		if opts.PrintOnly || opts.ToStdout {
+			fatal("error: watch --run writes its output files, so it can't be used with --print or --stdout")
+		}
+		interpreter, err := findLuaInterpreter(opts.Interpreter, opts.Target)
+		if err != nil {
+			fatal("error: %v\n\nRun 'tokimun run --list-interpreters' to see what was found.", err)
+		}
+		watchAndRun(files, interpreter, opts)
+		return
+	}
+
+	for _, file := range files {
+		if err := compileFile(file, opts); err != nil {
+			reportError(err, opts)
+		}
+	}
+
+	if opts.Quiet == 0 {
+		fmt.Printf("watching %d file(s), press Ctrl-C to stop\n", len(files))
+	}
+
+	watchFiles(files, func(changed []string) {
+		for _, file := range changed {
+			if err := compileFile(file, opts); err != nil {
+				reportError(err, opts)
+			}
+		}
+	}, nil)
 }
 
-// Compile compiles tokimun source to Lua
-func Compile(source string) (string, error) {
-	lexer := NewLexer(source)
-	tokens, err := lexer.Tokenize()
-	if err != nil {
-		return "", err
+// indentUnit turns an --indent value into the text of one indentation
+// level, "" meaning the compiler's default
+func indentUnit(indent string) (string, error) {
+	switch indent {
+	case "":
+		return "", nil
+	case "tab":
+		return "\t", nil
+	}
+	width, err := strconv.Atoi(indent)
+	if err != nil || width < 1 || width > 8 {
+		return "", fmt.Errorf("invalid indent '%s' (expected 'tab' or 1 to 8 spaces)", indent)
 	}
+	return strings.Repeat(" ", width), nil
+}
+
+// compilerOptions derives the code generation options for one input file
+func compilerOptions(inputPath string, opts CompileOptions) compiler.Options {
+	options := compiler.Options{
+		PreserveLines:   opts.PreserveLines,
+		Lint:            opts.Lint,
+		Target:          opts.target(),
+		Globals:         opts.Globals,
+		LuacheckIgnore:  opts.LuacheckIgnore,
+		EmitTarget:      opts.EmitLuaVersion,
+		NoNegativeIndex: opts.NoNegativeIndex,
+		SafeFloatLoops:  opts.SafeFloatLoops,
+		MaxLineLength:   opts.MaxLineLength,
+		KeepComments:    opts.KeepComments,
+		WrapMain:        opts.WrapMain,
+		Annotations:     opts.Annotations,
+		CheckBalanced:   opts.CheckBalanced,
+		ResolveRequire:  requireResolver(inputPath, opts.root(), opts.Include),
+		Warn: func(w compiler.Warning) {
+			reportWarning(inputPath, w, opts)
+		},
+	}
+	options.Indent, _ = indentUnit(opts.Indent)
+	if !opts.NoHeader {
+		options.Header = generatedHeader(inputPath, opts)
+	}
+	return options
+}
+
+// generatedHeader is the comment placed at the top of compiled output.
+// It names the options the output was compiled with by a fingerprint,
+// see optionsFingerprint.
+func generatedHeader(inputPath string, opts CompileOptions) string {
+	return fmt.Sprintf("-- Generated by tokimun v%s from %s (options %s); do not edit\n-- https://github.com/tokimun\n\n",
+		version, filepath.Base(inputPath), optionsFingerprint(opts))
+}
 
-	compiler := NewCompiler(tokens)
-	return compiler.Compile()
+// optionsFingerprint is a hash of the options that change the Lua that's
+// generated, so output compiled with different ones isn't up to date
+func optionsFingerprint(opts CompileOptions) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%q %q %q %d %t %t %t %t %t %t %t %t %q %q",
+		opts.target(), opts.Globals, opts.Indent, opts.MaxLineLength, opts.PreserveLines,
+		opts.KeepComments, opts.WrapMain, opts.Annotations, opts.NoNegativeIndex,
+		opts.SafeFloatLoops, opts.LuacheckIgnore, opts.EmitLuaVersion, opts.root(), opts.Include)
+	return fmt.Sprintf("%08x", h.Sum32())
 }
 
 func fatal(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, format+"\n", args...)
-	os.Exit(1)
+	exit(1)
 }
 
 // Exec helpers (platform independent)
 func execLookPath(file string) (string, error) {
+	// A path is used as is, like a shell would
+	if strings.ContainsRune(file, '/') || strings.ContainsRune(file, filepath.Separator) {
+		if _, err := os.Stat(file); err != nil {
+			return "", fmt.Errorf("not found")
+		}
+		return file, nil
+	}
+
 	// Simple PATH lookup
 	paths := filepath.SplitList(os.Getenv("PATH"))
 	for _, dir := range paths {
@@ -301,6 +1317,7 @@ func execLookPath(file string) (string, error) {
 type execCmd struct {
 	path   string
 	args   []string
+	Env    []string // The environment, or nil for ours
 	Stdin  io.Reader
 	Stdout io.Writer
 	Stderr io.Writer
@@ -313,29 +1330,67 @@ func execCommand(name string, args ...string) *execCmd {
 
 func (c *execCmd) Run() error {
 	// Use os/exec for actual execution
-	return runCommand(c.path, c.args[1:], c.Stdin, c.Stdout, c.Stderr)
+	return runCommand(c.path, c.args[1:], c.Env, c.Stdin, c.Stdout, c.Stderr)
+}
+
+// Start launches the command without waiting for it to finish
+func (c *execCmd) Start() (*os.Process, error) {
+	cmd := &osExecCmd{path: c.path, args: c.args[1:], env: c.Env, stdin: c.Stdin, stdout: c.Stdout, stderr: c.Stderr}
+	return cmd.start()
 }
 
 // This will be in a separate file for the actual os/exec import
-func runCommand(path string, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+func runCommand(path string, args []string, env []string, stdin io.Reader, stdout, stderr io.Writer) error {
 	// Lazy import to avoid issues
-	cmd := &osExecCmd{path: path, args: args, stdin: stdin, stdout: stdout, stderr: stderr}
+	cmd := &osExecCmd{path: path, args: args, env: env, stdin: stdin, stdout: stdout, stderr: stderr}
 	return cmd.run()
 }
 
 type osExecCmd struct {
 	path   string
 	args   []string
+	env    []string
 	stdin  io.Reader
 	stdout io.Writer
 	stderr io.Writer
 }
 
-func (c *osExecCmd) run() error {
+func (c *osExecCmd) start() (*os.Process, error) {
 	// Import os/exec inline
-	proc, err := os.StartProcess(c.path, append([]string{c.path}, c.args...), &os.ProcAttr{
+	return os.StartProcess(c.path, append([]string{c.path}, c.args...), &os.ProcAttr{
+		Env:   c.env,
 		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
 	})
+}
+
+// luaEnv returns our environment with LUA_PATH and LUA_CPATH set from
+// --lua-path and --lua-cpath, or nil when neither is given. Lua 5.2 and
+// later prefer versioned variables like LUA_PATH_5_4, so those are
+// dropped for the plain ones to take effect.
+func luaEnv(opts CompileOptions) []string {
+	if opts.LuaPath == "" && opts.LuaCPath == "" {
+		return nil
+	}
+	env := []string{}
+	for _, entry := range os.Environ() {
+		name, _, _ := strings.Cut(entry, "=")
+		if (opts.LuaPath != "" && strings.HasPrefix(name, "LUA_PATH")) ||
+			(opts.LuaCPath != "" && strings.HasPrefix(name, "LUA_CPATH")) {
+			continue
+		}
+		env = append(env, entry)
+	}
+	if opts.LuaPath != "" {
+		env = append(env, "LUA_PATH="+opts.LuaPath)
+	}
+	if opts.LuaCPath != "" {
+		env = append(env, "LUA_CPATH="+opts.LuaCPath)
+	}
+	return env
+}
+
+func (c *osExecCmd) run() error {
+	proc, err := c.start()
 	if err != nil {
 		return err
 	}
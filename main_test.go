@@ -0,0 +1,183 @@
+//go:build !wasm
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutputTarget(t *testing.T) {
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{"-- Generated by tokimun\n\n-- tokimun-target: 5.1\nprint(1)\n", "5.1"},
+		{"--[[ Generated by tokimun ]] --[[ tokimun-target: luajit ]] print(1)\n", "luajit"},
+		{"print(1)\n", ""},
+	}
+	for _, test := range tests {
+		if got := outputTarget(test.output); got != test.want {
+			t.Errorf("outputTarget(%q) = %q, want %q", test.output, got, test.want)
+		}
+	}
+}
+
+func TestDefaultTarget(t *testing.T) {
+	if got := compilerOptions("main.tkm", CompileOptions{}).Target; got != defaultTarget {
+		t.Errorf("compilerOptions without --target has target %q, want %q", got, defaultTarget)
+	}
+	if got := compilerOptions("main.tkm", CompileOptions{Target: "5.1"}).Target; got != "5.1" {
+		t.Errorf("compilerOptions with --target 5.1 has target %q", got)
+	}
+
+	// The default target has //, so it isn't lowered to math.floor
+	files := useFiles(t, map[string]string{"main.tkm": "print(7 // 2)\n"})
+	if err := compileFile("main.tkm", CompileOptions{Quiet: 1, NoHeader: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := files.read("main.lua"); got != "print(7 // 2)\n" {
+		t.Errorf("main.lua is %q, want %q", got, "print(7 // 2)\n")
+	}
+}
+
+func TestFindLuaInterpreter(t *testing.T) {
+	// A PATH holding only fake lua and lua5.1
+	dir := t.TempDir()
+	for _, name := range []string{"lua", "lua5.1"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir)
+
+	tests := []struct {
+		preferred string
+		target    string
+		want      string
+	}{
+		{"", "5.1", "lua5.1"},
+		{"", "5.4", "lua"},
+		{"", "", "lua"},
+		{"lua5.1", "5.4", "lua5.1"},
+		{filepath.Join(dir, "lua"), "5.1", "lua"},
+	}
+	for _, test := range tests {
+		got, err := findLuaInterpreter(test.preferred, test.target)
+		if err != nil {
+			t.Errorf("findLuaInterpreter(%q, %q): %v", test.preferred, test.target, err)
+		} else if want := filepath.Join(dir, test.want); got != want {
+			t.Errorf("findLuaInterpreter(%q, %q) = %s, want %s", test.preferred, test.target, got, want)
+		}
+	}
+
+	if _, err := findLuaInterpreter("luajit", "5.1"); err == nil {
+		t.Error("findLuaInterpreter found luajit, which isn't on PATH")
+	}
+	t.Setenv("PATH", t.TempDir())
+	if _, err := findLuaInterpreter("", "5.4"); err == nil {
+		t.Error("findLuaInterpreter found an interpreter on an empty PATH")
+	}
+}
+
+func TestManifestPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	manifest := "target = \"5.1\"\nlint = true\nheader = false\nwrap_main = true\nindent = 4\n"
+	if err := os.WriteFile(filepath.Join(dir, manifestName), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+
+	// The manifest's values are the defaults
+	_, opts := parseCompileOptions([]string{"a.tkm"})
+	if opts.Target != "5.1" || !opts.Lint || !opts.NoHeader || !opts.WrapMain || opts.Indent != "4" {
+		t.Errorf("options from the manifest are %+v", opts)
+	}
+
+	// Flags override them, booleans either way
+	files, opts := parseCompileOptions([]string{"--target", "5.4", "--lint=false", "--header", "--no-wrap-main", "--indent=tab", "a.tkm"})
+	if opts.Target != "5.4" || opts.Lint || opts.NoHeader || opts.WrapMain || opts.Indent != "tab" {
+		t.Errorf("options overriding the manifest are %+v", opts)
+	}
+	if len(files) != 1 || files[0] != "a.tkm" {
+		t.Errorf("files are %v, want [a.tkm]", files)
+	}
+
+	_, opts = parseCompileOptions([]string{"--no-header", "--preserve-lines=true", "a.tkm"})
+	if !opts.NoHeader || !opts.PreserveLines {
+		t.Errorf("--no-header --preserve-lines=true gave %+v", opts)
+	}
+}
+
+func TestFilterFiles(t *testing.T) {
+	files := []string{"src/main.tkm", "src/util.tkm", "src/util_test.tkm", "lib/vendor/json.tkm"}
+	tests := []struct {
+		only    string
+		exclude string
+		want    []string
+	}{
+		{"", "", files},
+		{"^src/", "", []string{"src/main.tkm", "src/util.tkm", "src/util_test.tkm"}},
+		{"", "_test\\.tkm$", []string{"src/main.tkm", "src/util.tkm", "lib/vendor/json.tkm"}},
+		// A file has to match --only and not --exclude
+		{"util", "_test", []string{"src/util.tkm"}},
+		{"vendor", "vendor", []string{}},
+	}
+	for _, test := range tests {
+		got := filterFiles(files, CompileOptions{Quiet: 1, Only: test.only, Exclude: test.exclude})
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("filterFiles with --only %q --exclude %q = %v, want %v", test.only, test.exclude, got, test.want)
+		}
+	}
+}
+
+func TestRunPassesLuaPath(t *testing.T) {
+	useFiles(t, map[string]string{"main.tkm": "print(1)\n"})
+
+	// A fake interpreter that records the variables it was started with
+	dir := t.TempDir()
+	record := filepath.Join(dir, "env")
+	interpreter := filepath.Join(dir, "lua")
+	script := "#!/bin/sh\necho \"$LUA_PATH|$LUA_CPATH|${LUA_PATH_5_4-unset}|$TOKIMUN_TEST\" > " + record + "\n"
+	if err := os.WriteFile(interpreter, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LUA_PATH_5_4", "./old/?.lua")
+	t.Setenv("TOKIMUN_TEST", "kept")
+
+	handleRun([]string{"-q", "--interpreter", interpreter, "--lua-path", "./?.lua;./lib/?.lua", "--lua-cpath", "./?.so", "main.tkm"})
+
+	got, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The versioned variable would win over LUA_PATH, so it's dropped
+	if want := "./?.lua;./lib/?.lua|./?.so|unset|kept\n"; string(got) != want {
+		t.Errorf("interpreter saw %q, want %q", got, want)
+	}
+}
+
+func TestIndentUnit(t *testing.T) {
+	tests := []struct {
+		indent string
+		want   string
+	}{
+		{"", ""},
+		{"tab", "\t"},
+		{"2", "  "},
+		{"4", "    "},
+		{"8", "        "},
+	}
+	for _, test := range tests {
+		if got, err := indentUnit(test.indent); err != nil || got != test.want {
+			t.Errorf("indentUnit(%q) = %q, %v, want %q", test.indent, got, err, test.want)
+		}
+	}
+	for _, indent := range []string{"0", "9", "x", "tabs"} {
+		if _, err := indentUnit(indent); err == nil {
+			t.Errorf("indentUnit(%q) didn't fail", indent)
+		}
+	}
+}
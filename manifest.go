@@ -0,0 +1,231 @@
+//go:build !wasm
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// manifestName is the project file looked for in the current directory
+// and its parents
+const manifestName = "tokimun.toml"
+
+// findManifest returns the path of the nearest tokimun.toml, or ""
+func findManifest() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, manifestName)
+		if _, err := fsys.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// loadManifest reads default options from the nearest tokimun.toml, if
+// there is one. Only the small part of TOML a manifest needs is
+// understood, one key per line:
+//
+//	target = "5.4"
+//	sources = ["src/*.tkm", "lib/*.tkm"]
+//	entry = "src/main.tkm"
+//	output_dir = "build"
+//	root = "src"
+//	include = ["lib", "vendor"]
+//	globals = "local"
+//	indent = 4
+//	max_line_length = 100
+//	lint = true
+//	luacheck_ignore = false
+//	keep_comments = false
+//	wrap_main = false
+//	annotations = false
+//	check_balanced = true
+//	preserve_lines = false
+//	header = true
+//
+// Paths are relative to the manifest's directory, which is also the
+// default root.
+func loadManifest() (CompileOptions, error) {
+	opts := CompileOptions{}
+
+	path := findManifest()
+	if path == "" {
+		return opts, nil
+	}
+
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return opts, fmt.Errorf("cannot read '%s': %v", path, err)
+	}
+
+	// Paths are written relative to the manifest but used relative to
+	// the working directory
+	cwd, _ := os.Getwd()
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		rel, err := filepath.Rel(cwd, filepath.Join(dir, p))
+		if err != nil {
+			return filepath.Join(dir, p)
+		}
+		return rel
+	}
+
+	opts.Root = resolve(".")
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(stripTOMLComment(line))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return opts, fmt.Errorf("%s:%d: sections are not supported", path, i+1)
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return opts, fmt.Errorf("%s:%d: expected 'key = value'", path, i+1)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "target":
+			opts.Target, err = parseTOMLString(value)
+		case "entry":
+			var entry string
+			entry, err = parseTOMLString(value)
+			opts.Entry = resolve(entry)
+		case "output_dir":
+			var dir string
+			dir, err = parseTOMLString(value)
+			opts.OutputDir = resolve(dir)
+		case "root":
+			var root string
+			root, err = parseTOMLString(value)
+			opts.Root = resolve(root)
+		case "include":
+			var dirs []string
+			dirs, err = parseTOMLStrings(value)
+			for _, dir := range dirs {
+				opts.Include = append(opts.Include, resolve(dir))
+			}
+		case "sources":
+			var sources []string
+			sources, err = parseTOMLStrings(value)
+			for _, source := range sources {
+				opts.Sources = append(opts.Sources, resolve(source))
+			}
+		case "globals":
+			opts.Globals, err = parseTOMLString(value)
+		case "indent":
+			// A number of spaces, or "tab"
+			if _, numErr := strconv.Atoi(value); numErr == nil {
+				opts.Indent = value
+			} else {
+				opts.Indent, err = parseTOMLString(value)
+			}
+		case "max_line_length":
+			opts.MaxLineLength, err = strconv.Atoi(value)
+			if err == nil && opts.MaxLineLength <= 0 {
+				err = fmt.Errorf("not positive")
+			}
+		case "lint":
+			opts.Lint, err = strconv.ParseBool(value)
+		case "luacheck_ignore":
+			opts.LuacheckIgnore, err = strconv.ParseBool(value)
+		case "keep_comments":
+			opts.KeepComments, err = strconv.ParseBool(value)
+		case "wrap_main":
+			opts.WrapMain, err = strconv.ParseBool(value)
+		case "annotations":
+			opts.Annotations, err = strconv.ParseBool(value)
+		case "check_balanced":
+			opts.CheckBalanced, err = strconv.ParseBool(value)
+		case "preserve_lines":
+			opts.PreserveLines, err = strconv.ParseBool(value)
+		case "header":
+			var header bool
+			header, err = strconv.ParseBool(value)
+			opts.NoHeader = !header
+		default:
+			return opts, fmt.Errorf("%s:%d: unknown key '%s'", path, i+1, key)
+		}
+		if err != nil {
+			return opts, fmt.Errorf("%s:%d: invalid value for '%s': %s", path, i+1, key, value)
+		}
+	}
+
+	return opts, nil
+}
+
+// stripTOMLComment removes a trailing # comment that isn't inside a string
+func stripTOMLComment(line string) string {
+	inString := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++ // skip the escaped character
+		case '"':
+			inString = !inString
+		case '#':
+			if !inString {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+func parseTOMLString(value string) (string, error) {
+	if !strings.HasPrefix(value, "\"") {
+		return "", fmt.Errorf("expected a string")
+	}
+	return strconv.Unquote(value)
+}
+
+// parseTOMLStrings parses a one-line array of strings
+func parseTOMLStrings(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+		return nil, fmt.Errorf("expected an array")
+	}
+	value = strings.TrimSpace(value[1 : len(value)-1])
+
+	strs := []string{}
+	for value != "" {
+		// Find the end of the next quoted string
+		end := 1
+		for end < len(value) && value[end] != '"' {
+			if value[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(value) {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		str, err := parseTOMLString(value[:end+1])
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, str)
+
+		value = strings.TrimSpace(value[end+1:])
+		value = strings.TrimSpace(strings.TrimPrefix(value, ","))
+	}
+	return strs, nil
+}
@@ -0,0 +1,43 @@
+//go:build !wasm
+
+package main
+
+import (
+	"os"
+	"runtime/pprof"
+)
+
+// profileFile is the open --profile output while a CPU profile is being
+// recorded. Profiling needs the runtime/pprof import, which only this
+// file has.
+var profileFile *os.File
+
+// startProfile records a CPU profile of the rest of the run to path, for
+// `go tool pprof`
+func startProfile(path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		fatal("error: cannot create profile '%s': %v", path, err)
+	}
+	if err := pprof.StartCPUProfile(file); err != nil {
+		file.Close()
+		fatal("error: cannot start profile: %v", err)
+	}
+	profileFile = file
+}
+
+// stopProfile finishes the profile, if one is being recorded
+func stopProfile() {
+	if profileFile == nil {
+		return
+	}
+	pprof.StopCPUProfile()
+	profileFile.Close()
+	profileFile = nil
+}
+
+// exit stops the profile before exiting, since deferred calls don't run
+func exit(code int) {
+	stopProfile()
+	os.Exit(code)
+}
@@ -0,0 +1,68 @@
+//go:build !wasm
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// requireResolver resolves relative requires in inputPath, like
+// `require "./utils"`, to dotted module names relative to root, the way
+// Lua's default package.path finds them when run from root. Modules are
+// looked up next to inputPath first, then in the include directories.
+func requireResolver(inputPath, root string, include []string) func(string) (string, error) {
+	searchPaths := append([]string{filepath.Dir(inputPath)}, include...)
+	return func(path string) (string, error) {
+		path = strings.TrimSuffix(strings.TrimSuffix(path, ".tkm"), ".lua")
+		target := findModule(searchPaths, filepath.FromSlash(path))
+		if target == "" {
+			return "", fmt.Errorf("module '%s' not found in search paths [%s]", path, strings.Join(searchPaths, ", "))
+		}
+
+		rel, err := relativeTo(root, target)
+		if err != nil {
+			return "", fmt.Errorf("module '%s' is outside the project root '%s'", path, root)
+		}
+		if strings.Contains(filepath.Base(rel), ".") {
+			return "", fmt.Errorf("module '%s' can't be required by name because its file name contains '.'", path)
+		}
+
+		return strings.ReplaceAll(filepath.ToSlash(rel), "/", "."), nil
+	}
+}
+
+// findModule returns the path without extension of the first .tkm or
+// .lua file for path in the search paths, or ""
+func findModule(searchPaths []string, path string) string {
+	for _, dir := range searchPaths {
+		target := filepath.Join(dir, path)
+		for _, ext := range []string{".tkm", ".lua"} {
+			if _, err := fsys.Stat(target + ext); err == nil {
+				return target
+			}
+		}
+	}
+	return ""
+}
+
+// relativeTo returns path relative to root, failing if it's outside root
+func relativeTo(root, path string) (string, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absRoot, absPath)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%s' is outside '%s'", path, root)
+	}
+	return rel, nil
+}
@@ -0,0 +1,230 @@
+//go:build !wasm
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// watchInterval is how often watched files are polled for changes
+const watchInterval = 250 * time.Millisecond
+
+// fileWatcher detects changes by polling modification times
+type fileWatcher struct {
+	paths    []string
+	modTimes map[string]time.Time
+}
+
+func newFileWatcher(paths []string) *fileWatcher {
+	w := &fileWatcher{paths: paths, modTimes: make(map[string]time.Time)}
+	w.changed()
+	return w
+}
+
+// changed returns the files modified since the last call
+func (w *fileWatcher) changed() []string {
+	changed := []string{}
+	for _, path := range w.paths {
+		info, err := fsys.Stat(path)
+		if err != nil {
+			// Editors often replace files on save; pick it up next time
+			continue
+		}
+		if modTime := info.ModTime(); !modTime.Equal(w.modTimes[path]) {
+			w.modTimes[path] = modTime
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
+
+// watchFiles calls onChange with the files that changed until the user
+// presses Ctrl-C, then calls onStop (if set) before returning. Changes
+// are collected until a poll finds nothing new, so saving several files
+// at once is handled together.
+func watchFiles(paths []string, onChange func(changed []string), onStop func()) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	watcher := newFileWatcher(paths)
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	var pending []string
+
+	for {
+		select {
+		case <-interrupt:
+			if onStop != nil {
+				onStop()
+			}
+			return
+		case <-ticker.C:
+			if changed := watcher.changed(); len(changed) > 0 {
+				for _, path := range changed {
+					if !contains(pending, path) {
+						pending = append(pending, path)
+					}
+				}
+				continue
+			}
+			if len(pending) > 0 {
+				onChange(pending)
+				pending = nil
+			}
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// childProcess is a running Lua interpreter started by run --watch
+type childProcess struct {
+	proc *os.Process
+	done chan struct{}
+}
+
+func startChild(interpreter, script string, env []string) (*childProcess, error) {
+	cmd := execCommand(interpreter, script)
+	cmd.Env = env
+	proc, err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	child := &childProcess{proc: proc, done: make(chan struct{})}
+	go func() {
+		proc.Wait()
+		close(child.done)
+	}()
+	return child, nil
+}
+
+// stop kills the process if it is still running and waits for it to exit
+func (c *childProcess) stop() {
+	if c == nil {
+		return
+	}
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	c.proc.Kill()
+	<-c.done
+}
+
+// runWatch runs inputPath and restarts it whenever the source changes.
+// A failed compile leaves the previous process running.
+func runWatch(inputPath, interpreter string, opts CompileOptions) {
+	tmpFile, err := os.CreateTemp("", "tokimun-*.lua")
+	if err != nil {
+		fatal("error: cannot create temp file: %v", err)
+	}
+	tmpFile.Close()
+	if !opts.KeepTemp {
+		defer os.Remove(tmpFile.Name())
+	} else {
+		fmt.Fprintf(os.Stderr, "temp file: %s\n", tmpFile.Name())
+	}
+
+	var child *childProcess
+
+	restart := func() {
+		output, err := compileSource(inputPath, opts)
+		if err != nil {
+			reportError(err, opts)
+			return
+		}
+
+		child.stop()
+		child = nil
+
+		if err := os.WriteFile(tmpFile.Name(), []byte(output), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "error: cannot write temp file: %v\n", err)
+			return
+		}
+
+		if opts.Quiet == 0 {
+			fmt.Printf("✓ compiled %s\n", inputPath)
+			fmt.Println("─────────────────────────")
+		}
+
+		child, err = startChild(interpreter, tmpFile.Name(), luaEnv(opts))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: cannot start %s: %v\n", interpreter, err)
+		}
+	}
+
+	restart()
+	watchFiles([]string{inputPath}, func([]string) {
+		restart()
+	}, func() {
+		child.stop()
+	})
+}
+
+// compileChanged compiles the changed files, keeping track in failing of
+// the files that don't compile, and reports whether none of them do
+func compileChanged(changed []string, failing map[string]bool, opts CompileOptions) bool {
+	for _, file := range changed {
+		if err := compileFile(file, opts); err != nil {
+			reportError(err, opts)
+			failing[file] = true
+		} else {
+			delete(failing, file)
+		}
+	}
+	return len(failing) == 0
+}
+
+// watchAndRun compiles files whenever they change and, once they all
+// compile, reruns the first one, stopping the previous run first. While
+// any file fails to compile the previous run keeps going, even if the
+// file that just changed compiles.
+func watchAndRun(files []string, interpreter string, opts CompileOptions) {
+	entry := outputPathFor(files[0], opts)
+	var child *childProcess
+	failing := map[string]bool{}
+
+	rebuild := func(changed []string) {
+		if !compileChanged(changed, failing, opts) {
+			return
+		}
+
+		child.stop()
+		child = nil
+
+		if opts.Quiet == 0 {
+			fmt.Println("─────────────────────────")
+		}
+
+		var err error
+		child, err = startChild(interpreter, entry, luaEnv(opts))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: cannot start %s: %v\n", interpreter, err)
+		}
+	}
+
+	rebuild(files)
+
+	if opts.Quiet == 0 {
+		fmt.Printf("watching %d file(s), press Ctrl-C to stop\n", len(files))
+	}
+
+	watchFiles(files, rebuild, func() {
+		child.stop()
+	})
+}
@@ -0,0 +1,33 @@
+//go:build !wasm
+
+package main
+
+import "testing"
+
+func TestCompileChangedWaitsForEveryFile(t *testing.T) {
+	files := useFiles(t, map[string]string{
+		"a.tkm": "print(1)\n",
+		"b.tkm": "local x = = 2\n",
+	})
+	opts := CompileOptions{Quiet: 2, NoHeader: true}
+	failing := map[string]bool{}
+
+	captureStderr(t, func() {
+		if compileChanged([]string{"a.tkm", "b.tkm"}, failing, opts) {
+			t.Error("compileChanged succeeded with b.tkm broken")
+		}
+
+		// a.tkm compiling again doesn't make b.tkm work
+		if compileChanged([]string{"a.tkm"}, failing, opts) {
+			t.Error("compileChanged succeeded after a change to a.tkm while b.tkm is broken")
+		}
+
+		files.WriteFile("b.tkm", []byte("print(2)\n"), 0644)
+		if !compileChanged([]string{"b.tkm"}, failing, opts) {
+			t.Errorf("compileChanged failed once b.tkm was fixed, failing %v", failing)
+		}
+	})
+	if files.read("b.lua") != "print(2)\n" {
+		t.Errorf("b.lua is %q", files.read("b.lua"))
+	}
+}